@@ -0,0 +1,96 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Checking the bucket before a sync
+
+package propolis
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"os"
+)
+
+// Issue a HEAD request for the bucket itself, which succeeds if the
+// bucket exists and the credentials can use it.
+func (p *Propolis) HeadBucketRequest() (err os.Error) {
+	var resp *http.Response
+	if resp, err = p.SendRequest("HEAD", false, "", p.keyUrl("", nil), nil, "", nil, nil); err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+// Create the bucket in p.Region. S3 puts a bucket created without a
+// location constraint in us-east-1, and rejects that region by name.
+func (p *Propolis) CreateBucketRequest() (err os.Error) {
+	var body io.ReadCloser
+	var extra http.Header
+	if p.Region != "" && p.Region != "us-east-1" {
+		body = newDocument("<CreateBucketConfiguration><LocationConstraint>" +
+			p.Region + "</LocationConstraint></CreateBucketConfiguration>")
+		extra = make(http.Header)
+		extra.Set("Content-Type", "application/xml")
+	}
+	var resp *http.Response
+	if resp, err = p.SendRequest("PUT", false, "", p.keyUrl("", nil), body, "", nil, extra); err != nil {
+		return
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	return
+}
+
+// Make sure the bucket is there and usable before anything else
+// happens, so a missing bucket or bad credentials are reported
+// plainly instead of as a failure partway through the scan. A missing
+// bucket is created if p.CreateBucket is set.
+func (p *Propolis) checkBucket() (err os.Error) {
+	if err = p.HeadBucketRequest(); err == nil {
+		return
+	}
+	e, ok := err.(*S3Error)
+	if !ok {
+		return fmt.Errorf("checking bucket %s: %v", p.Bucket, err)
+	}
+	switch e.StatusCode {
+	case 404:
+		if !p.CreateBucket {
+			return fmt.Errorf("bucket %s does not exist (see -create-bucket)", p.Bucket)
+		}
+		if p.Practice || p.StatusOnly {
+			return fmt.Errorf("bucket %s does not exist", p.Bucket)
+		}
+		p.Status("Creating bucket...")
+		if err = p.CreateBucketRequest(); err != nil {
+			return fmt.Errorf("creating bucket %s: %v", p.Bucket, err)
+		}
+		return nil
+	case 403:
+		return fmt.Errorf("access denied to bucket %s: check the credentials, "+
+			"and that the bucket belongs to them", p.Bucket)
+	case 301:
+		return fmt.Errorf("bucket %s is in a different region than this endpoint serves", p.Bucket)
+	}
+	return fmt.Errorf("checking bucket %s: %v", p.Bucket, err)
+}
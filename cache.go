@@ -20,24 +20,153 @@
 
 // Cache of file metadata
 
-package main
+package propolis
 
 import (
+	"fmt"
 	"gosqlite.googlecode.com/hg/sqlite"
+	"io"
+	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// wait this long (in milliseconds) for a locked database before failing
+	cache_busy_timeout = 5000
+
+	// number of writes grouped into a single transaction while batching
+	cache_batch_size = 1000
+)
+
+// A metadata cache backend. The sync logic only talks to the cache
+// through this interface; Cache (sqlite) is the default implementation
+// and MemoryCache keeps everything in memory.
+type Storage interface {
+	Get(path string) (info *os.FileInfo, hashHex string, synced int64, err os.Error)
+	FindByMd5(hashHex string, size int64, preferred string) (path string, err os.Error)
+	Put(path, hashHex string, info *os.FileInfo, synced int64) os.Error
+	Delete(path string) os.Error
+	DeleteAll(paths []string) os.Error
+	Reset() os.Error
+	Scan(prefix string, fn func(hashHex string, info *os.FileInfo, synced int64)) os.Error
+	BeginBatch() os.Error
+	EndBatch() os.Error
+	Flush() os.Error
+	Close() os.Error
+
+	// The catalog lists the files found by the server scan and in the
+	// cache for the current run. Entries are marked as seen when the
+	// local scan finds them, and the unseen ones are the files that
+	// exist only on the server.
+	ResetCatalog() os.Error
+	PutCatalog(entry *CatalogEntry) os.Error
+	MergeCache(prefix string) os.Error
+	AuditCache(prefix string) os.Error
+	StaleEntries(prefix string) (paths []string, err os.Error)
+	GetCatalog(path string) (entry *CatalogEntry, err os.Error)
+	MarkSeen(path string) os.Error
+	Unseen(after string, limit int) (entries []*CatalogEntry, err os.Error)
+	ClearSeen() os.Error
+
+	// second checksums of cached contents, one kind per Hasher (see
+	// Config.Checksum). Put clears the checksums of an entry it replaces.
+	GetChecksum(path, algorithm string) (hashHex string, err os.Error)
+	PutChecksum(path, algorithm, hashHex string) os.Error
+
+	// Note that an entry stands for a hard link marker (see
+	// Propolis.HardLinks). The marker object is empty, but the entry
+	// records the size of the linked file. Put clears the mark.
+	MarkLinked(path string) os.Error
+
+	// the ETag of an object stored in parts, which is not the md5
+	// hash of its contents. Put clears it.
+	GetETag(path string) (etag string, err os.Error)
+	PutETag(path, etag string) os.Error
+
+	// the size of an object stored compressed (see Config.Gzip), which
+	// is not the size of the file the entry records. Put clears it.
+	PutStoredSize(path string, size int64) os.Error
+
+	// Progress of the current run, so an interrupted run can pick up
+	// where it stopped: named values such as the server scan marker,
+	// and the set of paths already synced.
+	GetProgress(name string) (value string, err os.Error)
+	SetProgress(name, value string) os.Error
+	MarkDone(path string) os.Error
+	IsDone(path string) (done bool, err os.Error)
+	ResetProgress() os.Error
+}
+
+// a file found by the server scan or in the cache
+type CatalogEntry struct {
+	Path     string
+	HashHex  string // md5 hash from the server scan ("" if only in the cache)
+	Size     int64  // size from the server scan
+	Modified int64  // last modified time (ns) from the server scan
+}
+
+// sqlite cache
+// the connection is shared by all queue workers, so every use
+// of it must hold the lock
 type Cache struct {
 	*sqlite.Conn
+	sync.Mutex
+
+	// prepared statements, compiled once in Connect and reused
+	getInfo      *sqlite.Stmt // metadata for a path
+	getPathExact *sqlite.Stmt // does a path have given contents?
+	getPathAny   *sqlite.Stmt // any path with given contents
+	insert       *sqlite.Stmt // add or replace an entry
+	remove       *sqlite.Stmt // delete an entry
+	markLinked   *sqlite.Stmt // flag an entry as a hard link marker
+	getETag      *sqlite.Stmt // the multipart ETag of a path
+	setETag      *sqlite.Stmt // record the multipart ETag of a path
+	setStored    *sqlite.Stmt // record the compressed size of a path
+
+	getChecksum []*sqlite.Stmt // a second checksum for a path, one per extraHashers entry
+	setChecksum []*sqlite.Stmt // record a second checksum for a path
+
+	contentsInsert *sqlite.Stmt // record the contents of a server path
+	contentsRemove *sqlite.Stmt // forget the contents of a server path
+
+	catalogInsert *sqlite.Stmt // add or replace a catalog entry
+	catalogGet    *sqlite.Stmt // an unseen catalog entry
+	catalogSeen   *sqlite.Stmt // mark a catalog entry as seen
+	catalogUnseen *sqlite.Stmt // the next group of unseen catalog entries
+
+	progressGet *sqlite.Stmt // a named progress value
+	progressSet *sqlite.Stmt // add or replace a named progress value
+	doneInsert  *sqlite.Stmt // note that a path was synced this run
+	doneGet     *sqlite.Stmt // was a path synced this run?
+
+	// batch mode state
+	batching bool // are writes being grouped into transactions?
+	pending  int  // writes since the last commit
+
+	scratch string // a copy of the cache to delete on Close ("" for the real one)
 }
 
-func Connect(filename string) (db Cache, err os.Error) {
+func Connect(filename string) (db *Cache, err os.Error) {
 	var c *sqlite.Conn
 	if c, err = sqlite.Open(filename); err != nil {
 		return
 	}
-	db = Cache{c}
+	db = &Cache{Conn: c}
+
+	// write-ahead logging lets readers proceed while a write is in progress,
+	// and the busy timeout makes contending writers wait instead of failing
+	if err = db.pragma("journal_mode = WAL"); err != nil {
+		db.Close()
+		return
+	}
+	if err = db.pragma(fmt.Sprintf("busy_timeout = %d", cache_busy_timeout)); err != nil {
+		db.Close()
+		return
+	}
+
 	err = db.Exec("CREATE TABLE IF NOT EXISTS cache (\n" +
 		"    path TEXT NOT NULL,\n" +
 		"    md5 TEXT NOT NULL,\n" +
@@ -46,6 +175,7 @@ func Connect(filename string) (db Cache, err os.Error) {
 		"    mode INTEGER,\n" +
 		"    mtime INTEGER,\n" +
 		"    size INTEGER,\n" +
+		"    synced_at INTEGER NOT NULL DEFAULT 0,\n" +
 		"    PRIMARY KEY (path)\n" +
 		")\n")
 	if err != nil {
@@ -57,108 +187,693 @@ func Connect(filename string) (db Cache, err os.Error) {
 		db.Close()
 		return
 	}
+
+	// caches from older versions do not record when each entry was
+	// last synced; treat their entries as never verified
+	var synced bool
+	if synced, err = db.columnExists("cache", "synced_at"); err != nil {
+		db.Close()
+		return
+	}
+	if !synced {
+		if err = db.Exec("ALTER TABLE cache ADD COLUMN synced_at INTEGER NOT NULL DEFAULT 0"); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	// hard link entries used to be told apart only by their empty md5
+	// hash with a nonzero size
+	var linked bool
+	if linked, err = db.columnExists("cache", "linked"); err != nil {
+		db.Close()
+		return
+	}
+	if !linked {
+		if err = db.Exec("ALTER TABLE cache ADD COLUMN linked INTEGER NOT NULL DEFAULT 0"); err != nil {
+			db.Close()
+			return
+		}
+		if err = db.Exec("UPDATE cache SET linked = 1 WHERE md5 = '" + empty_file_md5_hash + "' AND size > 0"); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	// objects stored in parts have an ETag that is not an md5 hash
+	var etag bool
+	if etag, err = db.columnExists("cache", "etag"); err != nil {
+		db.Close()
+		return
+	}
+	if !etag {
+		if err = db.Exec("ALTER TABLE cache ADD COLUMN etag TEXT NOT NULL DEFAULT ''"); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	// compressed objects are smaller on the server than the files
+	var stored bool
+	if stored, err = db.columnExists("cache", "stored_size"); err != nil {
+		db.Close()
+		return
+	}
+	if !stored {
+		if err = db.Exec("ALTER TABLE cache ADD COLUMN stored_size INTEGER NOT NULL DEFAULT 0"); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	// each kind of second checksum has a column, added as it is needed
+	for _, h := range extraHashers {
+		var present bool
+		if present, err = db.columnExists("cache", h.Name()); err != nil {
+			db.Close()
+			return
+		}
+		if !present {
+			if err = db.Exec("ALTER TABLE cache ADD COLUMN " + h.Name() + " TEXT NOT NULL DEFAULT ''"); err != nil {
+				db.Close()
+				return
+			}
+		}
+	}
+
+	// the contents index remembers the md5 hash of every object known
+	// to be on the server, including ones whose metadata is not cached,
+	// so identical files can be copied on the server instead of uploaded
+	var existed bool
+	if existed, err = db.tableExists("contents"); err != nil {
+		db.Close()
+		return
+	}
+	err = db.Exec("CREATE TABLE IF NOT EXISTS contents (\n" +
+		"    path TEXT NOT NULL,\n" +
+		"    md5 TEXT NOT NULL,\n" +
+		"    size INTEGER,\n" +
+		"    PRIMARY KEY (path)\n" +
+		")\n")
+	if err != nil {
+		db.Close()
+		return
+	}
+	err = db.Exec("CREATE INDEX IF NOT EXISTS idx_contents_md5 ON contents (md5)\n")
+	if err != nil {
+		db.Close()
+		return
+	}
+
+	// start a new index with everything the cache knows
+	if !existed {
+		if err = db.Exec("INSERT OR IGNORE INTO contents SELECT path, md5, size FROM cache"); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	// the catalog and the progress of the current run are kept until
+	// the next run starts, so an interrupted run can be resumed
+	err = db.Exec("CREATE TABLE IF NOT EXISTS catalog (\n" +
+		"    path TEXT NOT NULL,\n" +
+		"    md5 TEXT NOT NULL,\n" +
+		"    size INTEGER,\n" +
+		"    modified INTEGER,\n" +
+		"    seen INTEGER NOT NULL,\n" +
+		"    PRIMARY KEY (path)\n" +
+		")\n")
+	if err != nil {
+		db.Close()
+		return
+	}
+	err = db.Exec("CREATE TABLE IF NOT EXISTS progress (\n" +
+		"    name TEXT NOT NULL,\n" +
+		"    value TEXT NOT NULL,\n" +
+		"    PRIMARY KEY (name)\n" +
+		")\n")
+	if err != nil {
+		db.Close()
+		return
+	}
+	err = db.Exec("CREATE TABLE IF NOT EXISTS done (\n" +
+		"    path TEXT NOT NULL,\n" +
+		"    PRIMARY KEY (path)\n" +
+		")\n")
+	if err != nil {
+		db.Close()
+		return
+	}
+
+	// compile the statements used once per file
+	db.getChecksum = make([]*sqlite.Stmt, len(extraHashers))
+	db.setChecksum = make([]*sqlite.Stmt, len(extraHashers))
+	for _, elt := range db.statements() {
+		if *elt.stmt, err = db.Prepare(elt.sql); err != nil {
+			db.Close()
+			return
+		}
+	}
 	return
 }
 
-func (p *Propolis) GetFileInfo(elt *File) (err os.Error) {
+type preparedStmt struct {
+	stmt **sqlite.Stmt
+	sql  string
+}
+
+func (db *Cache) statements() []preparedStmt {
+	stmts := []preparedStmt{
+		{&db.getInfo, "SELECT md5, uid, gid, mode, mtime, size, synced_at FROM cache WHERE path = ?"},
+		{&db.getPathExact, "SELECT path FROM contents WHERE md5 = ? AND size = ? AND path = ?"},
+		{&db.getPathAny, "SELECT path FROM contents WHERE md5 = ? AND size = ? LIMIT 1"},
+		{&db.insert, "INSERT OR REPLACE INTO cache " +
+			"(path, md5, uid, gid, mode, mtime, size, synced_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"},
+		{&db.remove, "DELETE FROM cache WHERE path = ?"},
+		{&db.markLinked, "UPDATE cache SET linked = 1 WHERE path = ?"},
+		{&db.getETag, "SELECT etag FROM cache WHERE path = ?"},
+		{&db.setETag, "UPDATE cache SET etag = ? WHERE path = ?"},
+		{&db.setStored, "UPDATE cache SET stored_size = ? WHERE path = ?"},
+
+		{&db.contentsInsert, "INSERT OR REPLACE INTO contents VALUES (?, ?, ?)"},
+		{&db.contentsRemove, "DELETE FROM contents WHERE path = ?"},
+
+		{&db.catalogInsert, "INSERT OR REPLACE INTO catalog VALUES (?, ?, ?, ?, 0)"},
+		{&db.catalogGet, "SELECT md5, size, modified FROM catalog WHERE path = ? AND seen = 0"},
+		{&db.catalogSeen, "UPDATE catalog SET seen = 1 WHERE path = ?"},
+		{&db.catalogUnseen, "SELECT path, md5, size, modified FROM catalog " +
+			"WHERE seen = 0 AND path > ? ORDER BY path LIMIT ?"},
+
+		{&db.progressGet, "SELECT value FROM progress WHERE name = ?"},
+		{&db.progressSet, "INSERT OR REPLACE INTO progress VALUES (?, ?)"},
+		{&db.doneInsert, "INSERT OR IGNORE INTO done VALUES (?)"},
+		{&db.doneGet, "SELECT 1 FROM done WHERE path = ?"},
+	}
+
+	// the checksum statements exist once Connect has made room for them
+	for i := range db.getChecksum {
+		column := extraHashers[i].Name()
+		stmts = append(stmts,
+			preparedStmt{&db.getChecksum[i], "SELECT " + column + " FROM cache WHERE path = ?"},
+			preparedStmt{&db.setChecksum[i], "UPDATE cache SET " + column + " = ? WHERE path = ?"})
+	}
+	return stmts
+}
+
+// Connect to a scratch copy of the cache in filename, for a practice
+// run. Even the catalog and progress of a run are written to the cache,
+// so this is the only way to leave the real one exactly as it was. The
+// copy is deleted by Close.
+func ConnectScratch(filename string) (db *Cache, err os.Error) {
+	var fp *os.File
+	if fp, err = ioutil.TempFile("", "propolis-practice-"); err != nil {
+		return
+	}
+	scratch := fp.Name()
+	fp.Close()
+
+	// recent writes may still be in the write-ahead log
+	for _, suffix := range []string{"", "-wal"} {
+		if err = copyIfExists(filename+suffix, scratch+suffix); err != nil {
+			removeScratch(scratch)
+			return
+		}
+	}
+	if db, err = Connect(scratch); err != nil {
+		removeScratch(scratch)
+		return
+	}
+	db.scratch = scratch
+	return
+}
+
+// copy the file src to dst, unless src does not exist
+func copyIfExists(src, dst string) (err os.Error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+			err = nil
+		}
+		return
+	}
+	defer in.Close()
+	if out, err = os.Create(dst); err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
+
+// delete a scratch copy of the cache and the files sqlite keeps beside it
+func removeScratch(scratch string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(scratch + suffix)
+	}
+}
+
+// finalize the prepared statements and close the connection
+func (db *Cache) Close() (err os.Error) {
+	for _, elt := range db.statements() {
+		if *elt.stmt != nil {
+			(*elt.stmt).Finalize()
+			*elt.stmt = nil
+		}
+	}
+	err = db.Conn.Close()
+	if db.scratch != "" {
+		removeScratch(db.scratch)
+	}
+	return
+}
+
+// does the named table exist yet?
+func (db *Cache) tableExists(name string) (exists bool, err os.Error) {
 	var stmt *sqlite.Stmt
-	stmt, err = p.Db.Prepare("SELECT md5, uid, gid, mode, mtime, size " +
-		"FROM cache WHERE path = ?")
-	if err != nil {
+	if stmt, err = db.Prepare("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?"); err != nil {
 		return
 	}
 	defer stmt.Finalize()
-	if err = stmt.Exec(elt.ServerPath); err != nil || !stmt.Next() {
+	if err = stmt.Exec(name); err != nil {
 		return
 	}
-	elt.CacheInfo = new(os.FileInfo)
-	elt.CacheInfo.Name = elt.ServerPath
-	var mode int64
-	err = stmt.Scan(
-		&elt.CacheHashHex,
-		&elt.CacheInfo.Uid,
-		&elt.CacheInfo.Gid,
-		&mode,
-		&elt.CacheInfo.Mtime_ns,
-		&elt.CacheInfo.Size)
-	elt.CacheInfo.Mode = uint32(mode)
+	exists = stmt.Next()
 	return
 }
 
-func (p *Propolis) GetPathFromMd5(elt *File) (path string, err os.Error) {
-	var stmt1, stmt2 *sqlite.Stmt
-	stmt1, err = p.Db.Prepare("SELECT path FROM cache WHERE md5 = ? AND path = ?")
-	if err != nil {
+// does the named table have the named column?
+func (db *Cache) columnExists(table, column string) (exists bool, err os.Error) {
+	var stmt *sqlite.Stmt
+	if stmt, err = db.Prepare("PRAGMA table_info(" + table + ")"); err != nil {
 		return
 	}
-	defer stmt1.Finalize()
-	if err = stmt1.Exec(elt.LocalHashHex, elt.ServerPath); err != nil {
+	defer stmt.Finalize()
+	if err = stmt.Exec(); err != nil {
 		return
 	}
-	if stmt1.Next() {
-		// this path has the desired md5 hash
-		return elt.ServerPath, nil
+	for stmt.Next() {
+		// cid, name, type, notnull, dflt_value, pk
+		var cid, notnull, pk int64
+		var name, kind string
+		var dflt []byte
+		if err = stmt.Scan(&cid, &name, &kind, &notnull, &dflt, &pk); err != nil {
+			return
+		}
+		if name == column {
+			exists = true
+		}
 	}
-	stmt2, err = p.Db.Prepare("SELECT path FROM cache WHERE md5 = ? LIMIT 1")
-	if err != nil {
+	return
+}
+
+// run a pragma, discarding any result row it produces
+func (db *Cache) pragma(setting string) (err os.Error) {
+	var stmt *sqlite.Stmt
+	if stmt, err = db.Prepare("PRAGMA " + setting); err != nil {
 		return
 	}
-	defer stmt2.Finalize()
-	if err = stmt2.Exec(elt.LocalHashHex); err != nil || !stmt2.Next() {
+	defer stmt.Finalize()
+	if err = stmt.Exec(); err != nil {
 		return
 	}
-	err = stmt2.Scan(&path)
+	for stmt.Next() {
+	}
 	return
 }
 
-func (p *Propolis) SetFileInfo(elt *File, uselocal bool) (err os.Error) {
-	// clear old entry if it exists
-	if err = p.DeleteFileInfo(elt); err != nil {
+// read a pragma that returns a single number
+func (db *Cache) pragmaInt(name string) (n int64, err os.Error) {
+	var stmt *sqlite.Stmt
+	if stmt, err = db.Prepare("PRAGMA " + name); err != nil {
 		return
 	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(); err != nil || !stmt.Next() {
+		return
+	}
+	err = stmt.Scan(&n)
+	return
+}
 
-	// insert new entry
-	info := elt.LocalInfo
-	hash := elt.LocalHashHex
-	if !uselocal {
-		info = elt.CacheInfo
-		hash = elt.ServerHashHex
+// The fraction of the cache file taken up by pages freed by deletes.
+func (db *Cache) FreeRatio() (ratio float64, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var free, total int64
+	if free, err = db.pragmaInt("freelist_count"); err != nil {
+		return
+	}
+	if total, err = db.pragmaInt("page_count"); err != nil || total == 0 {
+		return
+	}
+	return float64(free) / float64(total), nil
+}
+
+// Rebuild the cache file to reclaim the space freed by deletes, along
+// with the md5 index. This rewrites the whole file, so it is only done
+// on request and never while batching.
+func (db *Cache) Vacuum() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.batching {
+		return os.NewError("cannot vacuum the cache in the middle of a batch")
+	}
+	if err = db.Exec("REINDEX idx_md5"); err != nil {
+		return
+	}
+	return db.Exec("VACUUM")
+}
+
+// execute a prepared statement that returns no rows
+// note: Exec resets the statement before binding the new arguments
+func stepStmt(stmt *sqlite.Stmt, args ...interface{}) (err os.Error) {
+	if err = stmt.Exec(args...); err != nil {
+		return
+	}
+	stmt.Next()
+	return stmt.Error()
+}
+
+// step a reused query to completion so it does not hold a read lock
+func finishStmt(stmt *sqlite.Stmt) {
+	for stmt.Next() {
+	}
+}
+
+// Start grouping cache writes into large transactions. This is much
+// faster during an initial scan that touches many files, at the cost
+// of losing up to cache_batch_size writes if the process dies.
+func (db *Cache) BeginBatch() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.batching {
+		return
+	}
+	if err = db.Exec("BEGIN TRANSACTION"); err != nil {
+		return
+	}
+	db.batching = true
+	db.pending = 0
+	return
+}
+
+// Commit any batched writes and go back to one transaction per write.
+func (db *Cache) EndBatch() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if !db.batching {
+		return
+	}
+	db.batching = false
+	err = db.Exec("COMMIT")
+	return
+}
+
+// Commit any batched writes without ending the batch, and copy the
+// write-ahead log into the database file so it does not keep growing
+// during a long run.
+func (db *Cache) Flush() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.batching && db.pending > 0 {
+		db.pending = 0
+		if err = db.Exec("COMMIT"); err != nil {
+			return
+		}
+		if err = db.Exec("BEGIN TRANSACTION"); err != nil {
+			return
+		}
+	}
+	return db.pragma("wal_checkpoint(PASSIVE)")
+}
+
+// note a write, committing once enough have accumulated in a batch
+// the caller must hold the lock
+func (db *Cache) wrote() (err os.Error) {
+	if !db.batching {
+		return
+	}
+	db.pending++
+	if db.pending < cache_batch_size {
+		return
+	}
+	db.pending = 0
+	if err = db.Exec("COMMIT"); err != nil {
+		return
+	}
+	err = db.Exec("BEGIN TRANSACTION")
+	return
+}
+
+// Get the cached metadata for a path and when it was last synced (ns).
+// info is nil if there is no entry.
+func (db *Cache) Get(path string) (info *os.FileInfo, hashHex string, synced int64, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	stmt := db.getInfo
+	defer finishStmt(stmt)
+	if err = stmt.Exec(path); err != nil || !stmt.Next() {
+		return
+	}
+	info = new(os.FileInfo)
+	info.Name = path
+	var mode int64
+	err = stmt.Scan(
+		&hashHex,
+		&info.Uid,
+		&info.Gid,
+		&mode,
+		&info.Mtime_ns,
+		&info.Size,
+		&synced)
+	info.Mode = uint32(mode)
+	return
+}
+
+// Find a server path with the given contents, preferring the given
+// path if it has a match. Returns "" if there are no matches.
+func (db *Cache) FindByMd5(hashHex string, size int64, preferred string) (path string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	stmt1 := db.getPathExact
+	defer finishStmt(stmt1)
+	if err = stmt1.Exec(hashHex, size, preferred); err != nil {
+		return
+	}
+	if stmt1.Next() {
+		// this path has the desired md5 hash
+		return preferred, nil
+	}
+	stmt2 := db.getPathAny
+	defer finishStmt(stmt2)
+	if err = stmt2.Exec(hashHex, size); err != nil || !stmt2.Next() {
+		return
 	}
-	err = p.Db.Exec("INSERT INTO cache VALUES (?, ?, ?, ?, ?, ?, ?)",
-		elt.ServerPath,
-		hash,
+	err = stmt2.Scan(&path)
+	return
+}
+
+// Add or replace the entry for a path, noting when it was synced (ns).
+func (db *Cache) Put(path, hashHex string, info *os.FileInfo, synced int64) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	err = stepStmt(db.insert,
+		path,
+		hashHex,
 		info.Uid,
 		info.Gid,
 		info.Mode,
 		info.Mtime_ns,
-		info.Size)
+		info.Size,
+		synced)
+	if err != nil {
+		return
+	}
+	if err = stepStmt(db.contentsInsert, path, hashHex, info.Size); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+// which extraHashers entry is the named algorithm?
+func checksumIndex(algorithm string) (i int, err os.Error) {
+	for i, h := range extraHashers {
+		if h.Name() == algorithm {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("no cache column for checksum %q", algorithm)
+}
+
+func (db *Cache) GetChecksum(path, algorithm string) (hashHex string, err os.Error) {
+	var i int
+	if i, err = checksumIndex(algorithm); err != nil {
+		return
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	stmt := db.getChecksum[i]
+	defer finishStmt(stmt)
+	if err = stmt.Exec(path); err != nil || !stmt.Next() {
+		return
+	}
+	err = stmt.Scan(&hashHex)
 	return
 }
 
-func (p *Propolis) DeleteFileInfo(elt *File) (err os.Error) {
-	// delete entry if it exists
-	err = p.Db.Exec("DELETE FROM cache WHERE path = ?", elt.ServerPath)
+// Record a second checksum of an existing entry.
+func (db *Cache) PutChecksum(path, algorithm, hashHex string) (err os.Error) {
+	var i int
+	if i, err = checksumIndex(algorithm); err != nil {
+		return
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if err = stepStmt(db.setChecksum[i], hashHex, path); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+// Get the multipart ETag of a path, or "" if it has none.
+func (db *Cache) GetETag(path string) (etag string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	stmt := db.getETag
+	defer finishStmt(stmt)
+	if err = stmt.Exec(path); err != nil || !stmt.Next() {
+		return
+	}
+	err = stmt.Scan(&etag)
 	return
 }
 
-func (p *Propolis) ResetCache() (err os.Error) {
-	// clear all cache entries
-	err = p.Db.Exec("DELETE FROM cache")
+// Record the multipart ETag of an existing entry.
+func (db *Cache) PutETag(path, etag string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = stepStmt(db.setETag, etag, path); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+// Record the compressed size of an existing entry.
+func (db *Cache) PutStoredSize(path string, size int64) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = stepStmt(db.setStored, size, path); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+// Flag an existing entry as a hard link marker.
+func (db *Cache) MarkLinked(path string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = stepStmt(db.markLinked, path); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+// Delete the entry for a path if it exists.
+func (db *Cache) Delete(path string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = db.removePath(path); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+// delete a path from both the cache and the contents index
+// the caller must hold the lock
+func (db *Cache) removePath(path string) (err os.Error) {
+	if err = stepStmt(db.remove, path); err != nil {
+		return
+	}
+	return stepStmt(db.contentsRemove, path)
+}
+
+// Delete a group of entries in a single transaction.
+func (db *Cache) DeleteAll(paths []string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	// a batch is already a transaction
+	if db.batching {
+		for _, path := range paths {
+			if err = db.removePath(path); err != nil {
+				return
+			}
+			if err = db.wrote(); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	if err = db.Exec("BEGIN TRANSACTION"); err != nil {
+		return
+	}
+	for _, path := range paths {
+		if err = db.removePath(path); err != nil {
+			db.Exec("ROLLBACK")
+			return
+		}
+	}
+	err = db.Exec("COMMIT")
+	return
+}
+
+// Clear all cache entries.
+func (db *Cache) Reset() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = db.Exec("DELETE FROM cache"); err != nil {
+		return
+	}
+	err = db.Exec("DELETE FROM contents")
 	return
 }
 
-func (p *Propolis) ScanCache(push bool) (err os.Error) {
-	// scan the entire cache
+// the columns Scan reads, in order
+const cache_scan_sql = "SELECT path, md5, uid, gid, mode, mtime, size, synced_at FROM cache"
+
+// Call fn for every entry whose path is inside the given directory
+// prefix ("" means every entry), with when it was last synced (ns).
+func (db *Cache) Scan(prefix string, fn func(hashHex string, info *os.FileInfo, synced int64)) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
 	var stmt *sqlite.Stmt
-	prefix := p.BucketRoot
 	if prefix != "" {
-		prefix = strings.Replace(prefix, "\\", "\\\\", -1)
-		prefix = strings.Replace(prefix, "_", "\\_", -1)
-		prefix = strings.Replace(prefix, "%", "\\%", -1)
-		prefix += "/%"
-		stmt, err = p.Db.Prepare("SELECT * FROM cache WHERE path LIKE ? ESCAPE '\\'")
+		prefix = likePrefix(prefix)
+		stmt, err = db.Prepare(cache_scan_sql + " WHERE path LIKE ? ESCAPE '\\'")
 	} else {
-		stmt, err = p.Db.Prepare("SELECT * FROM cache")
+		stmt, err = db.Prepare(cache_scan_sql)
 	}
 	if err != nil {
 		return
@@ -177,7 +892,7 @@ func (p *Propolis) ScanCache(push bool) (err os.Error) {
 	// read the results
 	for stmt.Next() {
 		info := new(os.FileInfo)
-		var mode int64
+		var mode, synced int64
 		var hashHex string
 		err = stmt.Scan(
 			&info.Name,
@@ -186,55 +901,408 @@ func (p *Propolis) ScanCache(push bool) (err os.Error) {
 			&info.Gid,
 			&mode,
 			&info.Mtime_ns,
-			&info.Size)
+			&info.Size,
+			&synced)
 		if err != nil {
 			return
 		}
 		info.Mode = uint32(mode)
+		fn(hashHex, info, synced)
+	}
+	return
+}
 
-		// see if we have a matching entry already
-		var elt *File
-		var present bool
-		if elt, present = p.Catalog[info.Name]; !present {
-			elt = p.NewFileServer(info.Name, push)
+// turn a directory prefix into a LIKE pattern matching everything inside it
+func likePrefix(prefix string) string {
+	prefix = strings.Replace(prefix, "\\", "\\\\", -1)
+	prefix = strings.Replace(prefix, "_", "\\_", -1)
+	prefix = strings.Replace(prefix, "%", "\\%", -1)
+	return prefix + "/%"
+}
+
+// run a one-off statement, optionally limited to paths inside prefix
+// the caller must hold the lock
+func (db *Cache) execPrefix(sql, prefix string) (err os.Error) {
+	if prefix == "" {
+		return db.Exec(sql)
+	}
+	return db.Exec(sql+" AND path LIKE ? ESCAPE '\\'", likePrefix(prefix))
+}
+
+// Clear the catalog at the start of a run.
+func (db *Cache) ResetCatalog() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.Exec("DELETE FROM catalog")
+}
+
+// Add a file found by the server scan to the catalog.
+func (db *Cache) PutCatalog(entry *CatalogEntry) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	err = stepStmt(db.catalogInsert, entry.Path, entry.HashHex, entry.Size, entry.Modified)
+	if err != nil {
+		return
+	}
+
+	// the contents index is keyed by md5 hash, which the ETag of an
+	// object stored in parts is not
+	if !isMultipartETag(entry.HashHex) {
+		if err = stepStmt(db.contentsInsert, entry.Path, entry.HashHex, entry.Size); err != nil {
+			return
 		}
-		elt.CacheInfo = info
-		elt.CacheHashHex = hashHex
+	}
+	return db.wrote()
+}
 
-		// store the result (if it's not already there)
-		p.Catalog[info.Name] = elt
+// Add every cache entry inside prefix that is not already in the catalog.
+func (db *Cache) MergeCache(prefix string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.execPrefix("INSERT OR IGNORE INTO catalog "+
+		"SELECT path, '', 0, 0, 0 FROM cache WHERE 1", prefix)
+}
+
+// cache entries that do not match the catalog built by the server
+// scan. The scan lists ETags, which for objects stored in parts are
+// kept apart from the md5 hash. Hard link markers are empty on the
+// server, but the cache records the size of the linked file, and the
+// scan lists the compressed size of a file stored with -gzip.
+const stale_entry_sql = "NOT EXISTS (" +
+	"SELECT 1 FROM catalog WHERE catalog.path = cache.path " +
+	"AND (catalog.md5 = cache.md5 OR catalog.md5 = cache.etag AND cache.etag != '') " +
+	"AND (catalog.size = cache.size OR cache.linked " +
+	"OR catalog.size = cache.stored_size AND cache.stored_size > 0))"
+
+// Delete cache entries inside prefix that do not match the catalog
+// built by the server scan, and forget the contents of objects that
+// are gone.
+func (db *Cache) AuditCache(prefix string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = db.execPrefix("DELETE FROM cache WHERE "+stale_entry_sql, prefix); err != nil {
+		return
+	}
+	return db.execPrefix("DELETE FROM contents WHERE NOT EXISTS ("+
+		"SELECT 1 FROM catalog WHERE catalog.path = contents.path)", prefix)
+}
+
+// List the cache entries inside prefix that AuditCache would delete,
+// in path order.
+func (db *Cache) StaleEntries(prefix string) (paths []string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	sql := "SELECT path FROM cache WHERE " + stale_entry_sql
+	var stmt *sqlite.Stmt
+	if prefix != "" {
+		stmt, err = db.Prepare(sql + " AND path LIKE ? ESCAPE '\\' ORDER BY path")
+	} else {
+		stmt, err = db.Prepare(sql + " ORDER BY path")
+	}
+	if err != nil {
+		return
+	}
+	defer stmt.Finalize()
+	if prefix != "" {
+		err = stmt.Exec(likePrefix(prefix))
+	} else {
+		err = stmt.Exec()
+	}
+	if err != nil {
+		return
+	}
+	for stmt.Next() {
+		var path string
+		if err = stmt.Scan(&path); err != nil {
+			return
+		}
+		paths = append(paths, path)
+	}
+	return
+}
+
+// Get the catalog entry for a path. entry is nil if there is none or
+// it has already been seen.
+func (db *Cache) GetCatalog(path string) (entry *CatalogEntry, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	stmt := db.catalogGet
+	defer finishStmt(stmt)
+	if err = stmt.Exec(path); err != nil || !stmt.Next() {
+		return
+	}
+	entry = &CatalogEntry{Path: path}
+	err = stmt.Scan(&entry.HashHex, &entry.Size, &entry.Modified)
+	return
+}
+
+// Note that the local scan found a path.
+func (db *Cache) MarkSeen(path string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return stepStmt(db.catalogSeen, path)
+}
+
+// Get up to limit unseen catalog entries with paths after the given
+// one, in path order. Fetching them in groups means the lock is not
+// held while the caller works through them.
+func (db *Cache) Unseen(after string, limit int) (entries []*CatalogEntry, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	stmt := db.catalogUnseen
+	defer finishStmt(stmt)
+	if err = stmt.Exec(after, limit); err != nil {
+		return
+	}
+	for stmt.Next() {
+		entry := new(CatalogEntry)
+		if err = stmt.Scan(&entry.Path, &entry.HashHex, &entry.Size, &entry.Modified); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// Mark every catalog entry as unseen again, for a resumed run that
+// repeats the local scan.
+func (db *Cache) ClearSeen() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.Exec("UPDATE catalog SET seen = 0")
+}
+
+// Get a progress value, or "" if it is not set.
+func (db *Cache) GetProgress(name string) (value string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	stmt := db.progressGet
+	defer finishStmt(stmt)
+	if err = stmt.Exec(name); err != nil || !stmt.Next() {
+		return
+	}
+	err = stmt.Scan(&value)
+	return
+}
+
+func (db *Cache) SetProgress(name, value string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = stepStmt(db.progressSet, name, value); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+// Note that a path was synced in this run.
+func (db *Cache) MarkDone(path string) (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = stepStmt(db.doneInsert, path); err != nil {
+		return
+	}
+	return db.wrote()
+}
+
+func (db *Cache) IsDone(path string) (done bool, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	stmt := db.doneGet
+	defer finishStmt(stmt)
+	if err = stmt.Exec(path); err != nil {
+		return
+	}
+	return stmt.Next(), nil
+}
+
+// Forget the progress of the last run.
+func (db *Cache) ResetProgress() (err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if err = db.Exec("DELETE FROM progress"); err != nil {
+		return
+	}
+	return db.Exec("DELETE FROM done")
+}
+
+func (p *Propolis) GetFileInfo(elt *File) (err os.Error) {
+	var info *os.FileInfo
+	var hashHex string
+	var synced int64
+	if info, hashHex, synced, err = p.Db.Get(elt.ServerPath); err != nil || info == nil {
+		return
+	}
+	elt.CacheInfo = info
+	elt.CacheHashHex = hashHex
+	elt.CacheSynced = synced
+	if p.Hasher != nil {
+		if elt.CacheChecksumHex, err = p.Db.GetChecksum(elt.ServerPath, p.Hasher.Name()); err != nil {
+			return
+		}
+	}
+
+	// the scan found the ETag of an object stored in parts; the
+	// cache knows the md5 hash of its contents
+	var etag string
+	if etag, err = p.Db.GetETag(elt.ServerPath); err != nil || etag == "" {
+		return
+	}
+	elt.ServerETag = etag
+	if elt.ServerHashHex == etag {
+		elt.ServerHashHex = hashHex
 	}
 	return
 }
 
-func (p *Propolis) AuditCache() (err os.Error) {
-	// gather entries where the cache does not match the server
-	var deathrow []*File
-	for _, elt := range p.Catalog {
-		if elt.CacheInfo != nil &&
-			(elt.ServerHashHex == "" ||
-				elt.ServerHashHex != elt.CacheHashHex ||
-				elt.ServerSize != elt.CacheInfo.Size) {
-			deathrow = append(deathrow, elt)
+// Find a server path with the same contents as elt. When a second
+// checksum is kept, a path whose recorded checksum differs is not used
+// even if the md5 hash matches.
+func (p *Propolis) GetPathFromMd5(elt *File) (path string, err os.Error) {
+	if path, err = p.Db.FindByMd5(elt.LocalHashHex, elt.LocalInfo.Size, elt.ServerPath); err != nil || path == "" {
+		return
+	}
+	if p.Hasher != nil && elt.LocalChecksumHex != "" {
+		var hashHex string
+		if hashHex, err = p.Db.GetChecksum(path, p.Hasher.Name()); err != nil {
+			return "", err
+		}
+		if hashHex != "" && hashHex != elt.LocalChecksumHex {
+			p.Log.Warnf("md5 hashes match but %s checksums do not [%s] [%s]\n", p.Hasher.Name(), path, elt.ServerPath)
+			return "", nil
 		}
 	}
-	if len(deathrow) == 0 {
+	return
+}
+
+// Record the state of a file in the cache. Practice runs leave the
+// cache alone, like everything else.
+func (p *Propolis) SetFileInfo(elt *File, uselocal bool) (err os.Error) {
+	if p.Practice {
 		return
 	}
+	info := elt.LocalInfo
+	hash := elt.LocalHashHex
+	if !uselocal {
+		info = elt.CacheInfo
+		hash = elt.ServerHashHex
+	}
 
-	// wrap all the deletes in a single transaction
-	if err = p.Db.Exec("BEGIN TRANSACTION"); err != nil {
+	// replace the old entry if it exists
+	elt.CacheSynced = time.Nanoseconds()
+	if err = p.Db.Put(elt.ServerPath, hash, info, elt.CacheSynced); err != nil {
 		return
 	}
-	for _, elt := range deathrow {
-		if err = p.Db.Exec("DELETE FROM cache WHERE path = ?", elt.ServerPath); err != nil {
+	if elt.LinkTarget != "" {
+		if err = p.Db.MarkLinked(elt.ServerPath); err != nil {
 			return
 		}
-		p.Catalog[elt.ServerPath] = nil, false
 	}
-	if err = p.Db.Exec("COMMIT"); err != nil {
+	if elt.ServerETag != "" && elt.ServerETag != hash {
+		if err = p.Db.PutETag(elt.ServerPath, elt.ServerETag); err != nil {
+			return
+		}
+	}
+	if elt.Gzip {
+		stored := elt.UploadSize
+		if !uselocal {
+			stored = elt.ServerSize
+		}
+		if stored > 0 && stored != info.Size {
+			if err = p.Db.PutStoredSize(elt.ServerPath, stored); err != nil {
+				return
+			}
+		}
+	}
+
+	// the server copy is only known to match if it recorded a hash
+	checksum := elt.CacheChecksumHex
+	if uselocal {
+		checksum = elt.LocalChecksumHex
+	}
+	if p.Hasher != nil && checksum != "" {
+		err = p.Db.PutChecksum(elt.ServerPath, p.Hasher.Name(), checksum)
+	}
+	return
+}
+
+func (p *Propolis) DeleteFileInfo(elt *File) (err os.Error) {
+	if p.Practice {
 		return
 	}
 
+	// delete entry if it exists
+	return p.Db.Delete(elt.ServerPath)
+}
+
+// Make the cache writes so far durable. This is safe to call while a
+// sync is running.
+func (p *Propolis) FlushCache() os.Error {
+	return p.Db.Flush()
+}
+
+// flush the cache every FlushInterval seconds until stop is closed
+func (p *Propolis) flushPeriodically() (stop chan bool) {
+	stop = make(chan bool)
+	ticker := time.NewTicker(int64(p.FlushInterval) * 1e9)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Log.Debugf("Flushing cache\n")
+				if err := p.FlushCache(); err != nil {
+					p.Log.Errorf("Error flushing cache: %v\n", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
 	return
 }
+
+func (p *Propolis) ResetCache() (err os.Error) {
+	if p.Practice {
+		p.Log.Infof("Would reset the cache\n")
+		return
+	}
+
+	// clear all cache entries
+	return p.Db.Reset()
+}
+
+// add the cache entries under the bucket root to the catalog
+func (p *Propolis) ScanCache() os.Error {
+	return p.Db.MergeCache(p.BucketRoot)
+}
+
+// drop cache entries under the bucket root that the server scan contradicts
+// A practice run only lists the entries that would go.
+func (p *Propolis) AuditCache() os.Error {
+	if !p.Practice {
+		return p.Db.AuditCache(p.BucketRoot)
+	}
+	paths, err := p.Db.StaleEntries(p.BucketRoot)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		p.Log.Infof("Would delete out-of-date cache entry [%s]\n", path)
+	}
+	p.Status(fmt.Sprintf("Would delete %d out-of-date cache entries.", len(paths)))
+	return nil
+}
@@ -0,0 +1,553 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package propolis
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// a regular file's metadata for cache entries
+func testInfo(size int64) *os.FileInfo {
+	return &os.FileInfo{Mode: s_ifreg | 0644, Size: size, Mtime_ns: 1300000000e9 + size}
+}
+
+// a propolis instance with a fresh sqlite cache in dir
+func newSqlitePropolis(t *testing.T, dir string) *Propolis {
+	c := testConfig(dir)
+	c.CacheBackend = "sqlite"
+	c.CacheLocation = dir
+	p, err := newTestPropolis(c)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p
+}
+
+// the sorted paths of the entries inside prefix
+func scanPaths(db Storage, prefix string) (paths []string, err os.Error) {
+	err = db.Scan(prefix, func(hashHex string, info *os.FileInfo, synced int64) {
+		paths = append(paths, info.Name)
+	})
+	sort.Strings(paths)
+	return
+}
+
+// exercise the cache entries of a Storage implementation
+func checkStorage(t *testing.T, name string, db Storage) {
+	for _, entry := range []struct {
+		path, hashHex string
+		size, synced  int64
+	}{
+		{"a/one", "1111", 10, 5},
+		{"a/two", "2222", 20, 6},
+		{"b/three", "1111", 10, 7},
+	} {
+		if err := db.Put(entry.path, entry.hashHex, testInfo(entry.size), entry.synced); err != nil {
+			t.Fatalf("%s: Put %s: %v", name, entry.path, err)
+		}
+	}
+
+	info, hashHex, synced, err := db.Get("a/one")
+	switch {
+	case err != nil:
+		t.Errorf("%s: Get: %v", name, err)
+	case info == nil:
+		t.Errorf("%s: Get found no entry for a/one", name)
+	case hashHex != "1111" || synced != 5 || info.Size != 10 || info.Mode != testInfo(10).Mode ||
+		info.Mtime_ns != testInfo(10).Mtime_ns:
+		t.Errorf("%s: Get returned %q synced %d, %+v", name, hashHex, synced, info)
+	}
+	if info, _, _, err = db.Get("a/missing"); err != nil || info != nil {
+		t.Errorf("%s: Get of a missing path returned %+v, %v", name, info, err)
+	}
+
+	// the preferred path wins, and the size must match too
+	if path, err := db.FindByMd5("1111", 10, "b/three"); err != nil || path != "b/three" {
+		t.Errorf("%s: FindByMd5 preferring b/three found %q, %v", name, path, err)
+	}
+	if path, err := db.FindByMd5("1111", 10, "c/other"); err != nil || path != "a/one" && path != "b/three" {
+		t.Errorf("%s: FindByMd5 found %q, %v", name, path, err)
+	}
+	if path, err := db.FindByMd5("1111", 11, ""); err != nil || path != "" {
+		t.Errorf("%s: FindByMd5 with the wrong size found %q, %v", name, path, err)
+	}
+
+	// checksums and ETags belong to an entry until it is replaced
+	algorithm := extraHashers[0].Name()
+	if err = db.PutChecksum("a/one", algorithm, "abcd"); err != nil {
+		t.Errorf("%s: PutChecksum: %v", name, err)
+	}
+	if checksum, err := db.GetChecksum("a/one", algorithm); err != nil || checksum != "abcd" {
+		t.Errorf("%s: GetChecksum returned %q, %v", name, checksum, err)
+	}
+	if err = db.PutETag("a/two", "ffff-2"); err != nil {
+		t.Errorf("%s: PutETag: %v", name, err)
+	}
+	if etag, err := db.GetETag("a/two"); err != nil || etag != "ffff-2" {
+		t.Errorf("%s: GetETag returned %q, %v", name, etag, err)
+	}
+	if err = db.Put("a/two", "2222", testInfo(20), 8); err != nil {
+		t.Errorf("%s: Put: %v", name, err)
+	}
+	if etag, err := db.GetETag("a/two"); err != nil || etag != "" {
+		t.Errorf("%s: Put kept the ETag %q, %v", name, etag, err)
+	}
+
+	paths, err := scanPaths(db, "a")
+	if err != nil || fmt.Sprint(paths) != "[a/one a/two]" {
+		t.Errorf("%s: Scan of a found %v, %v", name, paths, err)
+	}
+
+	// a deleted path is no longer a copy source
+	if err = db.Delete("a/one"); err != nil {
+		t.Errorf("%s: Delete: %v", name, err)
+	}
+	if info, _, _, err = db.Get("a/one"); err != nil || info != nil {
+		t.Errorf("%s: Get after Delete returned %+v, %v", name, info, err)
+	}
+	if path, err := db.FindByMd5("1111", 10, "a/one"); err != nil || path != "b/three" {
+		t.Errorf("%s: FindByMd5 after Delete found %q, %v", name, path, err)
+	}
+
+	if err = db.Reset(); err != nil {
+		t.Errorf("%s: Reset: %v", name, err)
+	}
+	if paths, err = scanPaths(db, ""); err != nil || len(paths) != 0 {
+		t.Errorf("%s: Scan after Reset found %v, %v", name, paths, err)
+	}
+}
+
+// open a fresh sqlite cache in dir
+func connectTest(t *testing.T, dir string) *Cache {
+	db, err := Connect(filepath.Join(dir, "test.sqlite"))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return db
+}
+
+// the sorted paths of a group of catalog entries
+func catalogPaths(entries []*CatalogEntry) (paths []string) {
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	return
+}
+
+// exercise the catalog of a Storage implementation, and the audit
+// that compares it with the cache entries
+func checkCatalog(t *testing.T, name string, db Storage) {
+	for _, entry := range []struct {
+		path, hashHex string
+		size          int64
+	}{
+		{"x/same", "1111", 10},
+		{"x/changed", "2222", 20},
+		{"x/gone", "3333", 30},
+		{"x/compressed", "7777", 70},
+		{"y/outside", "4444", 40},
+	} {
+		if err := db.Put(entry.path, entry.hashHex, testInfo(entry.size), 0); err != nil {
+			t.Fatalf("%s: Put %s: %v", name, entry.path, err)
+		}
+	}
+	if err := db.PutStoredSize("x/compressed", 25); err != nil {
+		t.Fatalf("%s: PutStoredSize: %v", name, err)
+	}
+	if err := db.ResetCatalog(); err != nil {
+		t.Fatalf("%s: ResetCatalog: %v", name, err)
+	}
+	for _, entry := range []*CatalogEntry{
+		&CatalogEntry{Path: "x/same", HashHex: "1111", Size: 10},
+		&CatalogEntry{Path: "x/changed", HashHex: "9999", Size: 20},
+		&CatalogEntry{Path: "x/new", HashHex: "5555", Size: 50},
+		&CatalogEntry{Path: "x/compressed", HashHex: "7777", Size: 25},
+	} {
+		if err := db.PutCatalog(entry); err != nil {
+			t.Fatalf("%s: PutCatalog %s: %v", name, entry.Path, err)
+		}
+	}
+
+	// entries the scan contradicts or did not find are stale, but only
+	// inside the prefix; the scan lists the compressed size of a file
+	// stored with -gzip
+	stale, err := db.StaleEntries("x")
+	if err != nil || fmt.Sprint(stale) != "[x/changed x/gone]" {
+		t.Errorf("%s: StaleEntries found %v, %v", name, stale, err)
+	}
+	if err = db.AuditCache("x"); err != nil {
+		t.Errorf("%s: AuditCache: %v", name, err)
+	}
+	paths, err := scanPaths(db, "")
+	if err != nil || fmt.Sprint(paths) != "[x/compressed x/same y/outside]" {
+		t.Errorf("%s: the audit left %v, %v", name, paths, err)
+	}
+
+	// objects found by the scan are copy sources even without cache entries
+	if path, err := db.FindByMd5("5555", 50, ""); err != nil || path != "x/new" {
+		t.Errorf("%s: FindByMd5 of a scanned object found %q, %v", name, path, err)
+	}
+
+	// cache entries the scan did not list join the catalog
+	if err = db.Put("x/cached", "6666", testInfo(60), 0); err != nil {
+		t.Errorf("%s: Put: %v", name, err)
+	}
+	if err = db.MergeCache("x"); err != nil {
+		t.Errorf("%s: MergeCache: %v", name, err)
+	}
+
+	// the local scan marks what it finds as seen
+	entry, err := db.GetCatalog("x/new")
+	if err != nil || entry == nil || entry.HashHex != "5555" || entry.Size != 50 {
+		t.Errorf("%s: GetCatalog returned %+v, %v", name, entry, err)
+	}
+	if err = db.MarkSeen("x/new"); err != nil {
+		t.Errorf("%s: MarkSeen: %v", name, err)
+	}
+	if entry, err = db.GetCatalog("x/new"); err != nil || entry != nil {
+		t.Errorf("%s: GetCatalog of a seen entry returned %+v, %v", name, entry, err)
+	}
+	entries, err := db.Unseen("", 10)
+	if err != nil || fmt.Sprint(catalogPaths(entries)) != "[x/cached x/changed x/compressed x/same]" {
+		t.Errorf("%s: Unseen found %v, %v", name, catalogPaths(entries), err)
+	}
+	if entries, err = db.Unseen("x/cached", 1); err != nil || fmt.Sprint(catalogPaths(entries)) != "[x/changed]" {
+		t.Errorf("%s: Unseen after x/cached found %v, %v", name, catalogPaths(entries), err)
+	}
+	if err = db.ClearSeen(); err != nil {
+		t.Errorf("%s: ClearSeen: %v", name, err)
+	}
+	if entries, err = db.Unseen("", 10); err != nil || len(entries) != 5 {
+		t.Errorf("%s: Unseen after ClearSeen found %v, %v", name, catalogPaths(entries), err)
+	}
+}
+
+func TestCacheStorage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	db := connectTest(t, dir)
+	defer db.Close()
+	checkStorage(t, "sqlite", db)
+	checkCatalog(t, "sqlite", db)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	checkStorage(t, "memory", NewMemoryCache())
+	checkCatalog(t, "memory", NewMemoryCache())
+}
+
+// queue workers share one connection, so concurrent writes must all land
+func TestConcurrentSetFileInfo(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		dir := tempDir(t)
+		p := newSqlitePropolis(t, dir)
+		if batch {
+			if err := p.Db.BeginBatch(); err != nil {
+				t.Fatalf("BeginBatch: %v", err)
+			}
+		}
+
+		const workers, files = 25, 40
+		done := make(chan os.Error)
+		for w := 0; w < workers; w++ {
+			go func(w int) {
+				for i := 0; i < files; i++ {
+					elt := p.NewFile(fmt.Sprintf("dir%d/file%d", w, i), true, false)
+					elt.LocalInfo = testInfo(int64(i))
+					elt.LocalHashHex = fmt.Sprintf("%032x", w*files+i)
+					if err := p.SetFileInfo(elt, true); err != nil {
+						done <- err
+						return
+					}
+				}
+				done <- nil
+			}(w)
+		}
+		for w := 0; w < workers; w++ {
+			if err := <-done; err != nil {
+				t.Errorf("SetFileInfo (batch %v): %v", batch, err)
+			}
+		}
+		if batch {
+			if err := p.Db.EndBatch(); err != nil {
+				t.Fatalf("EndBatch: %v", err)
+			}
+		}
+
+		count := 0
+		if err := p.Db.Scan("", func(hashHex string, info *os.FileInfo, synced int64) { count++ }); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		if count != workers*files {
+			t.Errorf("batch %v: %d entries in the cache, expected %d", batch, count, workers*files)
+		}
+		_, hashHex, _, err := p.Db.Get("dir7/file3")
+		if expected := fmt.Sprintf("%032x", 7*files+3); err != nil || hashHex != expected {
+			t.Errorf("batch %v: got hash %q (%v), expected %q", batch, hashHex, err, expected)
+		}
+		p.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// A propolis instance with a fresh sqlite cache for a benchmark, and a
+// function that removes it. Benchmarks have no way to fail, so setup
+// errors panic.
+func benchPropolis() (p *Propolis, cleanup func()) {
+	dir, err := ioutil.TempDir("", "propolis-bench-")
+	if err != nil {
+		panic(err.String())
+	}
+	c := testConfig(dir)
+	c.CacheBackend = "sqlite"
+	c.CacheLocation = dir
+	if p, err = newTestPropolis(c); err != nil {
+		os.RemoveAll(dir)
+		panic(err.String())
+	}
+	return p, func() {
+		p.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// record b.N cache entries, as the initial scan does
+func benchmarkPut(b *testing.B, batch bool) {
+	b.StopTimer()
+	p, cleanup := benchPropolis()
+	defer cleanup()
+	b.StartTimer()
+
+	if batch {
+		if err := p.Db.BeginBatch(); err != nil {
+			panic(err.String())
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		if err := p.Db.Put(fmt.Sprintf("dir/file%d", i), empty_file_md5_hash, testInfo(int64(i)), 0); err != nil {
+			panic(err.String())
+		}
+	}
+	if batch {
+		if err := p.Db.EndBatch(); err != nil {
+			panic(err.String())
+		}
+	}
+}
+
+// each insert is its own transaction
+func BenchmarkPutUnbatched(b *testing.B) {
+	benchmarkPut(b, false)
+}
+
+// inserts are grouped cache_batch_size to a transaction
+func BenchmarkPutBatched(b *testing.B) {
+	benchmarkPut(b, true)
+}
+
+// the number of entries the lookup benchmarks choose from
+const bench_cache_entries = 10000
+
+// a sqlite cache holding bench_cache_entries entries
+func benchFilledCache() (db *Cache, cleanup func()) {
+	p, cleanup := benchPropolis()
+	db = p.Db.(*Cache)
+	if err := db.BeginBatch(); err != nil {
+		panic(err.String())
+	}
+	for i := 0; i < bench_cache_entries; i++ {
+		if err := db.Put(fmt.Sprintf("dir/file%d", i), empty_file_md5_hash, testInfo(int64(i)), 0); err != nil {
+			panic(err.String())
+		}
+	}
+	if err := db.EndBatch(); err != nil {
+		panic(err.String())
+	}
+	return
+}
+
+// look up entries with the statement compiled once in Connect
+func BenchmarkGetPrepared(b *testing.B) {
+	b.StopTimer()
+	db, cleanup := benchFilledCache()
+	defer cleanup()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		if info, _, _, err := db.Get(fmt.Sprintf("dir/file%d", i%bench_cache_entries)); err != nil || info == nil {
+			panic("lookup failed")
+		}
+	}
+}
+
+// look up entries compiling the statement every time, as the cache
+// used to
+func BenchmarkGetUnprepared(b *testing.B) {
+	b.StopTimer()
+	db, cleanup := benchFilledCache()
+	defer cleanup()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		db.Lock()
+		stmt, err := db.Prepare("SELECT md5, uid, gid, mode, mtime, size, synced_at FROM cache WHERE path = ?")
+		if err != nil {
+			panic(err.String())
+		}
+		if err = stmt.Exec(fmt.Sprintf("dir/file%d", i%bench_cache_entries)); err != nil || !stmt.Next() {
+			panic("lookup failed")
+		}
+		info := new(os.FileInfo)
+		var hashHex string
+		var mode, synced int64
+		if err = stmt.Scan(&hashHex, &info.Uid, &info.Gid, &mode, &info.Mtime_ns, &info.Size, &synced); err != nil {
+			panic(err.String())
+		}
+		stmt.Finalize()
+		db.Unlock()
+	}
+}
+
+// the contents of the sqlite cache files (the database and its logs,
+// but not the lock) in dir, by name
+func cacheFiles(t *testing.T, dir string) map[string]string {
+	names, err := filepath.Glob(filepath.Join(dir, "*.sqlite*"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	files := make(map[string]string)
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".lock") {
+			files[filepath.Base(name)] = readFile(name)
+		}
+	}
+	return files
+}
+
+// A practice run works on a scratch copy of the sqlite cache, so the
+// real one is left byte for byte as it was, and the copy is removed.
+func TestPracticeLeavesCache(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	cachedir := tempDir(t)
+	defer os.RemoveAll(cachedir)
+	s := newFakeS3()
+	defer s.Close()
+
+	writeFile(t, filepath.Join(root, "kept.txt"), "kept\n")
+	writeFile(t, filepath.Join(root, "changed.txt"), "before\n")
+	writeFile(t, filepath.Join(root, "deleted.txt"), "deleted\n")
+	c := testConfig(root)
+	c.CacheBackend = "sqlite"
+	c.CacheLocation = cachedir
+	c.Delete = true
+	p := newFakePropolis(t, c, s)
+	runSync(t, p, true)
+	p.Close()
+	before := cacheFiles(t, cachedir)
+	if len(before) == 0 {
+		t.Fatalf("no cache file in %s", cachedir)
+	}
+
+	// every kind of change, plus a server scan that finds a key the
+	// cache does not know about
+	writeFile(t, filepath.Join(root, "changed.txt"), "after the change\n")
+	writeFile(t, filepath.Join(root, "new.txt"), "new\n")
+	if err := os.Remove(filepath.Join(root, "deleted.txt")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	s.put("remote.txt", "remote\n", nil)
+	c.Practice = true
+	c.Refresh = true
+	p = newFakePropolis(t, c, s)
+	report := runSync(t, p, true)
+	scratch := p.Db.(*Cache).scratch
+	p.Close()
+
+	if len(report.Actions) == 0 {
+		t.Errorf("the practice run planned nothing")
+	}
+	after := cacheFiles(t, cachedir)
+	if len(after) != len(before) {
+		t.Errorf("cache files were %v, now %v", keysOf(before), keysOf(after))
+	}
+	for name, contents := range before {
+		if after[name] != contents {
+			t.Errorf("%s was changed by a practice run", name)
+		}
+	}
+	if scratch == "" {
+		t.Errorf("the practice run did not use a scratch copy")
+	} else if _, err := os.Lstat(scratch); err == nil {
+		t.Errorf("the scratch copy %s was not removed", scratch)
+	}
+}
+
+// A file stored compressed is listed by the server scan with its
+// compressed size, which must not make the audit of a -refresh run
+// throw its cache entry away.
+func TestRefreshKeepsGzipEntry(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	cachedir := tempDir(t)
+	defer os.RemoveAll(cachedir)
+	s := newFakeS3()
+	defer s.Close()
+
+	writeFile(t, filepath.Join(root, "page.html"), strings.Repeat("compress me\n", 100))
+	c := sqliteConfig(root, cachedir)
+	c.Gzip = true
+	p := newFakePropolis(t, c, s)
+	runSync(t, p, true)
+	p.Close()
+	if obj := s.get("page.html"); obj == nil || obj.size >= 1200 {
+		t.Fatalf("page.html was not stored compressed")
+	}
+
+	s.clearRequests()
+	c.Refresh = true
+	p = newFakePropolis(t, c, s)
+	defer p.Close()
+	runSync(t, p, true)
+	if n := s.count("HEAD", "page.html") + s.count("PUT", "page.html") + s.count("COPY", "page.html"); n != 0 {
+		t.Errorf("page.html was looked up or sent %d times after a -refresh run", n)
+	}
+	if stale, err := p.Db.StaleEntries(""); err != nil || len(stale) != 0 {
+		t.Errorf("the audit found stale entries %v, %v", stale, err)
+	}
+	if info, _, _, err := p.Db.Get("page.html"); err != nil || info == nil || info.Size != 1200 {
+		t.Errorf("the cache entry for page.html is %+v, %v", info, err)
+	}
+}
+
+func keysOf(m map[string]string) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
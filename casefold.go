@@ -0,0 +1,143 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Keys that differ only in case on case-insensitive file systems
+
+package propolis
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// marks the local name given to a key whose own name is taken
+const case_alias_infix = ".case-"
+
+// can colliding keys be given other local names? a push or
+// bidirectional sync would upload the new names as keys of their own
+func (p *Propolis) caseAliases() bool {
+	return p.CaseInsensitiveTarget && !p.push && !p.Bidirectional
+}
+
+// Check a key the local scan did not find for a case collision before
+// it is downloaded. A colliding key is skipped, or with
+// -case-insensitive-target on a pull it is saved under an alias.
+// Returns false if the file should not be synced.
+func (p *Propolis) placeCaseCollision(elt *File) bool {
+	// a push changes the server to match, so only downloads collide
+	if p.push && !p.Bidirectional {
+		return true
+	}
+	owner := p.caseOwner(elt)
+	if owner == "" {
+		return true
+	}
+	p.recordCollided(elt)
+	if !p.caseAliases() {
+		p.Log.Warnf("Skipping [%s]: its local name is taken by [%s] (see -case-insensitive-target)\n",
+			elt.ServerPath, owner)
+		return false
+	}
+	elt.LocalPath = caseAlias(elt.LocalPath, elt.ServerPath)
+	p.Log.Warnf("Saving [%s] as [%s]: its local name is taken by [%s]\n",
+		elt.ServerPath, elt.LocalPath, owner)
+	return true
+}
+
+// Find the key that already owns the local name of a file, or "" if
+// there is none. The first key to claim a folded name keeps it, and
+// unseen keys arrive in path order, so the winner is the same on every
+// run. A file already on disk always keeps its name. Claims are kept
+// with or without -case-insensitive-target, which only decides whether
+// the losers are skipped or saved under aliases.
+func (p *Propolis) caseOwner(elt *File) string {
+	folded := strings.ToLower(elt.LocalPath)
+	if key, present := p.caseClaims[folded]; present {
+		return key
+	}
+	p.caseClaims[folded] = elt.ServerPath
+
+	// the local scan did not find this name, so anything that answers
+	// to it is a file whose name differs in case
+	name := p.nameOnDisk(elt.LocalPath)
+	if name == "" {
+		return ""
+	}
+	return path.Join(path.Dir(elt.ServerPath), p.keyName(name))
+}
+
+// Get the name of the file that answers to localpath if it differs in
+// case, or "" if there is no such file or it has exactly that name.
+func (p *Propolis) nameOnDisk(localpath string) string {
+	if _, err := os.Lstat(localpath); err != nil {
+		return ""
+	}
+	dir, err := os.Open(filepath.Dir(localpath))
+	if err != nil {
+		return ""
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return ""
+	}
+	base := p.keyName(filepath.Base(localpath))
+	folded := strings.ToLower(base)
+	match := ""
+	for _, name := range names {
+		switch key := p.keyName(name); {
+		case key == base:
+			return ""
+		case match == "" && strings.ToLower(key) == folded:
+			match = name
+		}
+	}
+	return match
+}
+
+// the local name for a colliding key: the original with a short hash
+// of the key before the extension, so it stays the same across runs
+func caseAlias(localpath, key string) string {
+	hash := md5Hasher.New()
+	hash.Write([]byte(key))
+	ext := filepath.Ext(localpath)
+	return localpath[:len(localpath)-len(ext)] + case_alias_infix +
+		hex.EncodeToString(hash.Sum())[:8] + ext
+}
+
+func isCaseAlias(name string) bool {
+	i := strings.LastIndex(name, case_alias_infix)
+	if i < 0 {
+		return false
+	}
+	rest := name[i+len(case_alias_infix):]
+	if len(rest) < 8 || rest[8:] != "" && rest[8:] != filepath.Ext(name) {
+		return false
+	}
+	for _, c := range rest[:8] {
+		if strings.IndexRune("0123456789abcdef", c) < 0 {
+			return false
+		}
+	}
+	return true
+}
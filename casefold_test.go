@@ -0,0 +1,98 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of keys that differ only in case
+
+package propolis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaseAlias(t *testing.T) {
+	alias := caseAlias("/root/dir/foo.txt", "dir/foo.txt")
+	if !strings.HasPrefix(alias, "/root/dir/foo"+case_alias_infix) || !strings.HasSuffix(alias, ".txt") {
+		t.Errorf("alias %s does not keep the name and extension", alias)
+	}
+	if alias != caseAlias("/root/dir/foo.txt", "dir/foo.txt") || alias == caseAlias("/root/dir/foo.txt", "dir/Foo.txt") {
+		t.Errorf("aliases are not a function of the key")
+	}
+	for _, test := range []struct {
+		name  string
+		alias bool
+	}{
+		{filepath.Base(alias), true},
+		{"foo" + case_alias_infix + "0123abcd", true},
+		{"foo.txt", false},
+		{"foo" + case_alias_infix + "0123abcz.txt", false},
+		{"foo" + case_alias_infix + "0123abc.txt", false},
+		{"foo" + case_alias_infix + "0123abcd.txt.bak", false},
+	} {
+		if isCaseAlias(test.name) != test.alias {
+			t.Errorf("isCaseAlias(%q) is %v", test.name, !test.alias)
+		}
+	}
+}
+
+// Two keys that differ only in case would share a local name on a
+// case-insensitive file system. The one that sorts first keeps the
+// name. The other is reported and skipped, or with
+// -case-insensitive-target saved under an alias that later pulls leave
+// alone. The keys are checked whatever the file system, so this also
+// runs on case-sensitive ones.
+func TestCaseCollisions(t *testing.T) {
+	for _, aliases := range []bool{false, true} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		s := newFakeS3()
+		defer s.Close()
+		s.put("Foo.txt", "upper\n", nil)
+		s.put("foo.txt", "lower\n", nil)
+		s.put("bar.txt", "bar\n", nil)
+
+		c := testConfig(root)
+		c.CaseInsensitiveTarget = aliases
+		c.Delete = true
+		report := runSync(t, newFakePropolis(t, c, s), false)
+
+		if strings.Join(report.Collided, " ") != "foo.txt" {
+			t.Errorf("aliases=%v: collisions reported: %v", aliases, report.Collided)
+		}
+		if readFile(filepath.Join(root, "Foo.txt")) != "upper\n" || readFile(filepath.Join(root, "bar.txt")) != "bar\n" {
+			t.Errorf("aliases=%v: Foo.txt and bar.txt were not downloaded", aliases)
+		}
+		if exists(filepath.Join(root, "foo.txt")) {
+			t.Errorf("aliases=%v: foo.txt was downloaded under its own name", aliases)
+		}
+		alias := caseAlias(filepath.Join(root, "foo.txt"), "foo.txt")
+		if got := readFile(alias); aliases && got != "lower\n" || !aliases && exists(alias) {
+			t.Errorf("aliases=%v: alias for foo.txt has %q", aliases, got)
+		}
+
+		// the next pull with -delete leaves the alias alone
+		runSync(t, newFakePropolis(t, c, s), false)
+		if aliases && readFile(alias) != "lower\n" {
+			t.Errorf("the alias for foo.txt did not survive the next pull")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Checksum algorithms for file contents
+
+package propolis
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"strings"
+)
+
+// A checksum algorithm for file contents. md5 is always computed,
+// since it is what S3 reports as the ETag of a simple upload and what
+// the cache indexes contents by. Another Hasher can be chosen to keep
+// a second checksum: it is stored in the cache, sent with each upload
+// for S3 to check, and checked again on download.
+type Hasher interface {
+	Name() string   // the name used in Config.Checksum and as its cache column
+	New() hash.Hash // start a new checksum
+	Header() string // the request header that carries the checksum, in base64
+}
+
+type hasher struct {
+	name   string
+	header string
+	new    func() hash.Hash
+}
+
+func (h *hasher) Name() string   { return h.name }
+func (h *hasher) New() hash.Hash { return h.new() }
+func (h *hasher) Header() string { return h.header }
+
+// the checksum every file gets
+var md5Hasher Hasher = &hasher{"md5", "Content-Md5", md5.New}
+
+// the checksums that can be kept besides md5, each in a cache column
+// of its own
+var extraHashers = []Hasher{
+	&hasher{"sha256", "X-Amz-Checksum-Sha256", sha256.New},
+	&hasher{"crc32c", "X-Amz-Checksum-Crc32c", newCrc32c},
+	&hasher{"crc32", "X-Amz-Checksum-Crc32", newCrc32},
+	&hasher{"sha1", "X-Amz-Checksum-Sha1", sha1.New},
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newCrc32c() hash.Hash {
+	return crc32.New(crc32cTable)
+}
+
+func newCrc32() hash.Hash {
+	return crc32.NewIEEE()
+}
+
+// The names of the checksums that can be kept besides md5.
+func ChecksumNames() (names []string) {
+	for _, h := range extraHashers {
+		names = append(names, h.Name())
+	}
+	return
+}
+
+// Find the Hasher for a second checksum by name. md5 alone (the name
+// "md5" or "") needs no second checksum, so it gives nil.
+func FindHasher(name string) (h Hasher, err os.Error) {
+	name = strings.ToLower(name)
+	if name == "" || name == md5Hasher.Name() {
+		return nil, nil
+	}
+	for _, h = range extraHashers {
+		if h.Name() == name {
+			return
+		}
+	}
+	return nil, fmt.Errorf("unknown checksum algorithm %q", name)
+}
+
+// the form a checksum (kept in hex) takes in a request header
+func checksumHeader(hexsum string) string {
+	sum, err := hex.DecodeString(hexsum)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// a checksum from a response header, in hex; checksums of multipart
+// uploads end in a part count and do not cover the contents directly,
+// so they are ignored
+func checksumFromHeader(value string) string {
+	if value == "" || strings.Contains(value, "-") {
+		return ""
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
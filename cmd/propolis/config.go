@@ -0,0 +1,214 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Config file support
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// config file read when -config is not given, relative to $HOME
+const config_file = ".propolis.toml"
+
+// Fill in options from a config file. Every command-line flag can be
+// set by name, and flags given on the command line win over the file.
+// Settings at the top of the file apply to every bucket; settings in
+// a section named after a bucket only apply when syncing that bucket
+// and win over the top-level ones:
+//
+//	concurrent = 8
+//	cache = "/home/me/.cache/propolis"
+//
+//	["my.bucket.com"]
+//	public = true
+//	acl = "auto"
+//
+// The file uses a subset of TOML: comments, bare or quoted keys and
+// section names, and string, boolean, and numeric values.
+func loadConfig(filename string) (err os.Error) {
+	if filename == "" {
+		// the default file is optional
+		home := os.Getenv("HOME")
+		if home == "" {
+			return
+		}
+		filename = path.Join(home, config_file)
+		if _, er := os.Stat(filename); er != nil {
+			return
+		}
+	}
+
+	var sections map[string]map[string]string
+	if sections, err = readConfig(filename); err != nil {
+		return
+	}
+
+	// the bucket comes from the arguments, which flag parsing has
+	// already separated from the flags
+	bucket := ""
+	for _, arg := range flag.Args() {
+		if strings.HasPrefix(arg, "s3:") {
+			bucket, _ = parseBucket(arg)
+			break
+		}
+	}
+
+	// flags given on the command line are not overridden
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for _, section := range []string{"", bucket} {
+		for name, value := range sections[section] {
+			if name == "config" || flag.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown option %q", filename, name)
+			}
+			if explicit[name] {
+				continue
+			}
+			if !flag.Set(name, value) {
+				return fmt.Errorf("%s: bad value for %s: %s", filename, name, value)
+			}
+		}
+	}
+	return
+}
+
+// Parse a config file into section -> name -> value, where the
+// top-level section is "" and string values have their quotes removed.
+func readConfig(filename string) (sections map[string]map[string]string, err os.Error) {
+	var fp *os.File
+	if fp, err = os.Open(filename); err != nil {
+		return
+	}
+	defer fp.Close()
+
+	sections = map[string]map[string]string{"": make(map[string]string)}
+	section := ""
+	read := bufio.NewReader(fp)
+	lineno := 0
+	for {
+		line, isPrefix, er := read.ReadLine()
+		if er == os.EOF {
+			break
+		}
+		if er != nil {
+			return nil, er
+		}
+		lineno++
+		if isPrefix {
+			return nil, fmt.Errorf("%s:%d: line too long", filename, lineno)
+		}
+		s := strings.TrimSpace(stripComment(string(line)))
+		if s == "" {
+			continue
+		}
+
+		// section header
+		if s[0] == '[' {
+			if s[len(s)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: bad section header", filename, lineno)
+			}
+			if section, err = configString(strings.TrimSpace(s[1 : len(s)-1])); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+			}
+			if sections[section] == nil {
+				sections[section] = make(map[string]string)
+			}
+			continue
+		}
+
+		// name = value
+		chunks := strings.SplitN(s, "=", 2)
+		if len(chunks) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", filename, lineno)
+		}
+		var name, value string
+		if name, err = configString(strings.TrimSpace(chunks[0])); err == nil {
+			value, err = configValue(strings.TrimSpace(chunks[1]))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		sections[section][name] = value
+	}
+	return
+}
+
+// drop a # comment that is not inside a quoted string
+func stripComment(line string) string {
+	var quote int
+	for i := 0; i < len(line); i++ {
+		switch c := int(line[i]); {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+// a bare or quoted name
+func configString(s string) (string, os.Error) {
+	if s == "" {
+		return "", os.NewError("missing name")
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		return configValue(s)
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", fmt.Errorf("bad name %q (names with other characters must be quoted)", s)
+		}
+	}
+	return s, nil
+}
+
+// a value in the form flag.Set expects
+func configValue(s string) (string, os.Error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		// basic strings use the same escapes as Go
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		// literal strings have no escapes
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+	if _, err := strconv.Atof64(strings.Replace(s, "_", "", -1)); err == nil {
+		return strings.Replace(s, "_", "", -1), nil
+	}
+	return "", fmt.Errorf("bad value %q (strings must be quoted)", s)
+}
@@ -0,0 +1,1284 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Command-line interface
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/russross/propolis"
+	"io"
+	"json"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+func Setup() (p *propolis.Propolis, push bool, format string) {
+	var refresh, watch, delete, paranoid, reset, practice, status, public, secure, reduced, directories, xattrs, hardlinks, follow, insecure, progress, verbose, quiet, listv1, lazyscan, cleanupmultipart, purgeversions, purgenoncurrent, waitrestore, gzip, keepgzip, sniff, force, normalize, requestpayer, anonymous, prune, bidirectional, immediatedeletes, preserveatime, specialfiles, usermetadata, resume, createbucket, sha256, nohash, verifyserver, ignorehidden, caseinsensitive bool
+	var delay, flushinterval, maxdepth, concurrent, uploadconcurrency, downloadconcurrency, listconcurrency, multipartconcurrency, timeout, pagesize, restoredays int
+	var sample, verifysample, vacuumthreshold float64
+	var accesskeyid, secretaccesskey, proxy, cacert, sessiontoken, profile, cache_location, backend, tmpdir, configfile, logfile, manifest, useragent, checksum, newer, older, minsize, maxsize, buffersize, multipartage, resyncage, restoretier, presign, presignmethod, headerrules, defaultcontenttype, acl, conflict, trashprefix, trashage, region string
+	flag.BoolVar(&refresh, "refresh", true,
+		"Scan online bucket to update cache at startup\n"+
+			"\tLonger startup time, but catches changes made while offline")
+	flag.BoolVar(&watch, "watch", false,
+		"Go into daemon mode and watch the local file system\n"+
+			"\tfor changes after initial sync (false means sync then quit)")
+	flag.BoolVar(&delete, "delete", true,
+		"Delete files when syncing as well as copying changed files")
+	flag.BoolVar(&immediatedeletes, "immediate-deletes", false,
+		"Propagate deletes right away instead of waiting out -delay")
+	flag.BoolVar(&prune, "prune-empty-dirs", false,
+		"When deleting local files, also remove directories\n"+
+			"\tleft empty (never the local root)")
+	flag.BoolVar(&bidirectional, "bidirectional", false,
+		"Sync changes in both directions, using the cache to tell\n"+
+			"\twhich side changed (implies -refresh=true)")
+	flag.StringVar(&conflict, "conflict", "skip",
+		"How to settle files changed on both sides with -bidirectional:\n"+
+			"\tnewer, local, remote, rename (move the local version to\n"+
+			"\tname.conflict-<host>), or skip")
+	flag.StringVar(&trashprefix, "trash-prefix", "",
+		"Move deleted files to this prefix on the server (and to\n"+
+			"\t.propolis-trash in the local root) instead of deleting them")
+	flag.StringVar(&trashage, "trash-retention", "",
+		"Purge trash from before this age or date at startup\n"+
+			"\t(e.g., 30d; empty means keep it forever)")
+	flag.BoolVar(&paranoid, "paranoid", false,
+		"Always verify md5 hash of file contents,\n"+
+			"\teven when all metadata is an exact match (slower)")
+	flag.StringVar(&checksum, "checksum-algorithm", "",
+		"Also keep this checksum of each file's contents: "+strings.Join(propolis.ChecksumNames(), ", ")+"\n"+
+			"\tS3 checks it on upload, and downloads are checked against it\n"+
+			"\t(it vouches for multipart objects, whose ETag is not an md5 hash)")
+	flag.BoolVar(&sha256, "sha256", false,
+		"Same as -checksum-algorithm sha256")
+	flag.BoolVar(&nohash, "no-hash", false,
+		"Never hash local files: decide what changed from size and\n"+
+			"\tmodification time alone, and upload without Content-MD5,\n"+
+			"\trelying on TLS/TCP to catch corruption in transit (faster,\n"+
+			"\tbut changes that keep both are missed and server-side\n"+
+			"\tcopies of duplicate files are not made)")
+	flag.StringVar(&resyncage, "resync-older-than", "",
+		"Verify md5 hash of files not synced within this age (e.g., 30d)\n"+
+			"\teven when all metadata is an exact match")
+	flag.Float64Var(&verifysample, "verify-sample", 0,
+		"Percent of files matching the cache to hash anyway, chosen at\n"+
+			"\trandom each run, to catch silent corruption over time")
+	flag.BoolVar(&verifyserver, "verify-sample-server", false,
+		"Also check the server copy of each -verify-sample file\n"+
+			"\tagainst the cache with a HEAD request")
+	flag.Float64Var(&sample, "sample", 100,
+		"Percent of cached objects to download and check in verify mode\n"+
+			"\tchosen at random (e.g., 5 for a quick spot check)")
+	flag.BoolVar(&resume, "resume", true,
+		"Record progress as the sync goes, and pick up where an\n"+
+			"\tinterrupted run of the same sync stopped")
+	flag.BoolVar(&createbucket, "create-bucket", false,
+		"Create the bucket if it does not exist")
+	flag.StringVar(&region, "region", "",
+		"Region to create the bucket in with -create-bucket\n"+
+			"\t(e.g., eu-west-1; default us-east-1)")
+	flag.BoolVar(&reset, "reset", false,
+		"Reset the cache (implies -refresh=true)")
+	flag.BoolVar(&practice, "practice", false,
+		"Do a practice run without changing any files or cache entries\n"+
+			"\tShows what would be changed (implies -watch=false)")
+	flag.BoolVar(&status, "status", false,
+		"List files that are local-only, remote-only, or different\n"+
+			"\tthen quit without changing anything (implies -watch=false)")
+	flag.BoolVar(&public, "public", true,
+		"Make world-readable local files publicly readable\n"+
+			"\tin the online bucket (downloadable via the web)")
+	flag.BoolVar(&secure, "secure", false,
+		"Use secure connections to Amazon S3\n"+
+			"\tA bit slower, but data is encrypted when being transferred")
+	flag.BoolVar(&reduced, "reduced", false,
+		"Use reduced redundancy storage when uploading\n"+
+			"\tCheaper, but higher chance of loosing data")
+	flag.BoolVar(&anonymous, "anonymous", false,
+		"Send unsigned requests without looking for credentials\n"+
+			"\tFor pulling from public buckets only")
+	flag.BoolVar(&requestpayer, "request-payer", false,
+		"Agree to pay for requests, which requester-pays buckets\n"+
+			"\t(like some public datasets) require")
+	flag.BoolVar(&directories, "directories", false,
+		"Track directories using special zero-length files\n"+
+			"\tMostly useful for greater compatibility with s3fslite")
+	flag.BoolVar(&xattrs, "xattrs", false,
+		"Store extended attributes as metadata and restore them\n"+
+			"\ton download (adds to the size of each request)")
+	flag.BoolVar(&specialfiles, "special-files", false,
+		"Track named pipes, sockets, and device files with zero-length\n"+
+			"\tfiles, and recreate them on download where permitted")
+	flag.BoolVar(&usermetadata, "user-metadata", false,
+		"Store the key=value lines in name.meta as metadata of name,\n"+
+			"\tand write them back out on download")
+	flag.BoolVar(&preserveatime, "preserve-atime", false,
+		"Store access times and restore them on download\n"+
+			"\t(change times cannot be set, so they are never kept)")
+	flag.BoolVar(&hardlinks, "hard-links", false,
+		"Store extra hard links to a file as references to the first one\n"+
+			"\tand recreate the links on download")
+	flag.BoolVar(&follow, "follow-symlinks", false,
+		"Upload the files and directories that symlinks point to\n"+
+			"\tinstead of storing the links themselves")
+	flag.BoolVar(&progress, "progress", isTerminal(os.Stdout),
+		"Show bytes transferred, throughput, and ETA as files sync\n"+
+			"\tOn by default when output is a terminal")
+	flag.IntVar(&delay, "delay", 5,
+		"Wait this number of seconds from the last change to a file\n"+
+			"\tbefore syncing it with the server")
+	flag.IntVar(&concurrent, "concurrent", 25,
+		"Maximum number of server transactions that are\n"+
+			"\tallowed to run concurrently")
+	flag.IntVar(&uploadconcurrency, "upload-concurrency", 0,
+		"Maximum number of concurrent uploads (default: -concurrent)")
+	flag.IntVar(&downloadconcurrency, "download-concurrency", 0,
+		"Maximum number of concurrent downloads (default: -concurrent)")
+	flag.IntVar(&listconcurrency, "list-concurrency", 0,
+		"Maximum number of concurrent list, delete, and other\n"+
+			"\tmetadata requests (default: -concurrent)")
+	flag.IntVar(&multipartconcurrency, "multipart-concurrency", 4,
+		"Maximum number of parts of one large upload that are\n"+
+			"\tsent concurrently")
+
+	flag.IntVar(&pagesize, "list-page-size", propolis.MaxListPageSize,
+		"Number of keys to request per bucket list call\n"+
+			"\tLarger pages mean fewer round trips (at most 1000)")
+	flag.BoolVar(&listv1, "list-v1", false,
+		"Use the original bucket list API instead of ListObjectsV2\n"+
+			"\tFor S3-compatible stores that do not support V2")
+	flag.BoolVar(&lazyscan, "lazy-scan", false,
+		"List the bucket one directory at a time instead of all at once\n"+
+			"\tStarts sooner and uses less memory on very large buckets")
+	flag.BoolVar(&cleanupmultipart, "cleanup-multipart", false,
+		"Abort incomplete multipart uploads left under the bucket root\n"+
+			"\tParts from abandoned uploads are still billed as storage")
+	flag.StringVar(&multipartage, "multipart-age", "7d",
+		"Only abort incomplete uploads started before this age or date\n"+
+			"\t(e.g., 24h, 7d, or 2011-06-01)")
+	flag.BoolVar(&purgeversions, "purge-versions", false,
+		"In a versioned bucket, delete every version of a deleted file\n"+
+			"\tOtherwise deleting only adds a delete marker")
+	flag.BoolVar(&purgenoncurrent, "purge-noncurrent", false,
+		"In a versioned bucket, also delete the old versions\n"+
+			"\tof files that are replaced by an upload")
+	flag.IntVar(&restoredays, "restore-days", 0,
+		"Request a restore of archived (GLACIER) files that are\n"+
+			"\tneeded for download, keeping them available this many days")
+	flag.StringVar(&restoretier, "restore-tier", "Standard",
+		"Retrieval tier for restores: Standard, Bulk, or Expedited")
+	flag.BoolVar(&waitrestore, "wait-restore", false,
+		"Wait for restores to finish and download the files\n"+
+			"\tinstead of leaving them for a later run")
+	flag.StringVar(&headerrules, "header-rules", "",
+		"File of rules setting Cache-Control, Content-Disposition,\n"+
+			"\tExpires, X-Amz-Acl, or X-Amz-Storage-Class on uploads by\n"+
+			"\tfile name, one per line:\n"+
+			"\t    *.html Cache-Control: max-age=300")
+	flag.BoolVar(&gzip, "gzip", false,
+		"Compress uploads of text files (HTML, CSS, JavaScript, etc.)\n"+
+			"\tand store them with Content-Encoding: gzip")
+	flag.BoolVar(&keepgzip, "keep-gzip", false,
+		"Download compressed files as they are stored\n"+
+			"\tinstead of uncompressing them")
+	flag.BoolVar(&sniff, "sniff-content-type", false,
+		"Guess the content type of files with unknown extensions\n"+
+			"\tfrom their first 512 bytes (costs an extra read)")
+	flag.StringVar(&defaultcontenttype, "default-content-type", "application/octet-stream",
+		"Content type for files whose type is not known")
+	flag.StringVar(&acl, "acl", propolis.ACLAuto,
+		"Canned ACL for uploaded files, or \"auto\" to make world-readable\n"+
+			"\tfiles public-read and others private\n"+
+			"\t(private, public-read, authenticated-read, bucket-owner-full-control, ...)")
+	flag.BoolVar(&normalize, "normalize-unicode", false,
+		"Store file names in Unicode NFC form, so names from a Mac (NFD)\n"+
+			"\tand from other systems map to the same key; downloaded\n"+
+			"\tfiles get the NFC names")
+	flag.BoolVar(&caseinsensitive, "case-insensitive-target", false,
+		"The local file system ignores case (as on a Mac or Windows)\n"+
+			"\tKeys differing only in case are always skipped on download\n"+
+			"\tif one already has the local name; with this option a pull\n"+
+			"\tsaves the later ones as name.case-<hash>.ext instead")
+	flag.BoolVar(&force, "force", false,
+		"Start even if another instance appears to be using the cache")
+	flag.StringVar(&presign, "presign", "",
+		"Print a pre-signed url for s3:bucket:key that is good\n"+
+			"\tfor this long (e.g., 1h or 7d) and quit")
+	flag.StringVar(&presignmethod, "presign-method", "GET",
+		"HTTP method the pre-signed url allows (GET, PUT, ...)")
+	flag.IntVar(&flushinterval, "cache-flush-interval", 60,
+		"Commit and checkpoint the cache this often (in seconds)\n"+
+			"\tduring a sync, and on SIGHUP (0 means only at the end)")
+	flag.IntVar(&timeout, "timeout", 60,
+		"Fail a server request if connecting or any read or write\n"+
+			"\ttakes longer than this many seconds (0 means never)")
+
+	flag.StringVar(&accesskeyid, "accesskeyid", "",
+		"Amazon AWS Access Key ID")
+	flag.StringVar(&secretaccesskey, "secretaccesskey", "",
+		"Amazon AWS Secret Access Key")
+	flag.StringVar(&sessiontoken, "session-token", "",
+		"Amazon AWS Session Token for temporary credentials")
+	flag.StringVar(&proxy, "proxy", "",
+		"Send requests through this proxy (e.g., http://proxy:3128)\n"+
+			"\tOverrides the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY variables")
+	flag.StringVar(&cacert, "ca-cert", "",
+		"Verify secure connections against the certificates in this\n"+
+			"\tPEM file instead of the system roots")
+	flag.BoolVar(&insecure, "insecure-skip-verify", false,
+		"Do not verify server certificates for secure connections\n"+
+			"\tOnly for testing against stores with self-signed certificates")
+	flag.StringVar(&profile, "profile", "default",
+		"Profile to use from ~/"+propolis.CredentialsFile)
+	flag.StringVar(&cache_location, "cache", propolis.DefaultCacheLocation,
+		"Metadata cache location\n"+
+			"\tA sqlite3 database file that caches online metadata")
+	flag.StringVar(&backend, "cache-backend", "sqlite",
+		"Metadata cache backend: sqlite or memory\n"+
+			"\tA memory cache is discarded at exit (implies -refresh=true)")
+	flag.Float64Var(&vacuumthreshold, "cache-vacuum-threshold", 0,
+		"At startup, vacuum the sqlite cache if more than this fraction\n"+
+			"\tof it is unused (e.g., 0.5; 0 means never)")
+	flag.StringVar(&configfile, "config", "",
+		"Read default options from this file (default: ~/"+config_file+")\n"+
+			"\tOptions given on the command line override the file")
+	flag.StringVar(&tmpdir, "tmp-dir", "",
+		"Directory for partial downloads (default: next to each file)\n"+
+			"\tFiles are copied into place if it is on another file system")
+	flag.StringVar(&format, "format", "text",
+		"Output format for -practice runs, run summaries, and cache listings:\n"+
+			"\ttext or json; json emits one object per planned action or entry\n"+
+			"\ton stdout, followed by a summary object at the end of a run")
+	flag.StringVar(&newer, "newer-than", "",
+		"Only sync files modified within this long (e.g., 24h, 7d)\n"+
+			"\tor since this date (2011-06-01 or 2011-06-01T12:00:00Z)")
+	flag.StringVar(&older, "older-than", "",
+		"Only sync files modified at least this long ago (e.g., 30d)\n"+
+			"\tor before this date (same formats as -newer-than)")
+	flag.StringVar(&minsize, "min-size", "",
+		"Only sync files at least this big (e.g., 100, 4K, 10M, 1G)")
+	flag.StringVar(&maxsize, "max-size", "",
+		"Only sync files no bigger than this (same format as -min-size)")
+	flag.BoolVar(&ignorehidden, "ignore-hidden", false,
+		"Skip files and directories whose names start with a dot\n"+
+			"\t(matching keys on the server are never deleted)")
+	flag.IntVar(&maxdepth, "max-depth", 0,
+		"Only sync this many directory levels below the roots\n"+
+			"\t(1 means just the top directory; 0 means no limit)")
+	flag.StringVar(&buffersize, "io-buffer-size", "",
+		"Read this much at a time when hashing and copying files\n"+
+			"\t(same format as -min-size; larger helps on fast, distant links)")
+	flag.StringVar(&useragent, "user-agent", propolis.DefaultUserAgent,
+		"User-Agent header to send with every request")
+	flag.BoolVar(&verbose, "verbose", false,
+		"Print debugging messages as well as normal output")
+	flag.BoolVar(&quiet, "quiet", false,
+		"Only print warnings and errors")
+	flag.StringVar(&logfile, "log-file", "",
+		"Also append all messages, with timestamps, to this file\n"+
+			"\t(subject to -verbose and -quiet)")
+	flag.StringVar(&manifest, "manifest", "",
+		"Append a line of json to this file for each finished action\n"+
+			"\t(path, direction, action, bytes, md5, and time)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Propolis:\n"+
+				"  Amazon S3 <--> local file system synchronizer\n"+
+				"  Synchronizes a local directory with an S3 bucket, then\n"+
+				"  watches the local directory for changes and automatically\n"+
+				"  propogates them to the bucket.\n\n"+
+				"  See http://github.com/russross/propolis for details\n\n"+
+				"  Copyright 2011 by Russ Ross <russ@russross.com>\n\n"+
+				"  Propolis comes with ABSOLUTELY NO WARRANTY.  This is free software, and you\n"+
+				"  are welcome to redistribute it under certain conditions.  See the GNU\n"+
+				"  General Public Licence for details.\n\n"+
+				"Usage:\n"+
+				"  To start by syncing remote bucket to match local file system:\n"+
+				"      %s [flags] local/dir s3:bucket[:remote/dir]\n"+
+				"  To start by syncing local file system to match remote bucket:\n"+
+				"      %s [flags] s3:bucket[:remote/dir] local/dir\n"+
+				"  To print a temporary link to a file without sharing credentials:\n"+
+				"      %s -presign 1h [flags] s3:bucket:remote/file\n"+
+				"  To upload stdin to a file, or download a file to stdout:\n"+
+				"      %s [flags] put s3:bucket:remote/file < local/file\n"+
+				"      %s [flags] get s3:bucket:remote/file > local/file\n"+
+				"  To see what the cache knows about a directory or a file:\n"+
+				"      %s [flags] cache ls s3:bucket[:remote/dir]\n"+
+				"      %s [flags] cache get s3:bucket:remote/file\n"+
+				"  To copy the cache to another machine:\n"+
+				"      %s [flags] cache export s3:bucket > cache.json\n"+
+				"      %s [flags] cache import s3:bucket < cache.json\n"+
+				"  To compact the cache after many deletes:\n"+
+				"      %s [flags] cache vacuum s3:bucket\n"+
+				"  To check that the bucket still matches the cache:\n"+
+				"      %s [flags] [-sample 5] verify s3:bucket[:remote/dir]\n\n"+
+				"  Amazon Access Key ID and Secret Access Key can be specified in\n"+
+				"  one of four ways, listed in decreasing order of precedence.\n"+
+				"  Note: both values must be supplied using a single method:\n\n"+
+				"      1. On the command line\n"+
+				"      2. In the environment variables %s and %s\n"+
+				"         (with the session token, if any, in %s)\n"+
+				"      3. In the file ~/%s under the selected -profile\n"+
+				"      4. In the file %s as key:secret on a single line\n"+
+				"      5. From the IAM role of the EC2 instance or ECS task\n\n"+
+				"Options:\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+			propolis.AccessKeyIdVariable, propolis.SecretAccessKeyVariable, propolis.SessionTokenVariable,
+			propolis.CredentialsFile, propolis.PasswordFile)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// fill in anything not given on the command line from the config file
+	if err := loadConfig(configfile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: reading config file: %v\n\n", err)
+		os.Exit(-1)
+	}
+
+	if format != "text" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: unknown output format %q\n\n", format)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	var newerthan, olderthan int64
+	var err os.Error
+	if newerthan, err = parseWhen(newer); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -newer-than value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if olderthan, err = parseWhen(older); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -older-than value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	if restoretier != "Standard" && restoretier != "Bulk" && restoretier != "Expedited" {
+		fmt.Fprintf(os.Stderr, "Error: unknown restore tier %q\n\n", restoretier)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	var rules []propolis.HeaderRule
+	if headerrules != "" {
+		if rules, err = propolis.ReadHeaderRules(headerrules); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: bad -header-rules file: %v\n\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	var trashcutoff int64
+	if trashcutoff, err = parseWhen(trashage); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -trash-retention value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	var multipartcutoff int64
+	if multipartcutoff, err = parseWhen(multipartage); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -multipart-age value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	var resynccutoff int64
+	if resynccutoff, err = parseWhen(resyncage); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -resync-older-than value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	var minbytes, maxbytes int64
+	if minbytes, err = parseSize(minsize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -min-size value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if maxbytes, err = parseSize(maxsize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -max-size value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	var bufferbytes int64
+	if bufferbytes, err = parseSize(buffersize); err != nil || bufferbytes > 1<<30 {
+		fmt.Fprintf(os.Stderr, "Error: bad -io-buffer-size value: %v\n\n", buffersize)
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	// check command-line arguments
+	args := flag.Args()
+	if presign != "" {
+		signUrl(presign, presignmethod, args, secure, profile, accesskeyid, secretaccesskey, sessiontoken)
+	}
+	if len(args) > 0 && args[0] == "cache" {
+		cacheCommand(args[1:], cache_location, format)
+	}
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	// figure out the direction of sync, parse the bucket and directory info
+	var bucketname, bucketprefix, localdir, stream, key string
+	var verify bool
+
+	switch {
+	case (args[0] == "put" || args[0] == "get") && strings.HasPrefix(args[1], "s3:"):
+		// a single object to or from stdin/stdout, with no local
+		// directory or cache
+		stream = args[0]
+		localdir = "."
+		backend = "memory"
+		bucketname, key = parseBucket(args[1])
+		if key == "" {
+			flag.Usage()
+			os.Exit(-1)
+		}
+	case args[0] == "verify" && strings.HasPrefix(args[1], "s3:"):
+		// check the server copy of everything in the cache
+		if sample <= 0 || sample > 100 {
+			fmt.Fprintf(os.Stderr, "Error: -sample must be more than 0 and at most 100\n\n")
+			flag.Usage()
+			os.Exit(-1)
+		}
+		verify = true
+		localdir = "."
+		bucketname, bucketprefix = parseBucket(args[1])
+	case !strings.HasPrefix(args[0], "s3:") && strings.HasPrefix(args[1], "s3:"):
+		push = true
+		localdir, err = parseLocalDir(args[0])
+		bucketname, bucketprefix = parseBucket(args[1])
+	case strings.HasPrefix(args[0], "s3:") && !strings.HasPrefix(args[1], "s3:"):
+		push = false
+		bucketname, bucketprefix = parseBucket(args[0])
+		localdir, err = parseLocalDir(args[1])
+	default:
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(-1)
+	}
+	if anonymous && (push || bidirectional || stream == "put") {
+		fmt.Fprintf(os.Stderr, "Error: -anonymous can only be used to read from a bucket\n\n")
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if sha256 {
+		if checksum != "" && checksum != "sha256" {
+			fmt.Fprintf(os.Stderr, "Error: -sha256 conflicts with -checksum-algorithm %s\n\n", checksum)
+			flag.Usage()
+			os.Exit(-1)
+		}
+		checksum = "sha256"
+	}
+	if nohash && (paranoid || checksum != "" || gzip || resyncage != "" || verifysample > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -no-hash cannot be used with -paranoid, -checksum-algorithm, -gzip, -resync-older-than, or -verify-sample\n\n")
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	config := &propolis.Config{
+		Bucket:     bucketname,
+		BucketRoot: bucketprefix,
+		LocalRoot:  localdir,
+		TmpDir:     tmpdir,
+
+		Key:     accesskeyid,
+		Secret:  secretaccesskey,
+		Token:   sessiontoken,
+		Profile: profile,
+
+		Anonymous: anonymous,
+
+		Secure:            secure,
+		ReducedRedundancy: reduced,
+		Proxy:             proxy,
+		CACert:            cacert,
+		Insecure:          insecure,
+		RequestPayer:      requestpayer,
+
+		CacheLocation:   cache_location,
+		CacheBackend:    backend,
+		VacuumThreshold: vacuumthreshold,
+
+		Refresh:     refresh,
+		Paranoid:    paranoid,
+		NoHash:      nohash,
+		Delete:      delete,
+		Reset:       reset,
+		Directories: directories,
+		Xattrs:      xattrs,
+		HardLinks:   hardlinks,
+		Follow:      follow,
+		Practice:    practice,
+		Watch:       watch,
+		StatusOnly:  status,
+		Delay:       delay,
+		Concurrent:  concurrent,
+		Timeout:     timeout,
+		PageSize:    pagesize,
+		ListV1:      listv1,
+		LazyScan:    lazyscan,
+
+		Checksum: checksum,
+
+		PruneEmptyDirs: prune,
+
+		ImmediateDeletes: immediatedeletes,
+		Resume:           resume,
+		FlushInterval:    flushinterval,
+
+		BufferSize: int(bufferbytes),
+
+		CreateBucket: createbucket,
+		Region:       region,
+
+		UserAgent: useragent,
+
+		TrashPrefix: trashprefix,
+		TrashCutoff: trashcutoff,
+
+		Bidirectional: bidirectional,
+		Conflict:      conflict,
+
+		UploadConcurrency:   uploadconcurrency,
+		DownloadConcurrency: downloadconcurrency,
+		ListConcurrency:     listconcurrency,
+
+		MultipartConcurrency: multipartconcurrency,
+
+		NormalizeUnicode: normalize,
+
+		CaseInsensitiveTarget: caseinsensitive,
+
+		PreserveAtime: preserveatime,
+		SpecialFiles:  specialfiles,
+		UserMetadata:  usermetadata,
+
+		ResyncCutoff: resynccutoff,
+		VerifySample: verifysample,
+		VerifyServer: verifyserver,
+
+		CleanupMultipart: cleanupmultipart,
+		MultipartCutoff:  multipartcutoff,
+
+		PurgeVersions:   purgeversions,
+		PurgeNoncurrent: purgenoncurrent,
+
+		RestoreDays: restoredays,
+		RestoreTier: restoretier,
+		WaitRestore: waitrestore,
+		HeaderRules: rules,
+		Gzip:        gzip,
+		KeepGzip:    keepgzip,
+
+		SniffContentType:   sniff,
+		DefaultContentType: defaultcontenttype,
+		ACL:                acl,
+		Public:             public,
+
+		Force: force,
+
+		NewerThan: newerthan,
+		OlderThan: olderthan,
+		MinSize:   minbytes,
+		MaxSize:   maxbytes,
+
+		IgnoreHidden: ignorehidden,
+		MaxDepth:     maxdepth,
+
+		Log: &propolis.Logger{
+			Level: propolis.LogInfo,
+			Out:   os.Stdout,
+			Err:   os.Stderr,
+		},
+	}
+
+	switch {
+	case verbose:
+		config.Log.Level = propolis.LogDebug
+	case quiet:
+		config.Log.Level = propolis.LogWarn
+	}
+	if logfile != "" {
+		fp, err := os.OpenFile(logfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening log file: %v\n", err)
+			os.Exit(-1)
+		}
+		config.Log.File = fp
+	}
+
+	if manifest != "" {
+		fp, err := os.OpenFile(manifest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening manifest file: %v\n", err)
+			os.Exit(-1)
+		}
+		config.Manifest = fp
+	}
+
+	// keep stdout clean for reports
+	if status || format == "json" || stream != "" || verify {
+		config.Log.Out = os.Stderr
+	}
+	if practice && format == "json" {
+		config.OnAction = printAction
+	}
+	if progress && !practice && !status {
+		config.Progress = os.Stderr
+		config.ProgressTTY = isTerminal(os.Stderr)
+	}
+
+	if p, err = propolis.New(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if stream != "" {
+		streamObject(p, stream, key)
+	}
+	if verify {
+		verifyBucket(p, sample)
+	}
+	return
+}
+
+// Download cached objects to check them against the cache, print any
+// problems, and exit. The exit status is nonzero if any were found.
+func verifyBucket(p *propolis.Propolis, sample float64) {
+	report, err := p.Verify(sample)
+	p.Close()
+	if err != nil {
+		p.Log.Errorf("Error %v\n", err)
+		os.Exit(-1)
+	}
+	for _, category := range []string{"missing", "corrupt", "changed"} {
+		paths := report.Status[category]
+		if len(paths) == 0 {
+			continue
+		}
+		fmt.Printf("%s (%d):\n", category, len(paths))
+		for _, path := range paths {
+			fmt.Printf("    %s\n", path)
+		}
+	}
+	p.Status(fmt.Sprintf("Verified %d objects.", report.Verified))
+	if len(report.Skipped) > 0 {
+		p.Status(fmt.Sprintf("Skipped %d archived objects.", len(report.Skipped)))
+	}
+	if len(report.Status) > 0 || len(report.Errors) > 0 {
+		os.Exit(-1)
+	}
+	os.Exit(0)
+}
+
+// Upload stdin to a single key or download a single key to stdout,
+// then exit.
+func streamObject(p *propolis.Propolis, cmd, key string) {
+	var err os.Error
+	if cmd == "put" {
+		err = p.Put(key, os.Stdin)
+	} else {
+		err = p.Get(key, os.Stdout)
+	}
+	p.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(-1)
+	}
+	os.Exit(0)
+}
+
+// Print a pre-signed url for the single s3:bucket:key argument and
+// exit. No requests are made and the cache is not touched.
+func signUrl(lifetime, method string, args []string, secure bool, profile, key, secret, token string) {
+	seconds, err := parseAge(lifetime)
+	if err == nil && seconds == 0 {
+		err = os.NewError("the url would already be expired")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: bad -presign value: %v\n\n", err)
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if len(args) != 1 || !strings.HasPrefix(args[0], "s3:") {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	bucket, object := parseBucket(args[0])
+
+	p, err := propolis.New(&propolis.Config{
+		Bucket:       bucket,
+		LocalRoot:    ".",
+		Profile:      profile,
+		Key:          key,
+		Secret:       secret,
+		Token:        token,
+		Secure:       secure,
+		CacheBackend: "memory",
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+		os.Exit(-1)
+	}
+	defer p.Close()
+
+	signed, err := p.Presign(strings.ToUpper(method), object, seconds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(-1)
+	}
+	fmt.Println(signed)
+	os.Exit(0)
+}
+
+func main() {
+	// this exits if there is a problem, so no error checking needed
+	p, push, format := Setup()
+	defer p.Close()
+
+	// release the cache (and its lock) if interrupted, and flush it
+	// on SIGHUP
+	go func() {
+		for sig := range signal.Incoming {
+			s, ok := sig.(signal.UnixSignal)
+			if ok && s == syscall.SIGHUP {
+				// make the cache durable without stopping
+				p.Log.Infof("Flushing cache: %v\n", sig)
+				if err := p.FlushCache(); err != nil {
+					p.Log.Errorf("Error flushing cache: %v\n", err)
+				}
+				continue
+			}
+			if ok && (s == syscall.SIGINT || s == syscall.SIGTERM) {
+				p.Log.Errorf("Stopping: %v\n", sig)
+				p.Close()
+				os.Exit(-1)
+			}
+		}
+	}()
+
+	report, err := p.Sync(push)
+	printReport(os.Stdout, p, report, format)
+	if err != nil {
+		p.Log.Errorf("Error %v\n", err)
+		os.Exit(-1)
+	}
+	p.Status("Finished.")
+}
+
+// emit one json object per planned action for -practice -format json
+func printAction(action *propolis.Action) {
+	if err := json.NewEncoder(os.Stdout).Encode(action); err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding action for [%s]: %v\n", action.Path, err)
+	}
+}
+
+// errors were logged as they happened, so only the summaries are left
+func printReport(out io.Writer, p *propolis.Propolis, report *propolis.Report, format string) {
+	// status runs list the files that are out of sync
+	if p.StatusOnly {
+		for _, category := range []string{"local-only", "remote-only", "different"} {
+			paths := report.Status[category]
+			if len(paths) == 0 {
+				continue
+			}
+			fmt.Fprintf(out, "%s (%d):\n", category, len(paths))
+			for _, path := range paths {
+				fmt.Fprintf(out, "    %s\n", path)
+			}
+		}
+		if len(report.Status) == 0 {
+			fmt.Fprintln(out, "Everything is in sync.")
+		}
+	}
+
+	if len(report.Conflicts) > 0 {
+		fmt.Fprintf(out, "conflicts (%d):\n", len(report.Conflicts))
+		for _, path := range report.Conflicts {
+			fmt.Fprintf(out, "    %s\n", path)
+		}
+	}
+
+	if len(report.Collided) > 0 {
+		fmt.Fprintf(out, "case collisions (%d):\n", len(report.Collided))
+		for _, path := range report.Collided {
+			fmt.Fprintf(out, "    %s\n", path)
+		}
+	}
+
+	if len(report.Restoring) > 0 {
+		fmt.Fprintf(out, "pending restore (%d):\n", len(report.Restoring))
+		for _, path := range report.Restoring {
+			fmt.Fprintf(out, "    %s\n", path)
+		}
+	}
+
+	if report.AbortedUploads > 0 {
+		p.Status(fmt.Sprintf("Aborted %d incomplete multipart uploads (%d bytes).",
+			report.AbortedUploads, report.AbortedBytes))
+	}
+
+	if len(report.Skipped) > 0 {
+		p.Status(fmt.Sprintf("Skipped %d unreadable files.", len(report.Skipped)))
+	}
+
+	if report.CopiedFiles > 0 || report.UploadedFiles > 0 {
+		p.Status(fmt.Sprintf("Copied %d files on the server (%d bytes not uploaded), uploaded %d files (%d bytes).",
+			report.CopiedFiles, report.CopiedBytes, report.UploadedFiles, report.UploadedBytes))
+	}
+
+	if format == "json" {
+		printSummary(out, report)
+	}
+}
+
+// the end-of-run totals emitted for -format json
+type runSummary struct {
+	Action        string `json:"action"`
+	Errors        int    `json:"errors"`
+	Skipped       int    `json:"skipped"`
+	Conflicts     int    `json:"conflicts"`
+	Collided      int    `json:"case_collisions"`
+	CopiedFiles   int    `json:"copied_files"`
+	CopiedBytes   int64  `json:"copied_bytes"`
+	UploadedFiles int    `json:"uploaded_files"`
+	UploadedBytes int64  `json:"uploaded_bytes"`
+}
+
+func printSummary(out io.Writer, report *propolis.Report) {
+	summary := &runSummary{
+		Action:        "summary",
+		Errors:        len(report.Errors),
+		Skipped:       len(report.Skipped),
+		Conflicts:     len(report.Conflicts),
+		Collided:      len(report.Collided),
+		CopiedFiles:   report.CopiedFiles,
+		CopiedBytes:   report.CopiedBytes,
+		UploadedFiles: report.UploadedFiles,
+		UploadedBytes: report.UploadedBytes,
+	}
+	if err := json.NewEncoder(out).Encode(summary); err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding summary: %v\n", err)
+	}
+}
+
+// a cache entry as printed by the cache subcommand
+type cacheEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Mode     uint32 `json:"mode"`
+	Uid      int    `json:"uid"`
+	Gid      int    `json:"gid"`
+	Modified int64  `json:"mtime"`
+	HashHex  string `json:"md5"`
+	Synced   int64  `json:"synced_at,omitempty"`
+}
+
+type byPath []*cacheEntry
+
+func (a byPath) Len() int           { return len(a) }
+func (a byPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+func (a byPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// version of the cache export format, checked on import
+const cache_dump_version = 1
+
+// the whole cache for a bucket, as written by cache export
+type cacheDump struct {
+	Version int           `json:"version"`
+	Bucket  string        `json:"bucket"`
+	Entries []*cacheEntry `json:"entries"`
+}
+
+// Inspect or copy the cache without syncing anything, then exit:
+//
+//	cache ls s3:bucket[:dir]    print every entry inside a directory
+//	cache get s3:bucket:file    print a single entry
+//	cache export s3:bucket      write every entry to stdout as json
+//	cache import s3:bucket      add the entries from an export on stdin
+//	cache vacuum s3:bucket      compact the cache file
+func cacheCommand(args []string, location, format string) {
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	bucket, prefix := parseBucket(args[1])
+	filename := propolis.CacheFile(location, bucket)
+
+	switch {
+	case args[0] == "ls":
+		printCache(listCache(openCache(filename, false), prefix), format)
+	case args[0] == "get" && prefix != "":
+		printCache(getCache(openCache(filename, false), prefix), format)
+	case args[0] == "export" && prefix == "":
+		exportCache(openCache(filename, false), bucket)
+	case args[0] == "import" && prefix == "":
+		importCache(filename, bucket)
+	case args[0] == "vacuum" && prefix == "":
+		vacuumCache(filename)
+	default:
+		flag.Usage()
+		os.Exit(-1)
+	}
+	os.Exit(0)
+}
+
+// open the cache file, exiting on failure
+func openCache(filename string, create bool) *propolis.Cache {
+	// do not create a cache just to find it empty
+	if !create {
+		if _, err := os.Stat(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: no cache found: %v\n", err)
+			os.Exit(-1)
+		}
+	}
+	db, err := propolis.Connect(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: connecting to database: %v\n", err)
+		os.Exit(-1)
+	}
+	return db
+}
+
+// every entry inside a directory prefix, in path order
+func listCache(db *propolis.Cache, prefix string) (entries []*cacheEntry) {
+	err := db.Scan(prefix, func(hashHex string, info *os.FileInfo, synced int64) {
+		entries = append(entries, newCacheEntry(hashHex, info, synced))
+	})
+	db.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(-1)
+	}
+	sort.Sort(byPath(entries))
+	return
+}
+
+// the entry for a single path
+func getCache(db *propolis.Cache, path string) []*cacheEntry {
+	info, hashHex, synced, err := db.Get(path)
+	db.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(-1)
+	}
+	if info == nil {
+		fmt.Fprintf(os.Stderr, "Error: no cache entry for [%s]\n", path)
+		os.Exit(-1)
+	}
+	return []*cacheEntry{newCacheEntry(hashHex, info, synced)}
+}
+
+func printCache(entries []*cacheEntry, format string) {
+	for _, entry := range entries {
+		if format == "json" {
+			if err := json.NewEncoder(os.Stdout).Encode(entry); err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding cache entry for [%s]: %v\n", entry.Path, err)
+			}
+			continue
+		}
+		when := time.SecondsToLocalTime(entry.Modified / 1e9).Format("2006-01-02 15:04:05")
+		fmt.Printf("%07o %5d %5d %12d %s %s %s", entry.Mode, entry.Uid, entry.Gid,
+			entry.Size, when, entry.HashHex, entry.Path)
+		if entry.Synced > 0 {
+			fmt.Printf(" (synced %s)", time.SecondsToLocalTime(entry.Synced/1e9).Format("2006-01-02 15:04:05"))
+		}
+		fmt.Println()
+	}
+}
+
+// write every entry as a single json document
+func exportCache(db *propolis.Cache, bucket string) {
+	dump := &cacheDump{
+		Version: cache_dump_version,
+		Bucket:  bucket,
+		Entries: listCache(db, ""),
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(dump); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: encoding cache: %v\n", err)
+		os.Exit(-1)
+	}
+}
+
+// Add the entries from an export, replacing any existing entries with
+// the same paths. The cache is created if it does not exist yet.
+func importCache(filename, bucket string) {
+	dump := new(cacheDump)
+	if err := json.NewDecoder(os.Stdin).Decode(dump); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: reading cache export: %v\n", err)
+		os.Exit(-1)
+	}
+	if dump.Version != cache_dump_version {
+		fmt.Fprintf(os.Stderr, "Error: cache export has version %d, expected %d\n", dump.Version, cache_dump_version)
+		os.Exit(-1)
+	}
+	if dump.Bucket != bucket {
+		fmt.Fprintf(os.Stderr, "Error: cache export is for bucket %s, not %s\n", dump.Bucket, bucket)
+		os.Exit(-1)
+	}
+
+	lock, err := propolis.LockFile(filename + ".lock")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v (another propolis is using this cache)\n", err)
+		os.Exit(-1)
+	}
+	db := openCache(filename, true)
+	if err = db.BeginBatch(); err == nil {
+		for _, entry := range dump.Entries {
+			info := &os.FileInfo{
+				Name:     entry.Path,
+				Size:     entry.Size,
+				Mode:     entry.Mode,
+				Uid:      entry.Uid,
+				Gid:      entry.Gid,
+				Mtime_ns: entry.Modified,
+			}
+			if err = db.Put(entry.Path, entry.HashHex, info, entry.Synced); err != nil {
+				break
+			}
+		}
+		if er := db.EndBatch(); err == nil {
+			err = er
+		}
+	}
+	db.Close()
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: importing cache: %v\n", err)
+		os.Exit(-1)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d cache entries.\n", len(dump.Entries))
+}
+
+// compact the cache file, reporting how much it shrank
+func vacuumCache(filename string) {
+	lock, err := propolis.LockFile(filename + ".lock")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v (another propolis is using this cache)\n", err)
+		os.Exit(-1)
+	}
+	db := openCache(filename, false)
+	var before, after int64
+	if info, er := os.Stat(filename); er == nil {
+		before = info.Size
+	}
+	err = db.Vacuum()
+
+	// closing copies the rewritten file out of the write-ahead log
+	db.Close()
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: vacuuming cache: %v\n", err)
+		os.Exit(-1)
+	}
+	if info, er := os.Stat(filename); er == nil {
+		after = info.Size
+	}
+	fmt.Fprintf(os.Stderr, "Cache size was %d bytes, now %d bytes.\n", before, after)
+}
+
+func newCacheEntry(hashHex string, info *os.FileInfo, synced int64) *cacheEntry {
+	return &cacheEntry{
+		Path:     info.Name,
+		Size:     info.Size,
+		Mode:     info.Mode,
+		Uid:      info.Uid,
+		Gid:      info.Gid,
+		Modified: info.Mtime_ns,
+		HashHex:  hashHex,
+		Synced:   synced,
+	}
+}
+
+func parseBucket(arg string) (name, prefix string) {
+	// sanity check
+	if !strings.HasPrefix(arg, "s3:") {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	// split it into bucket and name
+	name = strings.TrimSpace(arg[len("s3:"):])
+	if colon := strings.Index(name, ":"); colon >= 0 {
+		prefix = strings.TrimSpace(name[colon+1:])
+		name = strings.TrimSpace(name[:colon])
+	}
+
+	valid := true
+	defer func() {
+		if !valid {
+			fmt.Fprintln(os.Stdout, "Invalid bucket name")
+			flag.Usage()
+			os.Exit(-1)
+		}
+	}()
+
+	// validate and canonicalize bucket part
+	// from http://docs.amazonwebservices.com/AmazonS3/latest/dev/index.html?BucketRestrictions.html
+	//     bucket names:
+	//     - must be between 3 and 255 characters long
+	if len(name) < 3 || len(name) > 255 {
+		valid = false
+		return
+	}
+
+	//     - can contain lowercase letters, numbers, periods, underscores, and dashes
+	if strings.IndexFunc(name, func(r int) bool {
+		return r != '.' && r != '_' && r != '-' &&
+			(r < 'a' || r > 'z') &&
+			(r < '0' || r > '9')
+	}) >= 0 {
+		valid = false
+		return
+	}
+
+	//     - must start with a number or letter
+	if !unicode.IsDigit(int(name[0])) && !unicode.IsLetter(int(name[0])) {
+		valid = false
+		return
+	}
+
+	//     - must not be formatted as an IP address (e.g., 192.168.5.4)
+	var a, b, c, d, e int
+	if n, _ := fmt.Sscanf(name+"!", "%3d.%3d.%3d.%3d%c", &a, &b, &c, &d, &e); n == 5 {
+		if e == '!' &&
+			a >= 0 && a <= 255 &&
+			b >= 0 && b <= 255 &&
+			c >= 0 && c <= 255 &&
+			d >= 0 && d <= 255 {
+			valid = false
+			return
+		}
+	}
+
+	// validate and canonicalize path part
+	prefix = path.Clean("/" + prefix)[1:]
+	return
+}
+
+// Parse a time given as an age (a number followed by s, m, h, d,
+// or w) or as a date in UTC. Returns ns since the epoch, or 0 for "".
+func parseWhen(s string) (int64, os.Error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	// an age relative to now
+	if age, err := parseAge(s); err == nil {
+		return time.Nanoseconds() - age*1e9, nil
+	}
+
+	// an absolute date
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05Z", time.RFC3339} {
+		if when, err := time.Parse(layout, s); err == nil {
+			return when.Seconds() * 1e9, nil
+		}
+	}
+	return 0, os.NewError("expected an age like 24h or a date like 2011-06-01: " + s)
+}
+
+// Parse a length of time given as a number followed by s, m, h, d,
+// or w. Returns the number of seconds.
+func parseAge(s string) (int64, os.Error) {
+	units := map[byte]int64{'s': 1, 'm': 60, 'h': 60 * 60, 'd': 24 * 60 * 60, 'w': 7 * 24 * 60 * 60}
+	if s != "" {
+		if unit, present := units[s[len(s)-1]]; present {
+			if n, err := strconv.Atoi64(s[:len(s)-1]); err == nil && n >= 0 {
+				return n * unit, nil
+			}
+		}
+	}
+	return 0, os.NewError("expected a length of time like 30m or 7d: " + s)
+}
+
+// Parse a size in bytes, with an optional K, M, or G suffix
+// (powers of 1024). Returns 0 for "".
+func parseSize(s string) (int64, os.Error) {
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		multiplier = 1 << 10
+	case 'm', 'M':
+		multiplier = 1 << 20
+	case 'g', 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi64(s)
+	if err != nil || n < 0 {
+		return 0, os.NewError("expected a size like 100, 4K, 10M, or 1G: " + s)
+	}
+	return n * multiplier, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.IsChar()
+}
+
+func parseLocalDir(arg string) (path string, err os.Error) {
+	// a bare drive letter means the root of that drive, not the
+	// current directory on it
+	if len(arg) == 2 && arg[1] == ':' && unicode.IsLetter(int(arg[0])) {
+		arg += string(filepath.Separator)
+	}
+	if path, err = filepath.Abs(arg); err != nil {
+		return "", fmt.Errorf("invalid local directory %s: %v", arg, err)
+	}
+
+	// this also catches a missing directory and a broken symlink
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", fmt.Errorf("invalid local directory %s: %v", arg, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid local directory %s: %v", arg, err)
+	}
+	if !info.IsDirectory() {
+		return "", fmt.Errorf("invalid local directory %s: not a directory", arg)
+	}
+	return path, nil
+}
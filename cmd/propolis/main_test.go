@@ -0,0 +1,130 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of the command-line handling
+
+package main
+
+import (
+	"bytes"
+	"github.com/russross/propolis"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The local directory must exist and be a directory, even when it is
+// reached through a symlink.
+func TestParseLocalDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "propolis-test-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, []byte("not a directory\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	broken := filepath.Join(dir, "broken")
+	if err = os.Symlink(filepath.Join(dir, "missing"), broken); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err = os.Symlink(dir, link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	for _, name := range []string{filepath.Join(dir, "missing"), file, broken} {
+		path, err := parseLocalDir(name)
+		if err == nil {
+			t.Errorf("%s: accepted as %s", name, path)
+		} else if !strings.Contains(err.String(), name) {
+			t.Errorf("%s: error does not name the directory: %v", name, err)
+		}
+	}
+
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("EvalSymlinks: %v", err)
+	}
+	for _, name := range []string{dir, link} {
+		if path, err := parseLocalDir(name); err != nil || path != real {
+			t.Errorf("%s: got %s, %v; expected %s", name, path, err, real)
+		}
+	}
+}
+
+// The run summary counts server-side copies apart from uploads. It is
+// a status line, and with -format json also a final object on stdout,
+// which then carries nothing else.
+func TestPrintReport(t *testing.T) {
+	report := &propolis.Report{
+		Skipped:       []string{"unreadable"},
+		CopiedFiles:   2,
+		CopiedBytes:   3000,
+		UploadedFiles: 1,
+		UploadedBytes: 40,
+	}
+	line := "Copied 2 files on the server (3000 bytes not uploaded), uploaded 1 files (40 bytes).\n"
+
+	for _, format := range []string{"text", "json"} {
+		var log, out bytes.Buffer
+		p := &propolis.Propolis{Log: &propolis.Logger{Level: propolis.LogInfo, Out: &log}}
+		printReport(&out, p, report, format)
+
+		if !strings.Contains(log.String(), line) {
+			t.Errorf("%s: no copy and upload totals in %q", format, log.String())
+		}
+		if format == "text" {
+			if out.Len() != 0 {
+				t.Errorf("text: unexpected output %q", out.String())
+			}
+			continue
+		}
+
+		if strings.Count(out.String(), "\n") != 1 {
+			t.Errorf("json: expected the summary alone, got %q", out.String())
+		}
+		if !strings.Contains(out.String(), `"copied_bytes":3000`) {
+			t.Errorf("json: summary %q does not name copied_bytes", out.String())
+		}
+		summary := new(runSummary)
+		if err := json.NewDecoder(&out).Decode(summary); err != nil {
+			t.Fatalf("json: decoding summary: %v", err)
+		}
+		expected := runSummary{Action: "summary", Skipped: 1, CopiedFiles: 2, CopiedBytes: 3000, UploadedFiles: 1, UploadedBytes: 40}
+		if !reflect.DeepEqual(*summary, expected) {
+			t.Errorf("json: got summary %+v, expected %+v", *summary, expected)
+		}
+	}
+
+	// nothing copied or uploaded, so no totals
+	var log, out bytes.Buffer
+	p := &propolis.Propolis{Log: &propolis.Logger{Level: propolis.LogInfo, Out: &log}}
+	printReport(&out, p, &propolis.Report{}, "text")
+	if strings.Contains(log.String(), "Copied") {
+		t.Errorf("totals printed for an empty run: %q", log.String())
+	}
+}
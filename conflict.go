@@ -0,0 +1,226 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Two-way sync with conflict detection
+
+package propolis
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ways to settle a file changed on both sides in a -bidirectional sync:
+// keep the newer side, always keep one side, keep the server's version
+// and move the local one aside, or leave both alone
+var ConflictPolicies = []string{
+	"newer",
+	"local",
+	"remote",
+	"rename",
+	"skip",
+}
+
+// Decide which way a file should go in a bidirectional sync, and set
+// elt.Push to match. The cache entry is the common ancestor: it
+// records the state of both sides at the end of the last sync, so a
+// side that no longer matches it has changed. The server side is
+// known from the refresh scan. Once the direction is chosen, elt holds
+// the same state SyncFile would see for a one-way sync in that
+// direction. Returns false if the file should be left alone.
+func (p *Propolis) reconcile(elt *File) (proceed bool, err os.Error) {
+	if elt.CacheInfo == nil {
+		if err = p.GetFileInfo(elt); err != nil {
+			return
+		}
+	}
+	ancestor := elt.CacheInfo != nil
+	local := elt.LocalInfo != nil
+	remote := elt.ServerHashHex != ""
+
+	localChanged, remoteChanged := local, remote
+	if ancestor {
+		localChanged = !local || changeReason(elt.LocalInfo, elt.CacheInfo) != ""
+		remoteChanged = !remote || elt.ServerHashHex != elt.CacheHashHex
+	}
+
+	// without -delete a missing file is not a change to pass on: it is
+	// copied back from the other side instead
+	if !p.Delete {
+		if !local {
+			localChanged = false
+		}
+		if !remote {
+			remoteChanged = false
+		}
+	}
+
+	// a file changed to the same contents on both sides is not a
+	// conflict; the scan result is enough to record it as synced
+	// (with -no-hash there is no way to tell, so it is a conflict)
+	if localChanged && remoteChanged && local && remote && !p.NoHash {
+		if err = p.GetMd5(elt); err != nil {
+			return
+		}
+		if elt.LocalHashHex == elt.ServerHashHex && elt.UploadSize == elt.ServerSize {
+			p.forgetAncestor(elt)
+			elt.Push = true
+			return true, nil
+		}
+		elt.Contents.Close()
+		elt.Contents = nil
+		elt.LocalHashHex = ""
+	}
+
+	switch {
+	case localChanged && remoteChanged:
+		if !local && !remote {
+			// deleted on both sides
+			if ancestor && !p.Practice {
+				err = p.DeleteFileInfo(elt)
+			}
+			return
+		}
+		return p.resolveConflict(elt)
+
+	case remoteChanged:
+		return true, p.pullFrom(elt)
+
+	case !localChanged && !local && remote:
+		// missing locally without -delete, so it is copied back
+		return true, p.pullFrom(elt)
+	}
+
+	// a file missing on the server is uploaded as a new file
+	if !remote {
+		p.forgetAncestor(elt)
+	}
+	elt.Push = true
+	return true, nil
+}
+
+// Settle a file that changed on both sides according to p.Conflict.
+// Every conflict is reported, however it is settled.
+func (p *Propolis) resolveConflict(elt *File) (proceed bool, err os.Error) {
+	p.Log.Warnf("Changed locally and on server [%s]\n", elt.ServerPath)
+	p.recordConflict(elt)
+
+	local := elt.LocalInfo != nil
+	remote := elt.ServerHashHex != ""
+	keepLocal := false
+	switch p.Conflict {
+	case "skip":
+		return
+	case "local":
+		keepLocal = true
+	case "remote":
+		keepLocal = false
+	default:
+		// a deleted side has no time to compare, so the side that
+		// still has the file wins. The server time is when the
+		// change reached the server, not the file's own mtime.
+		keepLocal = !remote || local && elt.LocalInfo.Mtime_ns > elt.ServerModified
+	}
+
+	if keepLocal {
+		if !remote {
+			p.forgetAncestor(elt)
+		}
+		elt.Push = true
+		elt.Reason = "conflict"
+		return true, nil
+	}
+
+	// with -conflict=rename the local version survives under a new
+	// name, and is uploaded as a file of its own
+	if p.Conflict == "rename" && local {
+		if err = p.moveConflict(elt); err != nil {
+			return
+		}
+		elt.LocalInfo = nil
+	}
+	if err = p.pullFrom(elt); err != nil {
+		return
+	}
+	elt.Reason = "conflict"
+	return true, nil
+}
+
+// Set elt up to pull the current server state. The ancestor in the
+// cache is out of date, so the server is asked for fresh metadata.
+func (p *Propolis) pullFrom(elt *File) (err os.Error) {
+	elt.Push = false
+	if elt.ServerHashHex == "" {
+		// deleted on the server
+		p.forgetAncestor(elt)
+		return
+	}
+	if elt.CacheInfo != nil && elt.ServerHashHex == elt.CacheHashHex {
+		// only the local side changed, so the ancestor is current
+		return
+	}
+	p.forgetAncestor(elt)
+	if err = p.StatRequest(elt); err != nil {
+		return
+	}
+	if elt.CacheInfo != nil {
+		err = p.SetFileInfo(elt, false)
+	}
+	return
+}
+
+// Drop the cache entry for a file whose server side no longer matches
+// it, so it cannot be mistaken for the current server state.
+func (p *Propolis) forgetAncestor(elt *File) {
+	if elt.CacheInfo == nil {
+		return
+	}
+	elt.CacheInfo = nil
+	elt.CacheHashHex = ""
+	if !p.Practice {
+		if err := p.DeleteFileInfo(elt); err != nil {
+			p.Log.Warnf("Error updating cache for [%s]: %v\n", elt.ServerPath, err)
+		}
+	}
+}
+
+// Move the local version of a conflicting file to name.conflict-<host>
+// and queue it for upload.
+func (p *Propolis) moveConflict(elt *File) (err os.Error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return
+	}
+	target := elt.LocalPath + ".conflict-" + host
+	rel, ok := relativePath(p.LocalRoot, target)
+	if !ok {
+		return os.NewError("conflict copy outside the local root: " + target)
+	}
+
+	p.Announce(elt, "rename", "Moving local version aside to [%s]\n", filepath.Base(target))
+	if p.Practice {
+		return
+	}
+	if err = os.Rename(elt.LocalPath, target); err != nil {
+		return
+	}
+	p.enqueue(p.NewFile(rel, true, true), true)
+	return
+}
@@ -0,0 +1,206 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of two-way sync
+
+package propolis
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// what may have happened to each side of a file since the last sync
+var sideStates = []string{"same", "changed", "deleted"}
+
+// the contents of name in one of the versions the tests make
+func version(which, name string) string {
+	switch which {
+	case "original":
+		return "original " + name + "\n"
+	case "local":
+		return "local change to " + name + "\n"
+	case "remote":
+		return "remote change to " + name + "\n"
+	}
+	return ""
+}
+
+// a config for a two-way sync of root that keeps its cache in cachedir
+func bidirectionalConfig(root, cachedir, policy string) *Config {
+	c := sqliteConfig(root, cachedir)
+	c.Bidirectional = true
+	c.Delete = true
+	c.Conflict = policy
+	return c
+}
+
+// Sync each file once, then change both sides as its name says:
+// "changed-deleted" is changed locally and deleted on the server.
+func prepareChanges(t *testing.T, s *fakeS3, root, cachedir string, names []string) {
+	for _, name := range names {
+		writeFile(t, filepath.Join(root, name), version("original", name))
+	}
+	p := newFakePropolis(t, bidirectionalConfig(root, cachedir, "skip"), s)
+	runSync(t, p, true)
+	p.Close()
+
+	for _, name := range names {
+		states := strings.Split(name, "-")
+		switch states[0] {
+		case "changed":
+			writeFile(t, filepath.Join(root, name), version("local", name))
+		case "deleted":
+			if err := os.Remove(filepath.Join(root, name)); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+		}
+		switch states[1] {
+		case "changed":
+			s.put(name, version("remote", name), nil)
+		case "deleted":
+			s.remove(name)
+		}
+	}
+}
+
+// check the contents of name on both sides ("" if it is missing)
+func checkSides(t *testing.T, s *fakeS3, root, label, name, local, remote string) {
+	if got := readFile(filepath.Join(root, name)); got != local {
+		t.Errorf("%s: local %s is %q, expected %q", label, name, got, local)
+	}
+	got := ""
+	if obj := s.get(name); obj != nil {
+		got = string(obj.data)
+	}
+	if got != remote {
+		t.Errorf("%s: server %s is %q, expected %q", label, name, got, remote)
+	}
+}
+
+// Each of the nine combinations of a file being unchanged, changed, or
+// deleted locally and on the server since the last sync. A change on
+// one side is passed to the other; a change on both is a conflict,
+// which -conflict=skip leaves alone.
+func TestReconcile(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	cachedir := tempDir(t)
+	defer os.RemoveAll(cachedir)
+	s := newFakeS3()
+	defer s.Close()
+
+	var names []string
+	for _, local := range sideStates {
+		for _, remote := range sideStates {
+			names = append(names, local+"-"+remote)
+		}
+	}
+	prepareChanges(t, s, root, cachedir, names)
+
+	p := newFakePropolis(t, bidirectionalConfig(root, cachedir, "skip"), s)
+	defer p.Close()
+	report := runSync(t, p, true)
+
+	for _, test := range []struct {
+		name, local, remote string
+	}{
+		{"same-same", "original", "original"},
+		{"same-changed", "remote", "remote"},
+		{"same-deleted", "", ""},
+		{"changed-same", "local", "local"},
+		{"changed-changed", "local", "remote"},
+		{"changed-deleted", "local", ""},
+		{"deleted-same", "", ""},
+		{"deleted-changed", "", "remote"},
+		{"deleted-deleted", "", ""},
+	} {
+		checkSides(t, s, root, "skip", test.name, version(test.local, test.name), version(test.remote, test.name))
+	}
+
+	conflicts := report.Conflicts
+	sort.Strings(conflicts)
+	if strings.Join(conflicts, " ") != "changed-changed changed-deleted deleted-changed" {
+		t.Errorf("conflicts reported: %v", conflicts)
+	}
+
+	// a file gone from both sides has nothing left to remember
+	if info, _, _, err := p.Db.Get("deleted-deleted"); err != nil || info != nil {
+		t.Errorf("deleted-deleted is still cached: %v", err)
+	}
+}
+
+// How each -conflict policy settles a file changed on both sides.
+func TestConflictPolicies(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Hostname: %v", err)
+	}
+	const name = "changed-changed"
+	for _, test := range []struct {
+		policy        string
+		offset        int64 // moves the local mtime from now, if not 0
+		local, remote string
+	}{
+		{"local", 0, "local", "local"},
+		{"remote", 0, "remote", "remote"},
+		{"newer", -3600e9, "remote", "remote"},
+		{"newer", 3600e9, "local", "local"},
+		{"rename", 0, "remote", "remote"},
+	} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		cachedir := tempDir(t)
+		defer os.RemoveAll(cachedir)
+		s := newFakeS3()
+		defer s.Close()
+
+		prepareChanges(t, s, root, cachedir, []string{name})
+		if test.offset != 0 {
+			when := time.Nanoseconds() + test.offset
+			if err := os.Chtimes(filepath.Join(root, name), when, when); err != nil {
+				t.Fatalf("Chtimes: %v", err)
+			}
+		}
+		p := newFakePropolis(t, bidirectionalConfig(root, cachedir, test.policy), s)
+		report := runSync(t, p, true)
+		p.Close()
+
+		label := test.policy
+		if test.offset != 0 {
+			label += fmt.Sprintf(" (local mtime moved %+ds)", test.offset/1e9)
+		}
+		checkSides(t, s, root, label, name, version(test.local, name), version(test.remote, name))
+		if len(report.Conflicts) != 1 {
+			t.Errorf("%s: conflicts reported: %v", label, report.Conflicts)
+		}
+
+		// the local version lives on under another name
+		if test.policy == "rename" {
+			moved := name + ".conflict-" + host
+			checkSides(t, s, root, label, moved, version("local", name), version("local", name))
+		}
+	}
+}
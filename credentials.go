@@ -0,0 +1,183 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Temporary credentials from the EC2/ECS instance metadata service
+
+package propolis
+
+import (
+	"bufio"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"json"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	imds_host              = "169.254.169.254"
+	imds_token_path        = "/latest/api/token"
+	imds_credentials_path  = "/latest/meta-data/iam/security-credentials/"
+	imds_token_ttl         = "21600"
+	ecs_host               = "169.254.170.2"
+	ecs_credentials_uri    = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+	metadata_timeout       = 2e9   // give up on the metadata service after this long
+	credentials_refresh_ns = 300e9 // refresh this long before credentials expire
+)
+
+// the credential document served by the metadata service
+type instanceCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
+
+// Fetch temporary credentials for the role attached to this instance
+// (EC2) or task (ECS). expires is in nanoseconds since the epoch.
+func fetchInstanceCredentials() (key, secret, token string, expires int64, err os.Error) {
+	var body []byte
+
+	if uri := os.Getenv(ecs_credentials_uri); uri != "" {
+		// ECS tasks get a task-specific path on a different host
+		if body, err = metadataRequest("GET", ecs_host, uri, nil); err != nil {
+			return
+		}
+	} else {
+		// IMDSv2: get a session token first
+		var session []byte
+		if session, err = metadataRequest("PUT", imds_host, imds_token_path,
+			http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {imds_token_ttl}}); err != nil {
+			return
+		}
+		header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(session)}}
+
+		// find the role name
+		var roles []byte
+		if roles, err = metadataRequest("GET", imds_host, imds_credentials_path, header); err != nil {
+			return
+		}
+		role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+		if role == "" {
+			err = os.NewError("no IAM role attached to this instance")
+			return
+		}
+
+		// and get the credentials for that role
+		if body, err = metadataRequest("GET", imds_host, imds_credentials_path+role, header); err != nil {
+			return
+		}
+	}
+
+	var creds instanceCredentials
+	if err = json.Unmarshal(body, &creds); err != nil {
+		return
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		err = os.NewError("incomplete credentials from instance metadata")
+		return
+	}
+	var when *time.Time
+	if when, err = time.Parse(time.RFC3339, creds.Expiration); err != nil {
+		return
+	}
+	return creds.AccessKeyId, creds.SecretAccessKey, creds.Token, when.Seconds() * 1e9, nil
+}
+
+// issue a request to a metadata service, giving up quickly if it is
+// not there (i.e., we are not running on EC2 or ECS)
+func metadataRequest(method, host, path string, header http.Header) (body []byte, err os.Error) {
+	type result struct {
+		body []byte
+		err  os.Error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		var res result
+		res.body, res.err = metadataExchange(method, host, path, header)
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		return res.body, res.err
+	case <-time.After(metadata_timeout):
+	}
+	return nil, os.NewError("timed out contacting instance metadata service")
+}
+
+func metadataExchange(method, host, path string, header http.Header) (body []byte, err os.Error) {
+	var req *http.Request
+	if req, err = http.NewRequest(method, "http://"+host+path, nil); err != nil {
+		return
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if method == "PUT" {
+		req.ContentLength = 0
+	}
+
+	var conn net.Conn
+	if conn, err = net.Dial("tcp", host+":80"); err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetTimeout(metadata_timeout)
+	if err = req.Write(conn); err != nil {
+		return
+	}
+
+	var resp *http.Response
+	if resp, err = http.ReadResponse(bufio.NewReader(conn), req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = os.NewError(fmt.Sprintf("instance metadata request for %s failed: %s", path, resp.Status))
+		return
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Get the current credentials. Temporary credentials from the
+// instance metadata service are refreshed shortly before they expire,
+// so long-running watch sessions keep working.
+func (p *Propolis) Credentials() (key, secret, token string) {
+	p.credLock.Lock()
+	defer p.credLock.Unlock()
+
+	if p.Expires != 0 && time.Nanoseconds() > p.Expires-credentials_refresh_ns {
+		k, s, t, expires, err := fetchInstanceCredentials()
+		if err != nil {
+			// keep using the old ones; they may still be valid
+			p.Log.Errorf("Error refreshing instance credentials: %v\n", err)
+		} else {
+			p.Key, p.Secret, p.Token, p.Expires = k, s, t, expires
+		}
+	}
+	return p.Key, p.Secret, p.Token
+}
@@ -0,0 +1,596 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// A fake S3 server for the tests
+
+package propolis
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"url"
+	"xml"
+)
+
+// an object in the fake bucket. A big object made up for a copy test
+// has a size but no contents.
+type fakeObject struct {
+	data     []byte
+	size     int64
+	etag     string      // without the quotes
+	header   http.Header // metadata and content headers stored with it
+	modified int64
+}
+
+// a multipart upload in progress
+type fakeUpload struct {
+	key    string
+	header http.Header
+	parts  map[int]*fakeObject
+}
+
+// the parts listed in a request to finish a multipart upload
+type fakeComplete struct {
+	Part []Part
+}
+
+// A bucket served over http that answers the requests propolis makes:
+// object GET, HEAD, PUT, copy, and DELETE, bucket lists, the
+// versioning status, and multipart uploads and copies. Every request
+// is logged, and fail can turn any of them into a 500 error.
+type fakeS3 struct {
+	sync.Mutex
+	server  *httptest.Server
+	objects map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	next    int
+
+	// "KIND key" for each request, where KIND is the method or one of
+	// LIST, VERSIONING, COPY, INITIATE, PART, COPYPART, COMPLETE, ABORT
+	requests []string
+
+	// leave NextMarker out of truncated delimited v1 lists, as some
+	// servers that imitate S3 do
+	noNextMarker bool
+
+	// called for each request with the lock held
+	inspect func(r *http.Request)
+	fail    func(kind, key string) bool
+}
+
+// the header names kept with an object, besides x-amz-meta-*
+var fakeStoredHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+	"X-Amz-Acl",
+	"X-Amz-Storage-Class",
+}
+
+func newFakeS3() *fakeS3 {
+	s := &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+func (s *fakeS3) Close() {
+	s.server.Close()
+}
+
+// point p at the fake server instead of S3
+func (s *fakeS3) connect(p *Propolis) {
+	u, err := url.Parse(s.server.URL + "/")
+	if err != nil {
+		panic(err.String())
+	}
+	p.Url = u
+	p.PathStyle = false
+}
+
+// store an object directly, as if another client had uploaded it
+func (s *fakeS3) put(key, contents string, header http.Header) *fakeObject {
+	s.Lock()
+	defer s.Unlock()
+	if header == nil {
+		header = make(http.Header)
+	}
+	obj := &fakeObject{
+		data:     []byte(contents),
+		size:     int64(len(contents)),
+		etag:     md5Hex([]byte(contents)),
+		header:   header,
+		modified: time.Nanoseconds(),
+	}
+	s.objects[key] = obj
+	return obj
+}
+
+// delete an object directly, as if another client had deleted it
+func (s *fakeS3) remove(key string) {
+	s.Lock()
+	defer s.Unlock()
+	s.objects[key] = nil, false
+}
+
+// the object stored at key, or nil
+func (s *fakeS3) get(key string) *fakeObject {
+	s.Lock()
+	defer s.Unlock()
+	return s.objects[key]
+}
+
+// the keys in the bucket, sorted
+func (s *fakeS3) keys() (keys []string) {
+	s.Lock()
+	defer s.Unlock()
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// how many requests of the given kind were made for key
+func (s *fakeS3) count(kind, key string) (n int) {
+	s.Lock()
+	defer s.Unlock()
+	for _, request := range s.requests {
+		if request == kind+" "+key {
+			n++
+		}
+	}
+	return
+}
+
+// forget the requests made so far
+func (s *fakeS3) clearRequests() {
+	s.Lock()
+	defer s.Unlock()
+	s.requests = nil
+}
+
+func md5Hex(data []byte) string {
+	h := md5.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum())
+}
+
+func md5Base64(data []byte) string {
+	h := md5.New()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum())
+}
+
+// the headers from a request that are stored with an object
+func storedHeaders(header http.Header) http.Header {
+	stored := make(http.Header)
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") ||
+			strings.HasPrefix(name, "X-Amz-Checksum-") && name != "X-Amz-Checksum-Mode" {
+			stored[name] = values
+		}
+	}
+	for _, name := range fakeStoredHeaders {
+		if value := header.Get(name); value != "" {
+			stored.Set(name, value)
+		}
+	}
+	return stored
+}
+
+// what kind of request is this?
+func requestKind(r *http.Request, key string, query url.Values) string {
+	_, uploads := query["uploads"]
+	_, uploadid := query["uploadId"]
+	copying := r.Header.Get("X-Amz-Copy-Source") != ""
+	switch {
+	case key == "" && r.Method == "GET":
+		if _, versioning := query["versioning"]; versioning {
+			return "VERSIONING"
+		}
+		if uploads {
+			return "UPLOADS"
+		}
+		return "LIST"
+	case key == "":
+		return "BUCKET-" + r.Method
+	case r.Method == "POST" && uploads:
+		return "INITIATE"
+	case r.Method == "PUT" && uploadid && copying:
+		return "COPYPART"
+	case r.Method == "PUT" && uploadid:
+		return "PART"
+	case r.Method == "POST" && uploadid:
+		return "COMPLETE"
+	case r.Method == "DELETE" && uploadid:
+		return "ABORT"
+	case r.Method == "PUT" && copying:
+		return "COPY"
+	}
+	return r.Method
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := strings.TrimLeft(r.URL.Path, "/")
+	query := r.URL.Query()
+	kind := requestKind(r, key, query)
+	s.requests = append(s.requests, kind+" "+key)
+	if s.inspect != nil {
+		s.inspect(r)
+	}
+	if s.fail != nil && s.fail(kind, key) {
+		fakeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	switch kind {
+	case "BUCKET-HEAD", "BUCKET-PUT":
+		w.WriteHeader(http.StatusOK)
+	case "VERSIONING":
+		fmt.Fprint(w, "<VersioningConfiguration></VersioningConfiguration>")
+	case "UPLOADS":
+		fmt.Fprint(w, "<ListMultipartUploadsResult></ListMultipartUploadsResult>")
+	case "LIST":
+		s.list(w, query)
+	case "GET", "HEAD":
+		s.serveObject(w, r, key)
+	case "PUT":
+		s.putObject(w, r, key)
+	case "COPY":
+		s.copyObject(w, r, key)
+	case "DELETE":
+		s.objects[key] = nil, false
+		w.WriteHeader(http.StatusNoContent)
+	case "INITIATE":
+		s.next++
+		id := fmt.Sprintf("upload-%d", s.next)
+		s.uploads[id] = &fakeUpload{key: key, header: storedHeaders(r.Header), parts: make(map[int]*fakeObject)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			xmlEscape(key), id)
+	case "PART", "COPYPART":
+		s.putPart(w, r, kind, query)
+	case "COMPLETE":
+		s.complete(w, r, key, query.Get("uploadId"))
+	case "ABORT":
+		s.uploads[query.Get("uploadId")] = nil, false
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// write an S3 error document
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// escape text for an xml document
+func xmlEscape(s string) string {
+	buf := new(bytes.Buffer)
+	for _, r := range s {
+		switch r {
+		case '&':
+			buf.WriteString("&amp;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '"':
+			buf.WriteString("&quot;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// answer a bucket list request, in either version of the list API
+func (s *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	max, _ := strconv.Atoi(query.Get("max-keys"))
+	if max <= 0 {
+		max = 1000
+	}
+	v2 := query.Get("list-type") == "2"
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("continuation-token")
+	}
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	contents := new(bytes.Buffer)
+	prefixes := new(bytes.Buffer)
+	count := 0
+	last := ""
+	truncated := false
+	for _, key := range keys {
+		// keys below the delimiter roll up into a common prefix
+		name := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				name = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if name <= after || name == last {
+			continue
+		}
+		if count == max {
+			truncated = true
+			break
+		}
+		count++
+		last = name
+		if name != key {
+			fmt.Fprintf(prefixes, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", xmlEscape(name))
+			continue
+		}
+		obj := s.objects[key]
+		fmt.Fprintf(contents, "<Contents><Key>%s</Key><LastModified>%s</LastModified>"+
+			"<ETag>&quot;%s&quot;</ETag><Size>%d</Size></Contents>",
+			xmlEscape(key), time.SecondsToUTC(obj.modified/1e9).Format(list_time_format), obj.etag, obj.size)
+	}
+
+	fmt.Fprintf(w, "<ListBucketResult><Prefix>%s</Prefix><MaxKeys>%d</MaxKeys><IsTruncated>%v</IsTruncated>",
+		xmlEscape(prefix), max, truncated)
+	if truncated && v2 {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", xmlEscape(last))
+	}
+	if truncated && !v2 && delimiter != "" && !s.noNextMarker {
+		fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", xmlEscape(last))
+	}
+	w.Write(contents.Bytes())
+	w.Write(prefixes.Bytes())
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// answer a GET or HEAD for an object, honoring the conditions and
+// ranges that downloads use
+func (s *fakeS3) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj := s.objects[key]
+	if obj == nil {
+		fakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	etag := "\"" + obj.etag + "\""
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != etag {
+		fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+
+	for name, values := range obj.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Etag", etag)
+	w.Header().Set("Last-Modified", time.SecondsToUTC(obj.modified/1e9).Format(http.TimeFormat))
+
+	var first int64
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &first); err != nil || first >= obj.size {
+			fakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, obj.size-1, obj.size))
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa64(obj.size-first))
+	w.WriteHeader(status)
+	if r.Method == "GET" {
+		w.Write(obj.data[first:])
+	}
+}
+
+// read an upload body, checking it against its Content-MD5
+func readBody(w http.ResponseWriter, r *http.Request) (data []byte, ok bool) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "IncompleteBody")
+		return nil, false
+	}
+	if sum := r.Header.Get("Content-Md5"); sum != "" && sum != md5Base64(data) {
+		fakeError(w, http.StatusBadRequest, "BadDigest")
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	obj := &fakeObject{
+		data:     data,
+		size:     int64(len(data)),
+		etag:     md5Hex(data),
+		header:   storedHeaders(r.Header),
+		modified: time.Nanoseconds(),
+	}
+	s.objects[key] = obj
+	w.Header().Set("Etag", "\""+obj.etag+"\"")
+	w.WriteHeader(http.StatusOK)
+}
+
+// find the source of a copy, checking its ETag if the copy is
+// conditional
+func (s *fakeS3) copySource(w http.ResponseWriter, r *http.Request) *fakeObject {
+	u, err := url.Parse(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "InvalidArgument")
+		return nil
+	}
+
+	// the source is /bucket/key
+	src := strings.TrimLeft(u.Path, "/")
+	if i := strings.Index(src, "/"); i >= 0 {
+		src = src[i+1:]
+	}
+	obj := s.objects[src]
+	if obj == nil {
+		fakeError(w, http.StatusNotFound, "NoSuchKey")
+		return nil
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != "\""+obj.etag+"\"" {
+		fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return nil
+	}
+	return obj
+}
+
+func (s *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	src := s.copySource(w, r)
+	if src == nil {
+		return
+	}
+	if src.size > max_copy_size {
+		fakeError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	obj := &fakeObject{
+		data:     src.data,
+		size:     src.size,
+		etag:     src.etag,
+		header:   src.header,
+		modified: time.Nanoseconds(),
+	}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		obj.header = storedHeaders(r.Header)
+	}
+	s.objects[key] = obj
+	fmt.Fprintf(w, "<CopyObjectResult><ETag>&quot;%s&quot;</ETag></CopyObjectResult>", obj.etag)
+}
+
+// store one part of a multipart upload, sent or copied
+func (s *fakeS3) putPart(w http.ResponseWriter, r *http.Request, kind string, query url.Values) {
+	upload := s.uploads[query.Get("uploadId")]
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if upload == nil || err != nil {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	part := new(fakeObject)
+	if kind == "PART" {
+		var ok bool
+		if part.data, ok = readBody(w, r); !ok {
+			return
+		}
+		part.size = int64(len(part.data))
+		part.etag = md5Hex(part.data)
+		upload.parts[number] = part
+		w.Header().Set("Etag", "\""+part.etag+"\"")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	src := s.copySource(w, r)
+	if src == nil {
+		return
+	}
+	var first, last int64
+	if _, err = fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &first, &last); err != nil ||
+		first > last || last >= src.size {
+		fakeError(w, http.StatusBadRequest, "InvalidRange")
+		return
+	}
+	part.size = last - first + 1
+	if src.data != nil {
+		part.data = src.data[first : last+1]
+		part.etag = md5Hex(part.data)
+	} else {
+		// made-up contents get a made-up hash
+		part.etag = md5Hex([]byte(fmt.Sprintf("%s:%d-%d", src.etag, first, last)))
+	}
+	upload.parts[number] = part
+	fmt.Fprintf(w, "<CopyPartResult><ETag>&quot;%s&quot;</ETag></CopyPartResult>", part.etag)
+}
+
+// finish a multipart upload. The ETag is the md5 hash of the part
+// hashes, followed by the number of parts.
+func (s *fakeS3) complete(w http.ResponseWriter, r *http.Request, key, uploadid string) {
+	upload := s.uploads[uploadid]
+	if upload == nil || upload.key != key {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	request := new(fakeComplete)
+	if err := xml.Unmarshal(r.Body, request); err != nil || len(request.Part) == 0 {
+		fakeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	obj := &fakeObject{header: upload.header, modified: time.Nanoseconds()}
+	sparse := false
+	h := md5.New()
+	for i, listed := range request.Part {
+		part := upload.parts[listed.PartNumber]
+		if listed.PartNumber != i+1 || part == nil || listed.ETag != "\""+part.etag+"\"" {
+			fakeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		sum, _ := hex.DecodeString(part.etag)
+		h.Write(sum)
+		obj.size += part.size
+		obj.data = append(obj.data, part.data...)
+		sparse = sparse || part.data == nil
+	}
+	if sparse {
+		obj.data = nil
+	}
+	obj.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum()), len(request.Part))
+	s.objects[key] = obj
+	s.uploads[uploadid] = nil, false
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ETag>&quot;%s&quot;</ETag></CompleteMultipartUploadResult>",
+		xmlEscape(key), obj.etag)
+}
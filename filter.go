@@ -0,0 +1,143 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Filters that limit which files take part in a sync
+
+package propolis
+
+import (
+	"os"
+	"strings"
+)
+
+// Report whether a local file should be left out of the sync. Files
+// that are filtered out are treated as if they do not exist on either
+// side, so nothing is uploaded, downloaded, or deleted for them.
+func (p *Propolis) FilterLocal(info *os.FileInfo) bool {
+	// directories are always walked
+	if info.IsDirectory() {
+		return false
+	}
+	return !p.inWindow(info.Mtime_ns) || !p.inSizeRange(info.Size)
+}
+
+// Report whether a file found only on the server should be left out
+// of the sync. The metadata stored with the file is used if the cache
+// has it, otherwise what the server scan reported.
+func (p *Propolis) FilterRemote(elt *File) bool {
+	if p.IgnoreHidden && p.hiddenKey(elt.ServerPath) {
+		return true
+	}
+	if p.tooDeep(p.keyDepth(elt.ServerPath)) {
+		return true
+	}
+
+	var mtime, size int64
+	switch {
+	case elt.CacheInfo != nil && elt.CacheInfo.IsDirectory():
+		return false
+	case elt.CacheInfo != nil:
+		mtime, size = elt.CacheInfo.Mtime_ns, elt.CacheInfo.Size
+	case elt.ServerHashHex != "":
+		mtime, size = elt.ServerModified, elt.ServerSize
+	default:
+		// nothing is known, so let the sync sort it out
+		return false
+	}
+
+	if mtime != 0 && !p.inWindow(mtime) {
+		return true
+	}
+	return !p.inSizeRange(size)
+}
+
+// does a file or directory name start with a dot?
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// does any part of a key below the bucket root start with a dot?
+func (p *Propolis) hiddenKey(key string) bool {
+	name, ok := p.belowBucketRoot(key)
+	if !ok {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if isHidden(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// is something this many levels below the roots past -max-depth?
+func (p *Propolis) tooDeep(levels int) bool {
+	return p.MaxDepth > 0 && levels > p.MaxDepth
+}
+
+// how many levels deep is a slash-separated name (0 for the root)?
+func depth(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// how many levels below the bucket root is a key?
+func (p *Propolis) keyDepth(key string) int {
+	name, _ := p.belowBucketRoot(key)
+	return depth(name)
+}
+
+// the part of a key below the bucket root
+func (p *Propolis) belowBucketRoot(key string) (name string, ok bool) {
+	if p.BucketRoot == "" {
+		return key, true
+	}
+	if key == p.BucketRoot {
+		return "", true
+	}
+	if !strings.HasPrefix(key, p.BucketRoot+"/") {
+		return "", false
+	}
+	return key[len(p.BucketRoot)+1:], true
+}
+
+// is a modification time (ns) inside the -newer-than/-older-than window?
+func (p *Propolis) inWindow(mtime int64) bool {
+	if p.NewerThan != 0 && mtime < p.NewerThan {
+		return false
+	}
+	if p.OlderThan != 0 && mtime > p.OlderThan {
+		return false
+	}
+	return true
+}
+
+// is a file size inside the -min-size/-max-size range?
+func (p *Propolis) inSizeRange(size int64) bool {
+	if size < p.MinSize {
+		return false
+	}
+	if p.MaxSize != 0 && size > p.MaxSize {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Compressed uploads
+
+package propolis
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// original size of a file that is stored compressed
+const uncompressed_size_header = "X-Amz-Meta-Uncompressed-Size"
+
+// content types that are worth compressing (besides text/*)
+var compressible_types = []string{
+	"application/javascript",
+	"application/x-javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"image/svg+xml",
+}
+
+// Should a file of this MIME type be compressed with -gzip?
+func compressible(mimetype string) bool {
+	if semi := strings.Index(mimetype, ";"); semi >= 0 {
+		mimetype = mimetype[:semi]
+	}
+	mimetype = strings.TrimSpace(mimetype)
+	if strings.HasPrefix(mimetype, "text/") {
+		return true
+	}
+	for _, kind := range compressible_types {
+		if mimetype == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress everything from src into dst. The output only depends on
+// the input (no timestamp or name in the header), so compressing the
+// same file twice gives the same bytes and the same md5 hash.
+func gzipTo(dst io.Writer, src io.Reader) (err os.Error) {
+	var gz *gzip.Compressor
+	if gz, err = gzip.NewWriter(dst); err != nil {
+		return
+	}
+	if _, err = io.Copy(gz, src); err != nil {
+		gz.Close()
+		return
+	}
+	return gz.Close()
+}
+
+// counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(buf []byte) (int, os.Error) {
+	w.n += int64(len(buf))
+	return len(buf), nil
+}
+
+// Stream a compressed copy of a file. Closing the reader also closes
+// the file.
+func gzipReader(fp *os.File) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(gzipTo(w, fp))
+	}()
+	return &gzipPipe{r, fp}
+}
+
+type gzipPipe struct {
+	*io.PipeReader
+	fp *os.File
+}
+
+func (g *gzipPipe) Close() os.Error {
+	g.PipeReader.Close()
+	return g.fp.Close()
+}
+
+// Replace a compressed file with its uncompressed contents, using tmp
+// as scratch space.
+func gunzipFile(name, tmp string) (err os.Error) {
+	var src *os.File
+	if src, err = os.Open(name); err != nil {
+		return
+	}
+	defer src.Close()
+
+	var gz *gzip.Decompressor
+	if gz, err = gzip.NewReader(src); err != nil {
+		return
+	}
+	defer gz.Close()
+
+	var dst *os.File
+	if dst, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return
+	}
+	_, err = io.Copy(dst, gz)
+	dst.Close()
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// Decompress everything written to the result into dst. Closing the
+// result waits for the last of the output and closes dst.
+func gunzipWriter(dst io.WriteCloser) io.WriteCloser {
+	r, w := io.Pipe()
+	g := &gunzipPipe{w, make(chan os.Error, 1)}
+	go func() {
+		gz, err := gzip.NewReader(r)
+		if err == nil {
+			_, err = io.Copy(dst, gz)
+			gz.Close()
+		}
+		if e := dst.Close(); err == nil {
+			err = e
+		}
+		r.CloseWithError(err)
+		g.done <- err
+	}()
+	return g
+}
+
+type gunzipPipe struct {
+	*io.PipeWriter
+	done chan os.Error
+}
+
+func (g *gunzipPipe) Close() os.Error {
+	g.PipeWriter.Close()
+	return <-g.done
+}
@@ -0,0 +1,166 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Per-file upload header rules
+
+package propolis
+
+import (
+	"bufio"
+	"fmt"
+	"http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// headers that rules are allowed to set. S3 stores these with the
+// object and returns them on every download.
+var rule_headers = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Expires",
+	"X-Amz-Acl",
+	"X-Amz-Storage-Class",
+}
+
+// headers that choose how an object is stored rather than describe
+// it. The first matching rule wins, so specific patterns can come
+// before catch-alls, and files no rule matches get the global ACL and
+// storage class.
+var first_match_headers = []string{
+	"X-Amz-Acl",
+	"X-Amz-Storage-Class",
+}
+
+func isFirstMatchHeader(header string) bool {
+	for _, h := range first_match_headers {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+// A rule that sets a header on uploads of files whose names match a
+// shell pattern, e.g. *.html gets Cache-Control: max-age=300
+type HeaderRule struct {
+	Pattern string // matched against the base name of the file
+	Header  string // one of rule_headers
+	Value   string
+}
+
+// Read header rules from a file with one rule per line:
+//
+//	*.html          Cache-Control: max-age=300
+//	*.[0-9a-f]*.js  Cache-Control: max-age=31536000
+//	*.pdf           Content-Disposition: attachment
+//	index.html      X-Amz-Acl: public-read
+//	*.json          X-Amz-Acl: private
+//	thumb-*         X-Amz-Storage-Class: STANDARD_IA
+//
+// Blank lines and lines starting with # are ignored. When several
+// rules set the same header on a file, the last one wins, except for
+// X-Amz-Acl and X-Amz-Storage-Class where the first one does.
+func ReadHeaderRules(filename string) (rules []HeaderRule, err os.Error) {
+	var fp *os.File
+	if fp, err = os.Open(filename); err != nil {
+		return
+	}
+	defer fp.Close()
+
+	read := bufio.NewReader(fp)
+	linenum := 0
+	for {
+		var line string
+		if line, err = read.ReadString('\n'); err != nil && (err != os.EOF || line == "") {
+			if err == os.EOF {
+				err = nil
+			}
+			return
+		}
+		linenum++
+		s := strings.TrimSpace(line)
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		// pattern header: value
+		var rule HeaderRule
+		fields := strings.SplitN(s, ":", 2)
+		if words := strings.Fields(fields[0]); len(fields) == 2 && len(words) == 2 {
+			rule.Pattern = words[0]
+			rule.Header = http.CanonicalHeaderKey(words[1])
+			rule.Value = strings.TrimSpace(fields[1])
+		}
+		if rule.Pattern == "" || rule.Value == "" {
+			return nil, fmt.Errorf("%s:%d: expected a pattern and a header", filename, linenum)
+		}
+		if _, err = filepath.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad pattern %q", filename, linenum, rule.Pattern)
+		}
+		allowed := false
+		for _, header := range rule_headers {
+			allowed = allowed || header == rule.Header
+		}
+		if !allowed {
+			return nil, fmt.Errorf("%s:%d: header %s cannot be set by a rule", filename, linenum, rule.Header)
+		}
+		if !validRuleValue(rule) {
+			return nil, fmt.Errorf("%s:%d: unknown %s value %q", filename, linenum, rule.Header, rule.Value)
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// the ACL and storage class must be ones S3 knows
+func validRuleValue(rule HeaderRule) bool {
+	var valid []string
+	switch rule.Header {
+	case "X-Amz-Acl":
+		valid = CannedACLs
+	case "X-Amz-Storage-Class":
+		valid = StorageClasses
+	default:
+		return true
+	}
+	for _, value := range valid {
+		if value == rule.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the headers from any rules that match this file name.
+func (p *Propolis) SetRuleHeaders(req *http.Request, name string) {
+	name = filepath.Base(name)
+	chosen := make(map[string]bool)
+	for _, rule := range p.HeaderRules {
+		if chosen[rule.Header] {
+			continue
+		}
+		if matched, _ := filepath.Match(rule.Pattern, name); matched {
+			req.Header.Set(rule.Header, rule.Value)
+			chosen[rule.Header] = isFirstMatchHeader(rule.Header)
+		}
+	}
+}
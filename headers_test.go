@@ -0,0 +1,118 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of per-file header rules
+
+package propolis
+
+import (
+	"http"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const test_rules = `# specific patterns first
+index.html     X-Amz-Acl: public-read
+*.html         X-Amz-Acl: authenticated-read
+thumb-*        X-Amz-Storage-Class: STANDARD_IA
+*.html         Cache-Control: max-age=300
+`
+
+// Uploads get the ACL and storage class of the first rule that matches
+// their names, or the global ones if none do, and the chosen headers
+// are covered by the request signature.
+func TestHeaderRules(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+
+	rulefile := filepath.Join(root, ".rules")
+	if err := ioutil.WriteFile(rulefile, []byte(test_rules), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	rules, err := ReadHeaderRules(rulefile)
+	if err != nil {
+		t.Fatalf("ReadHeaderRules: %v", err)
+	}
+
+	expected := []struct {
+		name, acl, class, cache string
+	}{
+		{"index.html", "public-read", "REDUCED_REDUNDANCY", "max-age=300"},
+		{"about.html", "authenticated-read", "REDUCED_REDUNDANCY", "max-age=300"},
+		{"thumb-cat.jpg", "private", "STANDARD_IA", ""},
+		{"config.json", "private", "REDUCED_REDUNDANCY", ""},
+	}
+	for _, file := range expected {
+		writeFile(t, filepath.Join(root, file.name), file.name+"\n")
+	}
+
+	c := testConfig(root)
+	c.HeaderRules = rules
+	c.ACL = "private"
+	c.ReducedRedundancy = true
+	c.IgnoreHidden = true
+	p := newFakePropolis(t, c, s)
+
+	// the server checks each upload's signature against the headers
+	// it actually received
+	var unsigned []string
+	s.inspect = func(r *http.Request) {
+		if r.Method != "PUT" {
+			return
+		}
+		msg := p.StringToSign(r, r.Header.Get("Date"))
+		key, signature := p.Sign(msg)
+		if r.Header.Get("Authorization") != "AWS "+key+":"+signature {
+			unsigned = append(unsigned, r.URL.Path)
+		}
+		for _, header := range []string{"X-Amz-Acl", "X-Amz-Storage-Class"} {
+			line := strings.ToLower(header) + ":" + r.Header.Get(header) + "\n"
+			if r.Header.Get(header) == "" || !strings.Contains(msg, line) {
+				unsigned = append(unsigned, r.URL.Path+" "+header)
+			}
+		}
+	}
+	runSync(t, p, true)
+
+	for _, file := range expected {
+		obj := s.get(file.name)
+		if obj == nil {
+			t.Errorf("%s was not uploaded", file.name)
+			continue
+		}
+		for header, value := range map[string]string{
+			"X-Amz-Acl":           file.acl,
+			"X-Amz-Storage-Class": file.class,
+			"Cache-Control":       file.cache,
+		} {
+			if got := obj.header.Get(header); got != value {
+				t.Errorf("%s was uploaded with %s %q, expected %q", file.name, header, got, value)
+			}
+		}
+	}
+	if len(unsigned) > 0 {
+		t.Errorf("headers missing from the signature: %v", unsigned)
+	}
+}
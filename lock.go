@@ -0,0 +1,73 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Advisory lock on the cache
+
+package propolis
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// An advisory lock on a file, held until Unlock is called or the
+// process exits.
+type Lock struct {
+	fp *os.File
+}
+
+// Take an exclusive lock on filename, creating it if necessary.
+// Fails right away if another process already holds the lock.
+func LockFile(filename string) (lock *Lock, err os.Error) {
+	var fp *os.File
+	if fp, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return
+	}
+	if errno := syscall.Flock(fp.Fd(), syscall.LOCK_EX|syscall.LOCK_NB); errno != 0 {
+		fp.Close()
+		if errno != syscall.EWOULDBLOCK {
+			return nil, os.NewSyscallError("flock", errno)
+		}
+
+		// say who has it
+		owner := "another process"
+		if contents, er := ioutil.ReadFile(filename); er == nil && len(contents) > 0 {
+			owner = "process " + strings.TrimSpace(string(contents))
+		}
+		return nil, fmt.Errorf("%s is locked by %s", filename, owner)
+	}
+
+	// record our pid for anyone who finds it locked
+	fp.Truncate(0)
+	fmt.Fprintf(fp, "%d\n", os.Getpid())
+	return &Lock{fp}, nil
+}
+
+// Release the lock. The file is left in place, since removing it
+// could let two other processes lock different files of the same name.
+func (lock *Lock) Unlock() os.Error {
+	if lock == nil {
+		return nil
+	}
+	return lock.fp.Close()
+}
@@ -0,0 +1,95 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Leveled logging
+
+package propolis
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// log levels, from most to least verbose
+const (
+	LogDebug = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var level_names = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// A logger that sends debug and info messages to one writer and
+// warnings and errors to another, and optionally copies everything
+// to a log file with timestamps. Messages below Level are dropped.
+// A nil *Logger drops everything.
+type Logger struct {
+	Level int       // least important level that is reported
+	Out   io.Writer // debug and info messages (nil to drop them)
+	Err   io.Writer // warnings and errors (nil to drop them)
+	File  io.Writer // log file, also receives everything at Level and up (nil for none)
+
+	progress *Progress // status line to erase before writing
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(LogDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(LogInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(LogWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(LogError, format, args...)
+}
+
+func (l *Logger) write(level int, format string, args ...interface{}) {
+	if l == nil || level < l.Level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	out := l.Out
+	if level >= LogWarn {
+		out = l.Err
+	}
+	if out != nil {
+		l.progress.clear()
+		fmt.Fprint(out, msg)
+	}
+
+	if l.File != nil {
+		if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+			msg += "\n"
+		}
+		stamp := time.LocalTime().Format("2006/01/02 15:04:05")
+		fmt.Fprintf(l.File, "%s %-5s %s", stamp, level_names[level], msg)
+	}
+}
@@ -0,0 +1,88 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Manifest of the actions taken by a sync
+
+package propolis
+
+import (
+	"json"
+	"sync"
+	"time"
+)
+
+// one line of the manifest, written once an action has finished
+type ManifestEntry struct {
+	Time      string `json:"time"`
+	Path      string `json:"path"`
+	Direction string `json:"direction"`
+	Action    string `json:"action"`
+	Bytes     int64  `json:"bytes"`
+	Md5       string `json:"md5,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// keeps lines from concurrent workers from interleaving
+var manifestLock sync.Mutex
+
+// Record the actions taken on a file that finished syncing. Nothing
+// is taken in a practice run, so nothing is recorded.
+func (p *Propolis) writeManifest(elt *File) {
+	if p.Manifest == nil || p.Practice {
+		return
+	}
+	for _, action := range elt.actions {
+		p.writeManifestEntry(elt, action.Action, action.Size, action.Reason)
+	}
+}
+
+func (p *Propolis) writeManifestEntry(elt *File, action string, size int64, reason string) {
+	if p.Manifest == nil || p.Practice {
+		return
+	}
+	direction := "pull"
+	if elt.Push {
+		direction = "push"
+	}
+
+	// deleted files have no contents to describe
+	md5 := ""
+	if action != "delete" {
+		md5 = elt.LocalHashHex
+		if md5 == "" {
+			md5 = elt.CacheHashHex
+		}
+	}
+
+	entry := &ManifestEntry{
+		Time:      time.UTC().Format(time.RFC3339),
+		Path:      elt.ServerPath,
+		Direction: direction,
+		Action:    action,
+		Bytes:     size,
+		Md5:       md5,
+		Reason:    reason,
+	}
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	if err := json.NewEncoder(p.Manifest).Encode(entry); err != nil {
+		p.Log.Errorf("Error writing manifest entry [%s]: %v\n", elt.ServerPath, err)
+	}
+}
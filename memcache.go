@@ -0,0 +1,411 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// In-memory metadata cache
+
+package propolis
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memoryEntry struct {
+	hashHex string
+	info    os.FileInfo
+	synced  int64
+	linked  bool   // a hard link marker, recording the linked file's size
+	etag    string // ETag of an object stored in parts
+	stored  int64  // size of a compressed object on the server
+
+	checksums map[string]string // algorithm -> second checksum
+}
+
+// A Storage implementation that keeps everything in memory. Nothing
+// survives the process, so every run starts with an empty cache.
+type MemoryCache struct {
+	sync.Mutex
+	entries map[string]*memoryEntry    // path -> entry
+	byHash  map[string]map[string]bool // md5 hash -> set of paths
+
+	catalog       map[string]*CatalogEntry   // path -> unseen catalog entry
+	seen          map[string]*CatalogEntry   // path -> catalog entry already seen
+	catalogByHash map[string]map[string]bool // md5 hash -> set of catalog paths
+}
+
+func NewMemoryCache() *MemoryCache {
+	db := &MemoryCache{
+		entries: make(map[string]*memoryEntry),
+		byHash:  make(map[string]map[string]bool),
+	}
+	db.ResetCatalog()
+	return db
+}
+
+func (db *MemoryCache) Get(path string) (info *os.FileInfo, hashHex string, synced int64, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if entry, present := db.entries[path]; present {
+		info = new(os.FileInfo)
+		*info = entry.info
+		hashHex = entry.hashHex
+		synced = entry.synced
+	}
+	return
+}
+
+func (db *MemoryCache) FindByMd5(hashHex string, size int64, preferred string) (path string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	// the cache first, then anything the server scan found
+	paths := db.byHash[hashHex]
+	if paths[preferred] && db.entries[preferred].info.Size == size {
+		return preferred, nil
+	}
+	for path = range paths {
+		if db.entries[path].info.Size == size {
+			return
+		}
+	}
+	for path = range db.catalogByHash[hashHex] {
+		elt := db.catalog[path]
+		if elt == nil {
+			elt = db.seen[path]
+		}
+		if elt.Size == size {
+			return
+		}
+	}
+	return "", nil
+}
+
+func (db *MemoryCache) Put(path, hashHex string, info *os.FileInfo, synced int64) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.remove(path)
+	entry := &memoryEntry{hashHex: hashHex, info: *info, synced: synced}
+	entry.info.Name = path
+	db.entries[path] = entry
+	if db.byHash[hashHex] == nil {
+		db.byHash[hashHex] = make(map[string]bool)
+	}
+	db.byHash[hashHex][path] = true
+	return nil
+}
+
+func (db *MemoryCache) GetChecksum(path, algorithm string) (hashHex string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if entry, present := db.entries[path]; present {
+		hashHex = entry.checksums[algorithm]
+	}
+	return
+}
+
+func (db *MemoryCache) PutChecksum(path, algorithm, hashHex string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if entry, present := db.entries[path]; present {
+		if entry.checksums == nil {
+			entry.checksums = make(map[string]string)
+		}
+		entry.checksums[algorithm] = hashHex
+	}
+	return nil
+}
+
+func (db *MemoryCache) GetETag(path string) (etag string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if entry, present := db.entries[path]; present {
+		etag = entry.etag
+	}
+	return
+}
+
+func (db *MemoryCache) PutETag(path, etag string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if entry, present := db.entries[path]; present {
+		entry.etag = etag
+	}
+	return nil
+}
+
+func (db *MemoryCache) PutStoredSize(path string, size int64) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if entry, present := db.entries[path]; present {
+		entry.stored = size
+	}
+	return nil
+}
+
+func (db *MemoryCache) MarkLinked(path string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if entry, present := db.entries[path]; present {
+		entry.linked = true
+	}
+	return nil
+}
+
+func (db *MemoryCache) Delete(path string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.remove(path)
+	return nil
+}
+
+func (db *MemoryCache) DeleteAll(paths []string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	for _, path := range paths {
+		db.remove(path)
+	}
+	return nil
+}
+
+// the caller must hold the lock
+func (db *MemoryCache) remove(path string) {
+	entry, present := db.entries[path]
+	if !present {
+		return
+	}
+	db.entries[path] = nil, false
+	if paths := db.byHash[entry.hashHex]; paths != nil {
+		paths[path] = false, false
+		if len(paths) == 0 {
+			db.byHash[entry.hashHex] = nil, false
+		}
+	}
+}
+
+func (db *MemoryCache) Reset() os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.entries = make(map[string]*memoryEntry)
+	db.byHash = make(map[string]map[string]bool)
+	return nil
+}
+
+func (db *MemoryCache) Scan(prefix string, fn func(hashHex string, info *os.FileInfo, synced int64)) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if prefix != "" {
+		prefix += "/"
+	}
+	for path, entry := range db.entries {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		info := new(os.FileInfo)
+		*info = entry.info
+		fn(entry.hashHex, info, entry.synced)
+	}
+	return nil
+}
+
+// batching, flushing, and closing are no-ops for an in-memory cache
+func (db *MemoryCache) BeginBatch() os.Error { return nil }
+func (db *MemoryCache) EndBatch() os.Error   { return nil }
+func (db *MemoryCache) Flush() os.Error      { return nil }
+func (db *MemoryCache) Close() os.Error      { return nil }
+
+func (db *MemoryCache) ResetCatalog() os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.catalog = make(map[string]*CatalogEntry)
+	db.catalogByHash = make(map[string]map[string]bool)
+	db.seen = make(map[string]*CatalogEntry)
+	return nil
+}
+
+func (db *MemoryCache) PutCatalog(entry *CatalogEntry) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.putCatalog(entry)
+	return nil
+}
+
+// the caller must hold the lock
+func (db *MemoryCache) putCatalog(entry *CatalogEntry) {
+	old := db.catalog[entry.Path]
+	if old == nil {
+		old = db.seen[entry.Path]
+	}
+	if old != nil {
+		db.catalogByHash[old.HashHex][old.Path] = false, false
+	}
+	elt := new(CatalogEntry)
+	*elt = *entry
+	db.catalog[elt.Path] = elt
+	db.seen[elt.Path] = nil, false
+	if db.catalogByHash[elt.HashHex] == nil {
+		db.catalogByHash[elt.HashHex] = make(map[string]bool)
+	}
+	db.catalogByHash[elt.HashHex][elt.Path] = true
+}
+
+func (db *MemoryCache) MergeCache(prefix string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if prefix != "" {
+		prefix += "/"
+	}
+	for path := range db.entries {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if _, present := db.catalog[path]; present {
+			continue
+		}
+		if _, present := db.seen[path]; present {
+			continue
+		}
+		db.putCatalog(&CatalogEntry{Path: path})
+	}
+	return nil
+}
+
+func (db *MemoryCache) AuditCache(prefix string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if prefix != "" {
+		prefix += "/"
+	}
+	for path, entry := range db.entries {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if db.stale(path, entry) {
+			db.remove(path)
+		}
+	}
+	return nil
+}
+
+func (db *MemoryCache) StaleEntries(prefix string) (paths []string, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if prefix != "" {
+		prefix += "/"
+	}
+	for path, entry := range db.entries {
+		if strings.HasPrefix(path, prefix) && db.stale(path, entry) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return
+}
+
+// does a cache entry contradict the server scan?
+// the caller must hold the lock
+func (db *MemoryCache) stale(path string, entry *memoryEntry) bool {
+	elt := db.catalog[path]
+	if elt == nil {
+		elt = db.seen[path]
+	}
+	return elt == nil || elt.HashHex != entry.hashHex && (entry.etag == "" || elt.HashHex != entry.etag) ||
+		elt.Size != entry.info.Size && !entry.linked && (entry.stored == 0 || elt.Size != entry.stored)
+}
+
+func (db *MemoryCache) GetCatalog(path string) (entry *CatalogEntry, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if elt, present := db.catalog[path]; present {
+		entry = new(CatalogEntry)
+		*entry = *elt
+	}
+	return
+}
+
+func (db *MemoryCache) MarkSeen(path string) os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	if elt, present := db.catalog[path]; present {
+		db.catalog[path] = nil, false
+		db.seen[path] = elt
+	}
+	return nil
+}
+
+func (db *MemoryCache) ClearSeen() os.Error {
+	db.Lock()
+	defer db.Unlock()
+
+	for path, elt := range db.seen {
+		db.catalog[path] = elt
+	}
+	db.seen = make(map[string]*CatalogEntry)
+	return nil
+}
+
+// nothing survives the process, so there is never a run to resume
+func (db *MemoryCache) GetProgress(name string) (string, os.Error) { return "", nil }
+func (db *MemoryCache) SetProgress(name, value string) os.Error    { return nil }
+func (db *MemoryCache) MarkDone(path string) os.Error              { return nil }
+func (db *MemoryCache) IsDone(path string) (bool, os.Error)        { return false, nil }
+func (db *MemoryCache) ResetProgress() os.Error                    { return nil }
+
+func (db *MemoryCache) Unseen(after string, limit int) (entries []*CatalogEntry, err os.Error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var paths []string
+	for path := range db.catalog {
+		if path > after {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	if len(paths) > limit {
+		paths = paths[:limit]
+	}
+	for _, path := range paths {
+		entry := new(CatalogEntry)
+		*entry = *db.catalog[path]
+		entries = append(entries, entry)
+	}
+	return
+}
@@ -0,0 +1,538 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Multipart upload maintenance, and uploads and copies of large objects
+
+package propolis
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"http"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"url"
+	"xml"
+)
+
+// S3 copies objects of up to 5 GB in a single request; bigger ones
+// have to be copied a part at a time
+const max_copy_size = 5 * 1024 * 1024 * 1024
+
+// the size of each part of a multipart copy. S3 allows 10,000 parts,
+// so this covers its 5 TB object size limit
+const copy_part_size = 1024 * 1024 * 1024
+
+// uploads bigger than this are sent in parts, several at a time
+const multipart_upload_size = 64 * 1024 * 1024
+
+// the smallest part of a multipart upload. Bigger files use bigger
+// parts to stay within 10,000 of them
+const upload_part_size = 16 * 1024 * 1024
+const max_parts = 10000
+
+// parts of one upload sent at once if the config does not say
+const default_multipart_concurrency = 4
+
+// times to try sending one part before giving up on the upload
+const part_attempts = 3
+
+// results from multipart upload list requests
+type ListMultipartUploadsResult struct {
+	Bucket             string
+	KeyMarker          string
+	UploadIdMarker     string
+	NextKeyMarker      string
+	NextUploadIdMarker string
+	IsTruncated        bool
+	Upload             []Upload
+}
+
+type Upload struct {
+	Key       string
+	UploadId  string
+	Initiated string
+}
+
+// results from part list requests
+type ListPartsResult struct {
+	IsTruncated          bool
+	NextPartNumberMarker int
+	Part                 []Part
+}
+
+type Part struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// results from starting a multipart upload
+type InitiateMultipartUploadResult struct {
+	UploadId string
+}
+
+// results from copying one part
+type CopyPartResult struct {
+	ETag string
+}
+
+// results from finishing a multipart upload
+type CompleteMultipartUploadResult struct {
+	ETag string
+}
+
+// the url for a key, with a query string
+func (p *Propolis) keyUrl(key string, query url.Values) (u *url.URL) {
+	u = new(url.URL)
+	*u = *p.Url
+	u.Path = p.keyPath(key)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return
+}
+
+// issue a GET request and parse the xml response into result
+func (p *Propolis) getXml(u *url.URL, result interface{}) (err os.Error) {
+	var resp *http.Response
+	if resp, err = p.SendRequest("GET", false, "", u, nil, "", nil, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return xml.Unmarshal(resp.Body, result)
+}
+
+// List the multipart uploads in progress under the bucket root,
+// continuing from the given markers.
+func (p *Propolis) ListMultipartUploadsRequest(keymarker, uploadidmarker string) (result *ListMultipartUploadsResult, err os.Error) {
+	query := make(url.Values)
+	if p.BucketRoot != "" {
+		query.Add("prefix", p.BucketRoot+"/")
+	}
+	if keymarker != "" {
+		query.Add("key-marker", keymarker)
+		query.Add("upload-id-marker", uploadidmarker)
+	}
+	u := p.keyUrl("", query)
+
+	// uploads is a flag with no value
+	if u.RawQuery != "" {
+		u.RawQuery = "uploads&" + u.RawQuery
+	} else {
+		u.RawQuery = "uploads"
+	}
+
+	result = new(ListMultipartUploadsResult)
+	if err = p.getXml(u, result); err != nil {
+		result = nil
+	}
+	return
+}
+
+// List the parts uploaded so far for a multipart upload.
+func (p *Propolis) ListPartsRequest(key, uploadid string, marker int) (result *ListPartsResult, err os.Error) {
+	query := make(url.Values)
+	query.Add("uploadId", uploadid)
+	if marker > 0 {
+		query.Add("part-number-marker", strconv.Itoa(marker))
+	}
+	result = new(ListPartsResult)
+	if err = p.getXml(p.keyUrl(key, query), result); err != nil {
+		result = nil
+	}
+	return
+}
+
+// Abort a multipart upload, discarding any parts already uploaded.
+func (p *Propolis) AbortMultipartRequest(key, uploadid string) (err os.Error) {
+	query := make(url.Values)
+	query.Add("uploadId", uploadid)
+	_, err = p.SendRequest("DELETE", false, "", p.keyUrl(key, query), nil, "", nil, nil)
+	return
+}
+
+// total size of the parts uploaded so far for a multipart upload
+func (p *Propolis) uploadSize(key, uploadid string) (size int64, err os.Error) {
+	marker := 0
+	for {
+		var result *ListPartsResult
+		if result, err = p.ListPartsRequest(key, uploadid, marker); err != nil {
+			return
+		}
+		for _, part := range result.Part {
+			size += part.Size
+		}
+		if !result.IsTruncated {
+			return
+		}
+		marker = result.NextPartNumberMarker
+	}
+	return
+}
+
+// Abort every multipart upload under the bucket root that was started
+// before p.MultipartCutoff. Abandoned uploads are invisible in normal
+// listings, but their parts are still billed as storage.
+func (p *Propolis) AbortOldUploads() (err os.Error) {
+	keymarker, uploadidmarker := "", ""
+	for {
+		var result *ListMultipartUploadsResult
+		if result, err = p.ListMultipartUploadsRequest(keymarker, uploadidmarker); err != nil {
+			return
+		}
+		for _, upload := range result.Upload {
+			when, er := time.Parse(list_time_format, upload.Initiated)
+			if er != nil || when.Seconds()*1e9 >= p.MultipartCutoff {
+				continue
+			}
+
+			var size int64
+			if size, err = p.uploadSize(upload.Key, upload.UploadId); err != nil {
+				return
+			}
+			p.Log.Infof("Aborting incomplete upload of [%s] started %s (%s)\n",
+				upload.Key, upload.Initiated, formatBytes(size))
+			if !p.Practice {
+				if err = p.AbortMultipartRequest(upload.Key, upload.UploadId); err != nil {
+					return
+				}
+			}
+			p.recordAborted(size)
+		}
+		if !result.IsTruncated {
+			return
+		}
+		keymarker, uploadidmarker = result.NextKeyMarker, result.NextUploadIdMarker
+	}
+	return
+}
+
+// Copy the object at src (a full bucket + key path) of size bytes to
+// key in parts, for objects too big to copy in one request. A
+// multipart copy does not take the metadata from the source, so info
+// and extra supply it as they would for an upload. If ifmatch is not
+// "", every part is copied only if the source still has that ETag. An
+// upload that fails partway is aborted. The ETag of the new object is
+// returned, without quotes.
+func (p *Propolis) MultipartCopyRequest(src, key string, size int64, info *os.FileInfo, extra http.Header, ifmatch string) (etag string, err os.Error) {
+	p.Log.Debugf("Copying [%s] in %d parts\n", key, (size+copy_part_size-1)/copy_part_size)
+
+	var uploadid string
+	if uploadid, err = p.initiateMultipartRequest(key, info, extra); err != nil {
+		return
+	}
+
+	var etags []string
+	for first := int64(0); first < size; first += copy_part_size {
+		last := first + copy_part_size - 1
+		if last >= size {
+			last = size - 1
+		}
+		var part string
+		if part, err = p.copyPartRequest(src, key, uploadid, len(etags)+1, first, last, ifmatch); err != nil {
+			break
+		}
+		etags = append(etags, part)
+	}
+	if err == nil {
+		etag, err = p.completeMultipartRequest(key, uploadid, etags)
+	}
+	if err != nil {
+		if er := p.AbortMultipartRequest(key, uploadid); er != nil {
+			p.Log.Warnf("Unable to abort the copy of [%s]: %v\n", key, er)
+		}
+	}
+	return
+}
+
+// Start a multipart upload to key and get its upload id. The metadata
+// for the finished object is given here, as it would be for a PUT.
+func (p *Propolis) initiateMultipartRequest(key string, info *os.FileInfo, extra http.Header) (uploadid string, err os.Error) {
+	// uploads is a flag with no value
+	u := p.keyUrl(key, nil)
+	u.RawQuery = "uploads"
+	var resp *http.Response
+	if resp, err = p.SendRequest("POST", p.ReducedRedundancy, "", u, nil, "", info, extra); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	result := new(InitiateMultipartUploadResult)
+	if err = xml.Unmarshal(resp.Body, result); err != nil {
+		return
+	}
+	return result.UploadId, nil
+}
+
+// Should elt be uploaded in parts? The finished object's ETag is not
+// its md5 hash, so the hash must be known to be stored as metadata.
+// A second checksum is only checked on single uploads.
+func (p *Propolis) uploadInParts(elt *File) bool {
+	return elt.UploadSize > multipart_upload_size && elt.LocalHashHex != "" &&
+		(p.Hasher == nil || elt.LocalChecksumHex == "")
+}
+
+// the part size for an upload of size bytes
+func uploadPartSize(size int64) (partsize int64) {
+	partsize = upload_part_size
+	for (size+partsize-1)/partsize > max_parts {
+		partsize *= 2
+	}
+	return
+}
+
+// one part of a multipart upload, held in memory so it can be resent
+type uploadPart struct {
+	number int
+	data   []byte
+}
+
+// Upload elt.Contents in parts, up to p.MultipartConcurrency of them at
+// once, for files too big to make good use of a single connection.
+// Each part that fails is sent again on its own. The contents are
+// hashed as they are read, and the upload is abandoned with
+// errFileChanged if they no longer match elt.LocalHashHex. An upload
+// that fails is aborted, and elt.Contents is always closed.
+func (p *Propolis) MultipartUploadRequest(elt *File) (err os.Error) {
+	body := p.Progress.Reader(elt.Contents, elt.UploadSize)
+	defer body.Close()
+
+	info := new(os.FileInfo)
+	*info = *elt.LocalInfo
+	info.Size = elt.UploadSize
+	extra := p.FileHeaders(elt)
+	extra.Set(md5_meta_header, elt.LocalHashHex)
+
+	partsize := uploadPartSize(elt.UploadSize)
+	count := int((elt.UploadSize + partsize - 1) / partsize)
+	p.Log.Debugf("Uploading [%s] in %d parts\n", elt.ServerPath, count)
+
+	var uploadid string
+	if uploadid, err = p.initiateMultipartRequest(elt.ServerPath, info, extra); err != nil {
+		return
+	}
+
+	// the first failure stops the rest
+	etags := make([]string, count)
+	var lock sync.Mutex
+	var failure os.Error
+	failed := func() os.Error {
+		lock.Lock()
+		defer lock.Unlock()
+		return failure
+	}
+
+	todo := make(chan *uploadPart)
+	done := make(chan bool)
+	for i := 0; i < p.MultipartConcurrency; i++ {
+		go func() {
+			for part := range todo {
+				if failed() != nil {
+					continue
+				}
+				etag, er := p.sendPart(elt.ServerPath, uploadid, part)
+				lock.Lock()
+				if er != nil && failure == nil {
+					failure = er
+				}
+				etags[part.number-1] = etag
+				lock.Unlock()
+			}
+			done <- true
+		}()
+	}
+
+	// read the parts in order and hand them out
+	hash := md5Hasher.New()
+	for i := 0; i < count && failed() == nil; i++ {
+		size := partsize
+		if remaining := elt.UploadSize - int64(i)*partsize; remaining < size {
+			size = remaining
+		}
+		part := &uploadPart{i + 1, make([]byte, size)}
+		if _, err = io.ReadFull(body, part.data); err != nil {
+			if err == io.ErrUnexpectedEOF || err == os.EOF {
+				err = errFileChanged
+			}
+			break
+		}
+		hash.Write(part.data)
+		todo <- part
+	}
+	close(todo)
+	for i := 0; i < p.MultipartConcurrency; i++ {
+		<-done
+	}
+
+	if err == nil {
+		err = failure
+	}
+	if err == nil && hex.EncodeToString(hash.Sum()) != elt.LocalHashHex {
+		err = errFileChanged
+	}
+	if err == nil {
+		elt.ServerETag, err = p.completeMultipartRequest(elt.ServerPath, uploadid, etags)
+	}
+	if err != nil {
+		if er := p.AbortMultipartRequest(elt.ServerPath, uploadid); er != nil {
+			p.Log.Warnf("Unable to abort the upload of [%s]: %v\n", elt.ServerPath, er)
+		}
+	}
+	return
+}
+
+// send one part of a multipart upload, trying again if it fails
+func (p *Propolis) sendPart(key, uploadid string, part *uploadPart) (etag string, err os.Error) {
+	query := make(url.Values)
+	query.Add("partNumber", strconv.Itoa(part.number))
+	query.Add("uploadId", uploadid)
+	u := p.keyUrl(key, query)
+
+	hash := md5Hasher.New()
+	hash.Write(part.data)
+	sum := base64.StdEncoding.EncodeToString(hash.Sum())
+
+	for attempt := 1; attempt <= part_attempts; attempt++ {
+		body := new(document)
+		body.Write(part.data)
+		var resp *http.Response
+		if resp, err = p.SendRequest("PUT", false, "", u, body, sum, nil, nil); err == nil {
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			etag = resp.Header.Get("Etag")
+			return
+		}
+		if attempt < part_attempts {
+			p.Log.Warnf("Sending part %d of [%s] again: %v\n", part.number, key, err)
+		}
+	}
+	return
+}
+
+// copy bytes first through last of src as one part of a multipart upload
+func (p *Propolis) copyPartRequest(src, key, uploadid string, part int, first, last int64, ifmatch string) (etag string, err os.Error) {
+	query := make(url.Values)
+	query.Add("partNumber", strconv.Itoa(part))
+	query.Add("uploadId", uploadid)
+
+	// the copy source is given directly, since SendRequest would
+	// add a metadata directive that parts do not take
+	source := new(url.URL)
+	source.Path = src
+	extra := make(http.Header)
+	extra.Set("X-Amz-Copy-Source", source.String())
+	extra.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	if ifmatch != "" {
+		extra.Set("X-Amz-Copy-Source-If-Match", "\""+ifmatch+"\"")
+	}
+
+	var resp *http.Response
+	if resp, err = p.SendRequest("PUT", false, "", p.keyUrl(key, query), nil, "", nil, extra); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	result := new(CopyPartResult)
+	if err = xml.Unmarshal(resp.Body, result); err != nil {
+		return
+	}
+	return result.ETag, nil
+}
+
+// Finish a multipart upload from the ETags of its parts, in order, and
+// get the ETag of the whole object.
+func (p *Propolis) completeMultipartRequest(key, uploadid string, etags []string) (etag string, err os.Error) {
+	body := newDocument("<CompleteMultipartUpload>")
+	for i, etag := range etags {
+		fmt.Fprintf(body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etag)
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+
+	query := make(url.Values)
+	query.Add("uploadId", uploadid)
+	extra := make(http.Header)
+	extra.Set("Content-Type", "application/xml")
+	var resp *http.Response
+	if resp, err = p.SendRequest("POST", false, "", p.keyUrl(key, query), body, "", nil, extra); err != nil {
+		return
+	}
+
+	// S3 can report a failure after it has sent a 200 status, in which
+	// case the body is an error document
+	defer resp.Body.Close()
+	var reply []byte
+	if reply, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if strings.Contains(string(reply), "<Error>") {
+		resp.Body = ioutil.NopCloser(bytes.NewBuffer(reply))
+		return "", ParseError(resp)
+	}
+	result := new(CompleteMultipartUploadResult)
+	if err = xml.Unmarshal(bytes.NewBuffer(reply), result); err != nil {
+		return
+	}
+	etag = result.ETag
+	if len(etag) > 2 && etag[0] == '"' {
+		etag = etag[1 : len(etag)-1]
+	}
+	return
+}
+
+// Copy an object as it is, metadata and all, to key when it is too big
+// to copy in one request. Its metadata and exact size come from a HEAD
+// request first. done is false if it turns out to be small enough for
+// a normal copy.
+func (p *Propolis) copyLargeObject(elt *File, key string) (done bool, err os.Error) {
+	var resp *http.Response
+	if resp, err = p.SendRequest("HEAD", false, "", elt.Url, nil, "", nil, nil); err != nil {
+		return
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	if resp.ContentLength <= max_copy_size {
+		return false, nil
+	}
+
+	// carry over the headers a copy would keep
+	extra := make(http.Header)
+	for name, values := range resp.Header {
+		switch {
+		case strings.HasPrefix(name, "X-Amz-Meta-"),
+			name == "Content-Type", name == "Content-Encoding", name == "Content-Disposition",
+			name == "Content-Language", name == "Cache-Control", name == "Expires":
+			extra[name] = values
+		}
+	}
+	etag := resp.Header.Get("Etag")
+	if len(etag) > 2 {
+		etag = etag[1 : len(etag)-1]
+	}
+	_, err = p.MultipartCopyRequest(elt.FullServerPath, key, resp.ContentLength, nil, extra, etag)
+	return true, err
+}
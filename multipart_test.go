@@ -0,0 +1,167 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of uploads and copies in parts
+
+package propolis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A file too big for a single upload is sent in parts, and a part that
+// fails once is sent again without starting the upload over.
+func TestMultipartUpload(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+
+	// 16 MB parts, the last one short
+	contents := make([]byte, multipart_upload_size+1024*1024)
+	for i := range contents {
+		contents[i] = byte(i * 7 / 5)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "big"), contents, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	sum := md5Hex(contents)
+
+	failed := false
+	s.fail = func(kind, key string) bool {
+		if kind == "PART" && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}
+	c := testConfig(root)
+	c.MultipartConcurrency = 3
+	p := newFakePropolis(t, c, s)
+	runSync(t, p, true)
+
+	parts := int((int64(len(contents)) + upload_part_size - 1) / upload_part_size)
+	if n := s.count("PUT", "big"); n != 0 {
+		t.Errorf("big was sent in a single upload %d times", n)
+	}
+	if n := s.count("PART", "big"); n != parts+1 {
+		t.Errorf("%d parts were sent, expected %d and one retry", n, parts)
+	}
+	if n := s.count("COMPLETE", "big"); n != 1 {
+		t.Errorf("the upload was finished %d times, expected once", n)
+	}
+
+	obj := s.get("big")
+	switch {
+	case obj == nil:
+		t.Fatalf("big was not uploaded")
+	case md5Hex(obj.data) != sum:
+		t.Errorf("big has the wrong contents on the server")
+	case !strings.HasSuffix(obj.etag, "-"+strconv.Itoa(parts)):
+		t.Errorf("big has ETag %s, expected one for %d parts", obj.etag, parts)
+	case obj.header.Get(md5_meta_header) != sum:
+		t.Errorf("big was stored with md5 %q, expected %s", obj.header.Get(md5_meta_header), sum)
+	}
+
+	// the cache keeps the md5 hash, and the ETag beside it
+	if _, hashHex, _, err := p.Db.Get("big"); err != nil || hashHex != sum {
+		t.Errorf("cache has hash %s, %v; expected %s", hashHex, err, sum)
+	}
+	if etag, err := p.Db.GetETag("big"); err != nil || etag != obj.etag {
+		t.Errorf("cache has ETag %s, %v; expected %s", etag, err, obj.etag)
+	}
+}
+
+// Copies of objects over 5 GB are made a part at a time, and the md5
+// hash of the copy is kept apart from its ETag. Smaller copies are made
+// in one request. The objects are made up, with sizes but no contents.
+func TestLargeCopy(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+	p := newFakePropolis(t, testConfig(root), s)
+
+	for _, test := range []struct {
+		size  int64
+		parts int // 0 for a single copy
+	}{
+		{max_copy_size, 0},
+		{6 * 1024 * 1024 * 1024, 6},
+		{6*1024*1024*1024 + 1, 7},
+	} {
+		sum := md5Hex([]byte(strconv.Itoa64(test.size)))
+		s.put("source", "", nil)
+		s.Lock()
+		s.objects["source"].size = test.size
+		s.objects["source"].etag = sum
+		s.objects["source"].data = nil
+		s.Unlock()
+		s.clearRequests()
+
+		elt := p.NewFile("copy", true, true)
+		elt.LocalInfo = testInfo(test.size)
+		elt.LocalInfo.Name = "copy"
+		elt.UploadSize = test.size
+		elt.LocalHashHex = sum
+		if err := p.CopyRequest(elt, "/"+p.Bucket+"/source"); err != nil {
+			t.Errorf("size %d: CopyRequest: %v", test.size, err)
+			continue
+		}
+
+		obj := s.get("copy")
+		if obj == nil || obj.size != test.size {
+			t.Errorf("size %d: the copy is missing or the wrong size", test.size)
+			continue
+		}
+		if test.parts == 0 {
+			if n := s.count("COPY", "copy"); n != 1 || obj.etag != sum || elt.ServerETag != "" {
+				t.Errorf("size %d: %d single copies made, ETag %s, ServerETag %q", test.size, n, obj.etag, elt.ServerETag)
+			}
+			continue
+		}
+
+		if n := s.count("COPYPART", "copy"); n != test.parts {
+			t.Errorf("size %d: %d parts copied, expected %d", test.size, n, test.parts)
+		}
+		if !strings.HasSuffix(obj.etag, "-"+strconv.Itoa(test.parts)) || elt.ServerETag != obj.etag {
+			t.Errorf("size %d: the copy has ETag %s and ServerETag %s", test.size, obj.etag, elt.ServerETag)
+		}
+		if got := obj.header.Get(md5_meta_header); got != sum {
+			t.Errorf("size %d: the copy was stored with md5 %q, expected %s", test.size, got, sum)
+		}
+
+		// the cache records the md5 hash, not the ETag, as the contents
+		if err := p.SetFileInfo(elt, true); err != nil {
+			t.Fatalf("SetFileInfo: %v", err)
+		}
+		if _, hashHex, _, err := p.Db.Get("copy"); err != nil || hashHex != sum {
+			t.Errorf("size %d: cache has hash %s, %v; expected %s", test.size, hashHex, err, sum)
+		}
+		if etag, err := p.Db.GetETag("copy"); err != nil || etag != obj.etag {
+			t.Errorf("size %d: cache has ETag %s, %v; expected %s", test.size, etag, err, obj.etag)
+		}
+	}
+}
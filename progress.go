@@ -0,0 +1,197 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Transfer progress reporting
+
+package propolis
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the progress line is redrawn on a terminal (ns)
+const progress_interval = 1e9
+
+// Aggregate transfer progress across all concurrent workers. On a
+// terminal a single status line is redrawn in place; otherwise one
+// summary line is printed when the sync finishes. All methods are
+// safe to call on a nil *Progress, which does nothing.
+type Progress struct {
+	sync.Mutex
+	out      io.Writer
+	tty      bool  // redraw the status line in place
+	start    int64 // when the sync started (ns)
+	files    int   // transfers started
+	finished int   // transfers completed
+	total    int64 // bytes in all transfers started so far
+	done     int64 // bytes transferred so far
+	shown    bool  // a status line is on the screen
+	ticker   *time.Ticker
+}
+
+func NewProgress(out io.Writer, tty bool) *Progress {
+	return &Progress{out: out, tty: tty}
+}
+
+// start the clock, and the redraw timer on a terminal
+func (pr *Progress) Start() {
+	if pr == nil {
+		return
+	}
+	pr.start = time.Nanoseconds()
+	if !pr.tty {
+		return
+	}
+	pr.ticker = time.NewTicker(progress_interval)
+	go func(c <-chan int64) {
+		for _ = range c {
+			outputLock.Lock()
+			pr.draw()
+			outputLock.Unlock()
+		}
+	}(pr.ticker.C)
+}
+
+// stop redrawing and leave a final summary line
+func (pr *Progress) Stop() {
+	if pr == nil {
+		return
+	}
+	if pr.ticker != nil {
+		pr.ticker.Stop()
+	}
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	pr.draw()
+	if !pr.tty || pr.shown {
+		fmt.Fprintln(pr.out)
+	}
+	pr.shown = false
+}
+
+// a transfer of size bytes is starting
+func (pr *Progress) begin(size int64) {
+	if pr == nil {
+		return
+	}
+	pr.Lock()
+	defer pr.Unlock()
+	pr.files++
+	pr.total += size
+}
+
+// a transfer is finished
+func (pr *Progress) end() {
+	if pr == nil {
+		return
+	}
+	pr.Lock()
+	defer pr.Unlock()
+	pr.finished++
+}
+
+// n more bytes have been transferred
+func (pr *Progress) add(n int64) {
+	if pr == nil {
+		return
+	}
+	pr.Lock()
+	defer pr.Unlock()
+	pr.done += n
+}
+
+// erase the status line so other output can be printed.
+// the caller must hold outputLock
+func (pr *Progress) clear() {
+	if pr == nil || !pr.shown {
+		return
+	}
+	fmt.Fprint(pr.out, "\r\033[K")
+	pr.shown = false
+}
+
+// print the current status line. the caller must hold outputLock
+func (pr *Progress) draw() {
+	pr.Lock()
+	files, finished, total, done := pr.files, pr.finished, pr.total, pr.done
+	pr.Unlock()
+
+	elapsed := time.Nanoseconds() - pr.start
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(done) / (float64(elapsed) / 1e9)
+	}
+	line := fmt.Sprintf("%s of %s, %d/%d files, %s/s",
+		formatBytes(done), formatBytes(total), finished, files, formatBytes(int64(rate)))
+
+	// the estimate only covers transfers that have started
+	if rate > 0 && total > done {
+		eta := int64(float64(total-done) / rate)
+		line += fmt.Sprintf(", ETA %d:%02d", eta/60, eta%60)
+	}
+	if pr.tty {
+		fmt.Fprint(pr.out, "\r\033[K"+line)
+		pr.shown = true
+	} else {
+		fmt.Fprint(pr.out, line)
+	}
+}
+
+// wrap an upload body so the bytes read from it are counted
+func (pr *Progress) Reader(body io.ReadCloser, size int64) io.ReadCloser {
+	if pr == nil {
+		return body
+	}
+	pr.begin(size)
+	return &progressReader{body, pr}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	pr *Progress
+}
+
+func (r *progressReader) Read(buf []byte) (n int, err os.Error) {
+	n, err = r.ReadCloser.Read(buf)
+	r.pr.add(int64(n))
+	return
+}
+
+func (r *progressReader) Close() os.Error {
+	r.pr.end()
+	return r.ReadCloser.Close()
+}
+
+// format a byte count for humans
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,1108 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Synchronizer state, configuration, and the top-level sync
+
+package propolis
+
+import (
+	"bufio"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"url"
+)
+
+// places credentials are looked for, in the order they are tried
+const (
+	AccessKeyIdVariable     = "AWSACCESSKEYID"
+	SecretAccessKeyVariable = "AWSSECRETACCESSKEY"
+	SessionTokenVariable    = "AWSSESSIONTOKEN"
+	CredentialsFile         = ".aws/credentials" // relative to $HOME
+	PasswordFile            = "/etc/passwd-amazon-s3"
+)
+
+const DefaultCacheLocation = "/var/cache/propolis"
+
+// The sqlite cache file for a bucket ("" means DefaultCacheLocation).
+func CacheFile(location, bucket string) string {
+	if location == "" {
+		location = DefaultCacheLocation
+	}
+	return path.Join(location, bucket+".sqlite")
+}
+
+// the most keys S3 will return from a single list request
+const MaxListPageSize = 1000
+
+const Version = "0.1"
+
+// sent with every request, unless configured otherwise
+const DefaultUserAgent = "propolis/" + Version
+
+// bytes read at a time when hashing and copying files, unless
+// configured otherwise
+const DefaultBufferSize = 32 * 1024
+
+const mime_types_file = "/etc/mime.types"
+
+// number of catalog entries read at a time when looking for files
+// that are only on the server
+const catalog_group_size = 1000
+
+// configuration and state for an active propolis instance
+type Propolis struct {
+	Bucket            string   // bucket name
+	Url               *url.URL // s3 bucket access url
+	PathStyle         bool     // the bucket is named in the url path instead of the host
+	Secure            bool     // use https
+	ReducedRedundancy bool     // use cheaper storage
+	Key               string   // Amazon AWS access key
+	Secret            string   // Amazon AWS secret key
+	Token             string   // Amazon AWS session token (temporary credentials only)
+	Expires           int64    // when instance credentials expire (ns), 0 for never
+	Anonymous         bool     // send unsigned requests (public buckets, pull only)
+	credLock          sync.Mutex
+
+	ClockOffset int64 // ns to add to the local clock to match the server
+	clockLock   sync.Mutex
+
+	Client *http.Client // shared client for all requests
+
+	RequestPayer bool      // agree to pay for requests to a requester-pays bucket
+	chargedOnce  sync.Once // warn once if the bucket is not charging us
+
+	BucketRoot string // s3 bucket root directory
+	LocalRoot  string // local file system root directory
+	TmpDir     string // directory for partial downloads ("" for next to each file) and spooled uploads ("" for the system default)
+
+	Refresh     bool // download list from s3 to refresh cache
+	Paranoid    bool // always compute md5 hashes
+	NoHash      bool // never hash local files; trust size and modification time
+	Delete      bool // delete files missing from the other side
+	Reset       bool // reset the cache before starting
+	Directories bool // track directories on s3 with zero-length files
+	Xattrs      bool // store and restore extended attributes
+	HardLinks   bool // store extra paths to an inode as links to the first
+	Follow      bool // store the files that symlinks point to instead of the links
+	Practice    bool // do not actually make any changes
+	Watch       bool // watch the file system for changes after the initial scan
+	StatusOnly  bool // report out-of-sync files and quit without changing anything
+	Delay       int  // number of seconds to wait before syncing a file
+	Concurrent  int  // max number of concurrent server requests
+	Timeout     int  // seconds before a stalled server request fails (0 for never)
+	PageSize    int  // keys to request per bucket list call
+	ListV1      bool // use the original bucket list API instead of ListObjectsV2
+	LazyScan    bool // list the bucket one directory at a time instead of all at once
+
+	Hasher Hasher // second checksum kept for file contents (nil for md5 alone)
+
+	PruneEmptyDirs bool // remove local directories left empty by pull-side deletes
+
+	ImmediateDeletes bool // deletes skip the Delay that lets changes settle
+	Resume           bool // record progress, and pick up an interrupted run where it stopped
+	FlushInterval    int  // seconds between cache flushes during a sync (0 for only at the end)
+
+	BufferSize int // bytes to read at a time when hashing and copying files
+
+	CreateBucket bool   // create the bucket if it does not exist
+	Region       string // region for a created bucket ("" for us-east-1)
+
+	UserAgent string // sent with every request
+
+	TrashPrefix string // move deleted files here on the server (and to .propolis-trash locally) instead of deleting them
+	TrashCutoff int64  // purge trash from before this time at startup (ns, 0 for never)
+
+	Bidirectional bool   // sync changes in both directions, using the cache as the common ancestor
+	Conflict      string // how to settle files changed on both sides (see ConflictPolicies)
+
+	UploadConcurrency   int       // max number of concurrent uploads
+	DownloadConcurrency int       // max number of concurrent downloads
+	ListConcurrency     int       // max number of concurrent list and other metadata requests
+	Throttle            *Throttle // lowers concurrency when the server says to slow down
+
+	MultipartConcurrency int // max number of parts of one large upload sent at once
+
+	NormalizeUnicode bool // store file names as NFC keys
+
+	CaseInsensitiveTarget bool // the local file system folds case, so keys differing only in case collide there
+
+	PreserveAtime bool // store access times and restore them on download
+	SpecialFiles  bool // track FIFOs, sockets, and device nodes with zero-length files
+	UserMetadata  bool // store the key=value pairs in name.meta as metadata of name
+
+	ResyncCutoff int64   // check the contents of entries last synced before this time (ns, 0 for never)
+	VerifySample float64 // percent of unchanged files to check the contents of, chosen at random each run
+	VerifyServer bool    // with VerifySample, also check the chosen files' server copies against the cache
+
+	CleanupMultipart bool  // abort old incomplete multipart uploads at startup
+	MultipartCutoff  int64 // abort uploads started before this time (ns)
+
+	PurgeVersions   bool // remove every version of deleted files in versioned buckets
+	PurgeNoncurrent bool // remove old versions of replaced files in versioned buckets
+	Versioned       bool // does the bucket keep old versions?
+
+	RestoreDays int    // restore archived files for this many days (0 means don't)
+	RestoreTier string // retrieval tier: Standard, Bulk, or Expedited
+	WaitRestore bool   // wait for restores to finish instead of skipping
+
+	HeaderRules []HeaderRule // extra headers to set on uploads by file name
+	Gzip        bool         // compress uploads of text files
+	KeepGzip    bool         // leave compressed files compressed on download
+
+	SniffContentType   bool   // guess content types from file contents when the name does not say
+	DefaultContentType string // content type for files of unknown type
+	ACL                string // canned ACL for uploads, or ACLAuto to follow file permissions
+	Public             bool   // with ACLAuto, make world-readable files public-read
+
+	NewerThan int64 // only sync files modified at or after this time (ns, 0 for no limit)
+	OlderThan int64 // only sync files modified at or before this time (ns, 0 for no limit)
+	MinSize   int64 // only sync files at least this many bytes long
+	MaxSize   int64 // only sync files at most this many bytes long (0 for no limit)
+
+	IgnoreHidden bool // leave out files and directories whose names start with a dot
+	MaxDepth     int  // only sync this many directory levels below the roots (0 for no limit)
+
+	Log      *Logger       // where messages go (nil for none)
+	OnAction func(*Action) // called as each action is started (or planned)
+	Manifest io.Writer     // each finished action is written here as a line of json (nil for none)
+	Progress *Progress     // transfer progress display (nil for none)
+
+	OnDownload func(elt *File, done, total int64) // called now and then as a download proceeds, and when it finishes
+
+	Db Storage // cache database connection
+
+	Queue   chan *File       // request queue
+	Links   map[Inode]string // inode -> first server path found for it
+	Visited map[Inode]bool   // directories already walked (for -follow-symlinks)
+
+	push       bool    // direction of the sync in progress
+	report     *Report // results of the sync in progress
+	lock       *Lock   // keeps other instances away from the cache
+	trashStamp string  // names this run's trash directory (-trash-prefix)
+
+	caseClaims map[string]string // folded local path -> key downloaded there
+}
+
+// identifies a file for hard link detection
+type Inode struct {
+	Dev uint64
+	Ino uint64
+}
+
+// Configuration for a new propolis instance. This holds everything
+// that can be set from the command line; see New.
+type Config struct {
+	Bucket     string // bucket name
+	BucketRoot string // s3 bucket root directory
+	LocalRoot  string // local file system root directory (absolute)
+	TmpDir     string // directory for partial downloads ("" for next to each file) and spooled uploads ("" for the system default)
+
+	Key     string // Amazon AWS access key (found automatically if empty)
+	Secret  string // Amazon AWS secret key (found automatically if empty)
+	Token   string // Amazon AWS session token (temporary credentials only)
+	Profile string // profile to use from the AWS credentials file
+
+	Anonymous bool // send unsigned requests, with no credentials (public buckets, pull only)
+
+	Secure            bool   // use https
+	ReducedRedundancy bool   // use cheaper storage
+	Proxy             string // proxy url, overriding the environment
+	CACert            string // PEM file of certificates to trust instead of the system roots
+	Insecure          bool   // do not verify server certificates
+	RequestPayer      bool   // agree to pay for requests to a requester-pays bucket
+
+	CacheLocation   string  // directory holding the sqlite cache
+	CacheBackend    string  // sqlite or memory
+	VacuumThreshold float64 // vacuum the sqlite cache at startup if more than this fraction is unused (0 for never)
+
+	Refresh     bool // download list from s3 to refresh cache
+	Paranoid    bool // always compute md5 hashes
+	NoHash      bool // never hash local files; trust size and modification time
+	Delete      bool // delete files missing from the other side
+	Reset       bool // reset the cache before starting
+	Directories bool // track directories on s3 with zero-length files
+	Xattrs      bool // store and restore extended attributes
+	HardLinks   bool // store extra paths to an inode as links to the first
+	Follow      bool // store the files that symlinks point to instead of the links
+	Practice    bool // do not actually make any changes
+	Watch       bool // watch the file system for changes after the initial scan
+	StatusOnly  bool // report out-of-sync files and quit without changing anything
+	Delay       int  // number of seconds to wait before syncing a file
+	Concurrent  int  // max number of concurrent server requests
+	Timeout     int  // seconds before a stalled server request fails (0 for never)
+	PageSize    int  // keys to request per bucket list call (0 or too many means MaxListPageSize)
+	ListV1      bool // use the original bucket list API instead of ListObjectsV2
+	LazyScan    bool // list the bucket one directory at a time instead of all at once
+
+	Checksum string // second checksum to keep for file contents: sha256, crc32c, crc32, or sha1 ("" or md5 for md5 alone)
+
+	PruneEmptyDirs bool // remove local directories left empty by pull-side deletes
+
+	ImmediateDeletes bool // deletes skip the Delay that lets changes settle
+	Resume           bool // record progress, and pick up an interrupted run where it stopped
+	FlushInterval    int  // seconds between cache flushes during a sync (0 for only at the end)
+
+	BufferSize int // bytes to read at a time when hashing and copying files (0 means DefaultBufferSize)
+
+	CreateBucket bool   // create the bucket if it does not exist
+	Region       string // region for a created bucket ("" for us-east-1)
+
+	UserAgent string // sent with every request ("" means DefaultUserAgent)
+
+	TrashPrefix string // move deleted files here on the server (and to .propolis-trash locally) instead of deleting them
+	TrashCutoff int64  // purge trash from before this time at startup (ns, 0 for never)
+
+	Bidirectional bool   // sync changes in both directions, using the cache as the common ancestor
+	Conflict      string // how to settle files changed on both sides (see ConflictPolicies)
+
+	UploadConcurrency   int // max number of concurrent uploads (0 means Concurrent)
+	DownloadConcurrency int // max number of concurrent downloads (0 means Concurrent)
+	ListConcurrency     int // max number of concurrent list and other metadata requests (0 means Concurrent)
+
+	MultipartConcurrency int // max number of parts of one large upload sent at once (0 means 4)
+
+	NormalizeUnicode bool // store file names as NFC keys
+
+	CaseInsensitiveTarget bool // the local file system folds case, so keys differing only in case collide there
+
+	PreserveAtime bool // store access times and restore them on download
+	SpecialFiles  bool // track FIFOs, sockets, and device nodes with zero-length files
+	UserMetadata  bool // store the key=value pairs in name.meta as metadata of name
+
+	ResyncCutoff int64   // check the contents of entries last synced before this time (ns, 0 for never)
+	VerifySample float64 // percent of unchanged files to check the contents of, chosen at random each run
+	VerifyServer bool    // with VerifySample, also check the chosen files' server copies against the cache
+
+	CleanupMultipart bool  // abort old incomplete multipart uploads at startup
+	MultipartCutoff  int64 // abort uploads started before this time (ns)
+
+	PurgeVersions   bool // remove every version of deleted files in versioned buckets
+	PurgeNoncurrent bool // remove old versions of replaced files in versioned buckets
+
+	RestoreDays int    // restore archived files for this many days (0 means don't)
+	RestoreTier string // retrieval tier: Standard, Bulk, or Expedited
+	WaitRestore bool   // wait for restores to finish instead of skipping
+
+	HeaderRules []HeaderRule // extra headers to set on uploads by file name
+	Gzip        bool         // compress uploads of text files
+	KeepGzip    bool         // leave compressed files compressed on download
+
+	SniffContentType   bool   // guess content types from file contents when the name does not say
+	DefaultContentType string // content type for files of unknown type
+	ACL                string // canned ACL for uploads, or ACLAuto to follow file permissions
+	Public             bool   // with ACLAuto, make world-readable files public-read
+
+	Force bool // start even if another instance holds the cache lock
+
+	NewerThan int64 // only sync files modified at or after this time (ns, 0 for no limit)
+	OlderThan int64 // only sync files modified at or before this time (ns, 0 for no limit)
+	MinSize   int64 // only sync files at least this many bytes long
+	MaxSize   int64 // only sync files at most this many bytes long (0 for no limit)
+
+	IgnoreHidden bool // leave out files and directories whose names start with a dot
+	MaxDepth     int  // only sync this many directory levels below the roots (0 for no limit)
+
+	Log         *Logger       // where messages go (nil for none)
+	OnAction    func(*Action) // called as each action is started (or planned)
+	Manifest    io.Writer     // each finished action is written here as a line of json (nil for none)
+	Progress    io.Writer     // where transfer progress goes (nil for none)
+	ProgressTTY bool          // Progress is a terminal: redraw one line in place
+
+	OnDownload func(elt *File, done, total int64) // called now and then as a download proceeds, and when it finishes
+}
+
+// Create a propolis instance from a configuration. This finds
+// credentials if none were given, opens the cache, and sets up the
+// connection to the server. Call Close when finished with it.
+func New(c *Config) (p *Propolis, err os.Error) {
+	// enforce certain option combinations
+	refresh, watch := c.Refresh, c.Watch
+	if c.Reset || c.CacheBackend == "memory" || c.Bidirectional {
+		refresh = true
+	}
+	if c.Practice || c.StatusOnly {
+		watch = false
+	}
+	// make sure we get access keys, unless we are not signing anything
+	key, secret, token := c.Key, c.Secret, c.Token
+	var expires int64
+	if c.Anonymous {
+		key, secret, token = "", "", ""
+	} else {
+		if key == "" || secret == "" {
+			var envtoken string
+			key, secret, envtoken, expires = getKeys(c.Profile)
+			if token == "" {
+				token = envtoken
+			}
+		}
+		if key == "" || secret == "" {
+			return nil, os.NewError("Amazon AWS Access Key ID and/or Secret Access Key undefined")
+		}
+	}
+
+	// only canned ACLs can be set with a header
+	acl := c.ACL
+	if acl == "" {
+		acl = ACLAuto
+	}
+	valid := acl == ACLAuto
+	for _, canned := range CannedACLs {
+		valid = valid || acl == canned
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown ACL %q", acl)
+	}
+	var hasher Hasher
+	if hasher, err = FindHasher(c.Checksum); err != nil {
+		return
+	}
+	conflict := c.Conflict
+	if conflict == "" {
+		conflict = "skip"
+	}
+	valid = false
+	for _, policy := range ConflictPolicies {
+		valid = valid || conflict == policy
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown conflict policy %q", conflict)
+	}
+
+	// make sure the root directory exists
+	if info, err := os.Lstat(c.LocalRoot); err != nil {
+		return nil, fmt.Errorf("%s is not a valid directory: %v", c.LocalRoot, err)
+	} else if !info.IsDirectory() {
+		return nil, os.NewError(c.LocalRoot + " is not a valid directory")
+	}
+	if c.TmpDir != "" {
+		if info, err := os.Stat(c.TmpDir); err != nil || !info.IsDirectory() {
+			return nil, os.NewError(c.TmpDir + " is not a valid directory")
+		}
+	}
+
+	// open the database
+	var cache Storage
+	var lock *Lock
+	switch c.CacheBackend {
+	case "", "sqlite":
+		filename := CacheFile(c.CacheLocation, c.Bucket)
+
+		// two instances sharing a cache would corrupt each other's state
+		if lock, err = LockFile(filename + ".lock"); err != nil {
+			if !c.Force {
+				return nil, fmt.Errorf("%v (another propolis is using this cache; use -force to override)", err)
+			}
+			c.Log.Warnf("Ignoring cache lock: %v\n", err)
+			err = nil
+		}
+		// a practice run must not change the cache at all
+		connect := Connect
+		if c.Practice {
+			connect = ConnectScratch
+		}
+		db, err := connect(filename)
+		if err != nil {
+			lock.Unlock()
+			return nil, fmt.Errorf("connecting to database: %v", err)
+		}
+
+		// reclaim the space left by many deletes
+		if c.VacuumThreshold > 0 && !c.Practice {
+			if ratio, err := db.FreeRatio(); err == nil && ratio > c.VacuumThreshold {
+				c.Log.Infof("Vacuuming cache (%.0f%% unused)\n", ratio*100)
+				if err = db.Vacuum(); err != nil {
+					c.Log.Warnf("Unable to vacuum cache: %v\n", err)
+				}
+			}
+		}
+		cache = db
+	case "memory":
+		cache = NewMemoryCache()
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", c.CacheBackend)
+	}
+
+	// create the Propolis object
+	url := new(url.URL)
+	url.Scheme = "http"
+	if c.Secure {
+		url.Scheme = "https"
+	}
+	url.Host = c.Bucket + ".s3.amazonaws.com"
+	url.Path = "/"
+
+	// the wildcard certificate for *.s3.amazonaws.com does not match
+	// bucket names with dots in them, so name the bucket in the path
+	pathstyle := c.Secure && strings.Contains(c.Bucket, ".")
+	if pathstyle {
+		url.Host = "s3.amazonaws.com"
+		url.Path = "/" + c.Bucket + "/"
+	}
+
+	concurrent := c.Concurrent
+	if concurrent < 1 {
+		concurrent = 1
+	}
+	limit := func(n int) int {
+		if n < 1 {
+			return concurrent
+		}
+		return n
+	}
+
+	// the throttle can let every kind run at its full limit
+	most := 0
+	for _, n := range []int{c.UploadConcurrency, c.DownloadConcurrency, c.ListConcurrency} {
+		if limit(n) > most {
+			most = limit(n)
+		}
+	}
+
+	multipartconcurrency := c.MultipartConcurrency
+	if multipartconcurrency < 1 {
+		multipartconcurrency = default_multipart_concurrency
+	}
+
+	restoretier := c.RestoreTier
+	if restoretier == "" {
+		restoretier = "Standard"
+	}
+
+	defaultcontenttype := c.DefaultContentType
+	if defaultcontenttype == "" {
+		defaultcontenttype = default_mime_type
+	}
+
+	useragent := c.UserAgent
+	if useragent == "" {
+		useragent = DefaultUserAgent
+	}
+
+	// larger buffers help on high-latency, high-bandwidth links
+	buffersize := c.BufferSize
+	if buffersize <= 0 {
+		buffersize = DefaultBufferSize
+	}
+
+	// S3 rejects larger pages, so clamp them instead
+	pagesize := c.PageSize
+	if pagesize <= 0 || pagesize > MaxListPageSize {
+		if pagesize > MaxListPageSize {
+			c.Log.Warnf("List page size %d is too big, using %d\n", pagesize, MaxListPageSize)
+		}
+		pagesize = MaxListPageSize
+	}
+
+	p = &Propolis{
+		Bucket:            c.Bucket,
+		Url:               url,
+		PathStyle:         pathstyle,
+		Secure:            c.Secure,
+		ReducedRedundancy: c.ReducedRedundancy,
+		Key:               key,
+		Secret:            secret,
+		Token:             token,
+		Expires:           expires,
+		Anonymous:         c.Anonymous,
+		RequestPayer:      c.RequestPayer,
+
+		BucketRoot: c.BucketRoot,
+		LocalRoot:  filepath.Clean(c.LocalRoot),
+		TmpDir:     c.TmpDir,
+
+		Refresh:     refresh,
+		Paranoid:    c.Paranoid,
+		NoHash:      c.NoHash,
+		Delete:      c.Delete,
+		Reset:       c.Reset,
+		Directories: c.Directories,
+		Xattrs:      c.Xattrs,
+		HardLinks:   c.HardLinks,
+		Follow:      c.Follow,
+		Practice:    c.Practice,
+		Watch:       watch,
+		StatusOnly:  c.StatusOnly,
+		Delay:       c.Delay,
+		Concurrent:  concurrent,
+		Timeout:     c.Timeout,
+		PageSize:    pagesize,
+		ListV1:      c.ListV1,
+		LazyScan:    c.LazyScan,
+
+		Hasher: hasher,
+
+		PruneEmptyDirs: c.PruneEmptyDirs,
+
+		ImmediateDeletes: c.ImmediateDeletes,
+		Resume:           c.Resume,
+		FlushInterval:    c.FlushInterval,
+
+		BufferSize: buffersize,
+
+		CreateBucket: c.CreateBucket,
+		Region:       c.Region,
+
+		UserAgent: useragent,
+
+		TrashPrefix: strings.Trim(c.TrashPrefix, "/"),
+		TrashCutoff: c.TrashCutoff,
+		trashStamp:  time.UTC().Format(trash_stamp_format),
+
+		Bidirectional: c.Bidirectional,
+		Conflict:      conflict,
+
+		UploadConcurrency:   limit(c.UploadConcurrency),
+		DownloadConcurrency: limit(c.DownloadConcurrency),
+		ListConcurrency:     limit(c.ListConcurrency),
+		Throttle:            NewThrottle(most),
+
+		MultipartConcurrency: multipartconcurrency,
+
+		NormalizeUnicode: c.NormalizeUnicode,
+
+		CaseInsensitiveTarget: c.CaseInsensitiveTarget,
+
+		PreserveAtime: c.PreserveAtime,
+		SpecialFiles:  c.SpecialFiles,
+		UserMetadata:  c.UserMetadata,
+
+		ResyncCutoff: c.ResyncCutoff,
+		VerifySample: c.VerifySample,
+		VerifyServer: c.VerifyServer,
+
+		CleanupMultipart: c.CleanupMultipart,
+		MultipartCutoff:  c.MultipartCutoff,
+
+		PurgeVersions:   c.PurgeVersions,
+		PurgeNoncurrent: c.PurgeNoncurrent,
+
+		RestoreDays: c.RestoreDays,
+		RestoreTier: restoretier,
+		WaitRestore: c.WaitRestore,
+		HeaderRules: c.HeaderRules,
+		Gzip:        c.Gzip,
+		KeepGzip:    c.KeepGzip,
+
+		SniffContentType:   c.SniffContentType,
+		DefaultContentType: defaultcontenttype,
+		ACL:                acl,
+		Public:             c.Public,
+
+		NewerThan: c.NewerThan,
+		OlderThan: c.OlderThan,
+		MinSize:   c.MinSize,
+		MaxSize:   c.MaxSize,
+
+		IgnoreHidden: c.IgnoreHidden,
+		MaxDepth:     c.MaxDepth,
+
+		Log:      c.Log,
+		OnAction: c.OnAction,
+		Manifest: c.Manifest,
+
+		OnDownload: c.OnDownload,
+
+		Db:      cache,
+		lock:    lock,
+		Links:   make(map[Inode]string),
+		Visited: make(map[Inode]bool),
+	}
+	if c.Progress != nil {
+		p.Progress = NewProgress(c.Progress, c.ProgressTTY)
+		if p.Log != nil {
+			p.Log.progress = p.Progress
+		}
+	}
+	if err = p.SetupClient(c.Proxy, c.CACert, c.Insecure); err != nil {
+		cache.Close()
+		lock.Unlock()
+		return nil, fmt.Errorf("setting up connections: %v", err)
+	}
+	return
+}
+
+// release the resources held by a propolis instance
+func (p *Propolis) Close() (err os.Error) {
+	err = p.Db.Close()
+	p.lock.Unlock()
+	p.lock = nil
+	return
+}
+
+// anonymous requests can read a public bucket but not change it
+var errAnonymousPush = os.NewError("anonymous access can only pull from a bucket")
+
+// Perform a complete sync. If push is true the bucket is changed to match
+// the local directory, otherwise the local directory is changed to
+// match the bucket. The report describes what was done; it is
+// returned even if the sync stopped early because of an error.
+func (p *Propolis) Sync(push bool) (report *Report, err os.Error) {
+	p.push = push
+	p.report = newReport()
+	report = p.report
+	if (push || p.Bidirectional) && p.Anonymous {
+		return report, errAnonymousPush
+	}
+	p.Progress.Start()
+	defer p.Progress.Stop()
+
+	if err = p.checkBucket(); err != nil {
+		return
+	}
+
+	// long runs make their cache writes durable now and then, so a
+	// crash loses little
+	if p.FlushInterval > 0 {
+		stop := p.flushPeriodically()
+		defer close(stop)
+	}
+
+	if p.Reset {
+		if err = p.ResetCache(); err != nil {
+			return report, fmt.Errorf("reseting cache: %v", err)
+		}
+	}
+
+	// deletes and replacements only free storage in a versioned
+	// bucket if old versions are purged
+	if (push || p.Bidirectional) && !p.StatusOnly {
+		p.checkVersioning()
+	}
+
+	if p.CleanupMultipart {
+		p.Status("Aborting old incomplete multipart uploads...")
+		if err = p.AbortOldUploads(); err != nil {
+			return report, fmt.Errorf("cleaning up multipart uploads: %v", err)
+		}
+	}
+
+	if p.TrashPrefix != "" && p.TrashCutoff > 0 && !p.StatusOnly {
+		p.Status("Purging old trash...")
+		if err = p.PurgeTrash(); err != nil {
+			return report, fmt.Errorf("purging trash: %v", err)
+		}
+	}
+
+	// an interrupted run keeps its catalog and skips what it finished
+	var resumed bool
+	if resumed, err = p.startProgress(); err != nil {
+		return report, fmt.Errorf("starting run: %v", err)
+	}
+
+	// scan the server for a catalog of files
+	var scanned string
+	if resumed {
+		if scanned, err = p.Db.GetProgress(progress_scanned); err != nil {
+			return report, fmt.Errorf("reading progress: %v", err)
+		}
+	}
+	if p.Refresh && scanned == "" {
+		p.Status("Scanning server...")
+		if err = p.Db.BeginBatch(); err != nil {
+			return report, fmt.Errorf("starting cache transaction: %v", err)
+		}
+		if err = p.ScanServer(); err != nil {
+			p.Db.EndBatch()
+			return report, fmt.Errorf("in refresh scan: %v", err)
+		}
+		if p.checkpoints() {
+			if err = p.Db.SetProgress(progress_scanned, "yes"); err != nil {
+				p.Db.EndBatch()
+				return report, fmt.Errorf("recording progress: %v", err)
+			}
+		}
+		if err = p.Db.EndBatch(); err != nil {
+			return report, fmt.Errorf("committing cache transaction: %v", err)
+		}
+	}
+	if p.Refresh {
+
+		// dump cache entries that are out-of-date, except in a
+		// bidirectional sync where they show what changed on the server
+		if !p.Bidirectional {
+			if p.Practice {
+				p.Status("Checking for out-of-date cache entries...")
+			} else {
+				p.Status("Deleting out-of-date cache entries...")
+			}
+			if err = p.AuditCache(); err != nil {
+				return report, fmt.Errorf("in cache audit: %v", err)
+			}
+		}
+	}
+
+	// add what the cache knows to the catalog
+	p.Status("Scanning cache...")
+	if err = p.ScanCache(); err != nil {
+		return report, fmt.Errorf("in cache scan: %v", err)
+	}
+
+	// group the cache writes from the initial scan into large transactions
+	if err = p.Db.BeginBatch(); err != nil {
+		return report, fmt.Errorf("starting cache transaction: %v", err)
+	}
+
+	var q chan *File
+	var end chan chan bool
+	if p.StatusOnly {
+		q, end = p.StartStatus()
+	} else {
+		q, end = p.StartQueue()
+	}
+	p.Queue = q
+
+	// do initial file system scan, syncing as we go
+	// this marks entries in the catalog as seen as they are processed
+	p.Status("Scanning file system...")
+	if p.Watch {
+		panic("Not implemented yet")
+	} else {
+		scan(p, p.LocalRoot)
+	}
+
+	// on a push, the entries found on the server but not locally are
+	// mostly deletes. Letting the uploads finish first means a file
+	// that was renamed or moved is copied from its old key before that
+	// key is deleted, instead of being uploaded all over again.
+	if (p.push || p.Bidirectional) && !p.StatusOnly {
+		p.Status("Waiting for uploads to finish...")
+		done := make(chan bool)
+		end <- done
+		<-done
+		q, end = p.StartQueue()
+		p.Queue = q
+	}
+
+	// sync entries found on server but not in local file system
+	p.Status("Syncing files found on server but not locally...")
+	if err = p.syncUnseen(); err != nil {
+		return report, fmt.Errorf("in catalog scan: %v", err)
+	}
+
+	p.Status("Waiting for queue to empty...")
+	done := make(chan bool)
+	end <- done
+	<-done
+	report.sortPaths()
+	if err = p.Db.EndBatch(); err != nil {
+		return report, fmt.Errorf("committing cache transaction: %v", err)
+	}
+
+	// the run is complete, so there is nothing to resume
+	if p.checkpoints() {
+		if err = p.Db.ResetProgress(); err != nil {
+			return report, fmt.Errorf("clearing progress: %v", err)
+		}
+	}
+	return
+}
+
+// print a progress message about the sync as a whole
+func (p *Propolis) Status(msg string) {
+	p.Log.Infof("%s\n", msg)
+}
+
+func (p *Propolis) VisitDir(path string, f *os.FileInfo) bool {
+	// symlinks can lead back to a directory we are already inside
+	if p.Follow {
+		key := Inode{f.Dev, f.Ino}
+		if p.Visited[key] {
+			p.Log.Warnf("Skipping symlink cycle at [%s]\n", path)
+			return false
+		}
+		p.Visited[key] = true
+	}
+
+	// the trash holds files that were deleted on purpose
+	if p.isLocalTrash(path) {
+		return false
+	}
+
+	// hidden directories are pruned, but the root is synced whatever its name
+	if p.IgnoreHidden && filepath.Clean(path) != p.LocalRoot && isHidden(f.Name) {
+		return false
+	}
+
+	p.Log.Debugf("Scanning directory [%s]\n", path)
+	p.VisitFile(path+string(filepath.Separator), f)
+
+	// a directory at the depth limit is synced but not walked
+	if name, ok := relativePath(p.LocalRoot, filepath.Clean(path)); ok && p.tooDeep(depth(name)+1) {
+		return false
+	}
+	return true
+}
+
+func (p *Propolis) VisitFile(localpath string, f *os.FileInfo) {
+	// directories arrive with a trailing separator, so the root itself
+	// may be "//" when syncing from "/"; cleaning maps it back to the
+	// root, which is the empty name
+	name, ok := relativePath(p.LocalRoot, filepath.Clean(localpath))
+	if !ok {
+		panic("VisitFile: Invalid prefix [" + localpath + "]")
+	}
+	serverpath := path.Join(p.BucketRoot, p.keyName(name))
+
+	// leftovers from interrupted downloads are not real files
+	if f.IsRegular() && isPartialName(f.Name) {
+		return
+	}
+
+	// sidecars are stored as metadata of the files they describe
+	if p.UserMetadata && f.IsRegular() && isMetaFile(f.Name) {
+		return
+	}
+
+	// so are the local names given to colliding keys
+	if p.caseAliases() && isCaseAlias(f.Name) {
+		return
+	}
+
+	// replace a symlink with whatever it points to
+	// dangling links are stored as links
+	if p.Follow && f.IsSymlink() {
+		if target, err := os.Stat(localpath); err == nil {
+			if target.IsDirectory() {
+				p.followDir(localpath)
+				return
+			}
+			f = target
+		}
+	}
+	entry, err := p.Db.GetCatalog(serverpath)
+	if err != nil {
+		p.Log.Errorf("Error reading catalog for [%s]: %v\n", serverpath, err)
+		return
+	}
+	if entry != nil {
+		// mark it as seen once we've processed it
+		// note: do this now, now when the file is actually synced
+		if err = p.Db.MarkSeen(serverpath); err != nil {
+			p.Log.Errorf("Error updating catalog for [%s]: %v\n", serverpath, err)
+			return
+		}
+	}
+
+	// filtered files are ignored on both sides
+	if p.FilterLocal(f) || (p.IgnoreHidden && name != "" && isHidden(f.Name)) {
+		return
+	}
+
+	// so are files an interrupted run already synced
+	if p.alreadyDone(serverpath) {
+		return
+	}
+
+	var elt *File
+	if entry != nil {
+		elt = p.catalogFile(entry)
+	} else {
+		// a file the server does not have follows the direction of
+		// the sync: a push uploads it and a pull (with -delete)
+		// removes it
+		elt = p.NewFile(name, p.push, true)
+	}
+
+	// the name on disk may differ from the key if it was normalized
+	elt.LocalPath = localpath
+	elt.LocalInfo = f
+
+	// the first path found for a multiply-linked file is uploaded normally,
+	// and the rest refer to it
+	if p.HardLinks && f.IsRegular() && f.Nlink > 1 {
+		key := Inode{f.Dev, f.Ino}
+		if target, present := p.Links[key]; present {
+			elt.LinkTarget = target
+		} else {
+			p.Links[key] = serverpath
+		}
+	}
+
+	// the initial scan is an explicit request, so it skips the delay
+	p.enqueue(elt, true)
+}
+
+// create a File for a catalog entry, with what the server scan found
+func (p *Propolis) catalogFile(entry *CatalogEntry) (elt *File) {
+	elt = p.NewFileServer(entry.Path, p.push, true)
+	elt.ServerHashHex = entry.HashHex
+	elt.ServerSize = entry.Size
+	elt.ServerModified = entry.Modified
+	return
+}
+
+// Queue the catalog entries the local scan did not find. They are
+// read a group at a time so the whole catalog is never in memory.
+func (p *Propolis) syncUnseen() (err os.Error) {
+	p.caseClaims = make(map[string]string)
+	after := ""
+	for {
+		var entries []*CatalogEntry
+		if entries, err = p.Db.Unseen(after, catalog_group_size); err != nil || len(entries) == 0 {
+			return
+		}
+		for _, entry := range entries {
+			elt := p.catalogFile(entry)
+			if err = p.GetFileInfo(elt); err != nil {
+				return
+			}
+			if p.FilterRemote(elt) || p.alreadyDone(elt.ServerPath) {
+				continue
+			}
+			if !p.placeCaseCollision(elt) {
+				continue
+			}
+			p.enqueue(elt, true)
+		}
+		after = entries[len(entries)-1].Path
+	}
+	return
+}
+
+// walks a directory reached through a symlink, presenting
+// its contents as if they were inside the link
+type linkVisitor struct {
+	p      *Propolis
+	target string // resolved path being walked
+	link   string // path of the symlink in the local tree
+}
+
+func (v *linkVisitor) VisitDir(path string, f *os.FileInfo) bool {
+	return v.p.VisitDir(v.link+path[len(v.target):], f)
+}
+
+func (v *linkVisitor) VisitFile(path string, f *os.FileInfo) {
+	v.p.VisitFile(v.link+path[len(v.target):], f)
+}
+
+// walk the directory that a symlink points to
+func (p *Propolis) followDir(link string) {
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		p.Log.Warnf("Error following symlink [%s]: %v\n", link, err)
+		return
+	}
+	filepath.Walk(target, &linkVisitor{p, target, link}, nil)
+}
+
+// Walk the local tree. Each directory is read in sorted order, so files
+// are queued in the same order on every run.
+func scan(p *Propolis, root string) {
+	filepath.Walk(root, p, nil)
+}
+
+func getKeys(profile string) (key, secret, token string, expires int64) {
+	key = os.Getenv(AccessKeyIdVariable)
+	secret = os.Getenv(SecretAccessKeyVariable)
+	token = os.Getenv(SessionTokenVariable)
+	if key != "" && secret != "" {
+		return
+	}
+
+	// try the standard credentials file
+	if home := os.Getenv("HOME"); home != "" {
+		key, secret, token = readCredentials(path.Join(home, CredentialsFile), profile)
+		if key != "" && secret != "" {
+			return
+		}
+	}
+	key, secret, token = "", "", ""
+
+	// try reading from password file
+	fp, err := os.Open(PasswordFile)
+	if err == nil {
+		read := bufio.NewReader(fp)
+		for line, isPrefix, err := read.ReadLine(); err == nil; line, isPrefix, err = read.ReadLine() {
+			s := strings.TrimSpace(string(line))
+			if isPrefix || len(s) == 0 || s[0] == '#' {
+				continue
+			}
+			chunks := strings.SplitN(s, ":", 2)
+			if len(chunks) != 2 {
+				continue
+			}
+			key = chunks[0]
+			secret = chunks[1]
+			break
+		}
+		fp.Close()
+	}
+	if key != "" && secret != "" {
+		return
+	}
+
+	// last resort: ask the instance metadata service for role credentials
+	key, secret, token, expires, err = fetchInstanceCredentials()
+	if err != nil {
+		key, secret, token, expires = "", "", "", 0
+	}
+	return
+}
+
+// read a profile from an ini-style AWS credentials file
+func readCredentials(filename, profile string) (key, secret, token string) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	section := ""
+	read := bufio.NewReader(fp)
+	for line, isPrefix, err := read.ReadLine(); err == nil; line, isPrefix, err = read.ReadLine() {
+		s := strings.TrimSpace(string(line))
+		if isPrefix || len(s) == 0 || s[0] == '#' || s[0] == ';' {
+			continue
+		}
+
+		// section header
+		if s[0] == '[' && s[len(s)-1] == ']' {
+			section = strings.TrimSpace(s[1 : len(s)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+
+		// key = value
+		chunks := strings.SplitN(s, "=", 2)
+		if len(chunks) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(chunks[1])
+		switch strings.TrimSpace(chunks[0]) {
+		case "aws_access_key_id":
+			key = value
+		case "aws_secret_access_key":
+			secret = value
+		case "aws_session_token":
+			token = value
+		}
+	}
+	return
+}
@@ -0,0 +1,107 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of the local scan
+
+package propolis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The key for each file the local scan finds, for a local root of "/",
+// one level down, or many levels down. The root itself may arrive with
+// a trailing separator, or as "//" when the root is "/".
+func TestVisitFileRoots(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	p, err := newTestPropolis(testConfig(dir))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	p.Queue = make(chan *File, 1)
+
+	for _, test := range []struct {
+		root, path, key string
+		dir             bool
+	}{
+		{"/", "/etc/hosts", "etc/hosts", false},
+		{"/", "/", "", true},
+		{"/", "//", "", true},
+		{"/a", "/a/b", "b", false},
+		{"/a", "/a/", "", true},
+		{"/a/b/c/d", "/a/b/c/d/e/f", "e/f", false},
+		{"/a/b/c/d", "/a/b/c/d/", "", true},
+	} {
+		p.LocalRoot = test.root
+		info := &os.FileInfo{Mode: s_ifreg | 0644, Name: filepath.Base(test.path)}
+		if test.dir {
+			info.Mode = s_ifdir | 0755
+		}
+		p.VisitFile(test.path, info)
+		elt := <-p.Queue
+		if elt.ServerPath != test.key {
+			t.Errorf("root %q: %q has key %q, expected %q", test.root, test.path, elt.ServerPath, test.key)
+		}
+	}
+}
+
+// A file found locally follows the direction of the sync, whether or
+// not the server has it: a push uploads it, and a pull leaves the
+// server alone.
+func TestLocalFileDirection(t *testing.T) {
+	for _, push := range []bool{true, false} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		s := newFakeS3()
+		defer s.Close()
+
+		writeFile(t, filepath.Join(root, "local-only.txt"), "local\n")
+		writeFile(t, filepath.Join(root, "both.txt"), "local version\n")
+		s.put("both.txt", "server version\n", nil)
+
+		p := newFakePropolis(t, testConfig(root), s)
+		p.push = push
+		p.Queue = make(chan *File, 2)
+		for _, name := range []string{"local-only.txt", "both.txt"} {
+			info, err := os.Lstat(filepath.Join(root, name))
+			if err != nil {
+				t.Fatalf("Lstat: %v", err)
+			}
+			p.VisitFile(filepath.Join(root, name), info)
+			if elt := <-p.Queue; elt.Push != push {
+				t.Errorf("push=%v: %s was queued with Push %v", push, name, elt.Push)
+			}
+		}
+
+		runSync(t, p, push)
+		uploads := s.count("PUT", "local-only.txt") + s.count("PUT", "both.txt")
+		switch {
+		case push && uploads != 2:
+			t.Errorf("push: %d of 2 files were uploaded", uploads)
+		case !push && uploads != 0:
+			t.Errorf("pull: %d files were uploaded", uploads)
+		case !push && readFile(filepath.Join(root, "both.txt")) != "server version\n":
+			t.Errorf("pull: both.txt was not downloaded")
+		}
+	}
+}
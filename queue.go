@@ -20,13 +20,11 @@
 
 // Update task queue manager
 
-package main
+package propolis
 
 import (
 	"container/heap"
 	"container/vector"
-	"fmt"
-	"os"
 	"time"
 )
 
@@ -34,6 +32,7 @@ type Candidate struct {
 	Name     string
 	Inserted int64
 	Updated  int64
+	Kind     int
 	Data     *File
 }
 
@@ -41,22 +40,89 @@ type Queue struct {
 	vector.Vector
 }
 
+// oldest first, with ties broken by name so the order is repeatable
 func (q *Queue) Less(i, j int) bool {
-	return q.At(i).(*Candidate).Inserted < q.At(j).(*Candidate).Inserted
+	a, b := q.At(i).(*Candidate), q.At(j).(*Candidate)
+	if a.Inserted != b.Inserted {
+		return a.Inserted < b.Inserted
+	}
+	return a.Name < b.Name
+}
+
+// kinds of update, each with its own limit on how many run at once
+const (
+	update_upload = iota
+	update_download
+	update_metadata
+	update_kinds
+)
+
+var update_kind_names = []string{"upload", "download", "metadata"}
+
+// Classify a queued update. Pushes that find no local file turn into
+// deletes, which are cheap metadata requests.
+func updateKind(data *File) int {
+	switch {
+	case !data.Push:
+		return update_download
+	case data.LocalInfo == nil:
+		return update_metadata
+	}
+	return update_upload
+}
+
+// Add a file to the queue. Immediate updates skip the delay that lets
+// a burst of changes to one file settle: explicit requests like the
+// initial scan are immediate, while changes a watcher sees are not.
+// With -immediate-deletes, deletes never wait either.
+func (p *Propolis) enqueue(elt *File, immediate bool) {
+	elt.Immediate = immediate || p.ImmediateDeletes && isDelete(elt)
+	p.Queue <- elt
+}
+
+// Will a queued update delete a file? This is a guess made before the
+// file is synced: a push with no local file, or a pull of a local file
+// the server does not have.
+func isDelete(elt *File) bool {
+	if elt.Push {
+		return elt.LocalInfo == nil
+	}
+	return elt.LocalInfo != nil && elt.CacheInfo == nil && elt.ServerHashHex == ""
+}
+
+// the number of updates of a given kind allowed to run at once,
+// which is lower while the server is throttling requests
+func (p *Propolis) concurrency(kind int) (limit int) {
+	switch kind {
+	case update_upload:
+		limit = p.UploadConcurrency
+	case update_download:
+		limit = p.DownloadConcurrency
+	default:
+		limit = p.ListConcurrency
+	}
+	if throttled := p.Throttle.Limit(); throttled < limit {
+		limit = throttled
+	}
+	return
 }
 
 // Start the main queue loop. The channel that is returned
 // accepts relative path names as input. It waits for at least
 // p.Delay seconds from the last time that path came through
 // the channel, then issues a FileUpdate action on it.
-// At most p.Concurrent updates will be launched in parallel, which
+// Uploads, downloads, and metadata updates each have their own
+// limit on how many run in parallel (see concurrency), which
 // may delay some requests beyond delay seconds.
 func (p *Propolis) StartQueue() (check chan *File, quit chan chan bool) {
 	// a path coming in on this channel should be checked after a delay
 	check = make(chan *File)
 
-	// the main queue of files that are waiting to be updated
-	queue := new(Queue)
+	// the queues of files that are waiting to be updated, one per kind
+	queues := make([]*Queue, update_kinds)
+	for kind := range queues {
+		queues[kind] = new(Queue)
+	}
 
 	// map of path -> candidate in the queue, useful for
 	// finding existing entries
@@ -65,8 +131,8 @@ func (p *Propolis) StartQueue() (check chan *File, quit chan chan bool) {
 	// this channel triggers a check for an old-enough entry to update
 	timeout := make(chan bool)
 
-	// this channel indicates an update is complete
-	finished := make(chan bool)
+	// this channel indicates an update of the given kind is complete
+	finished := make(chan int)
 
 	// this channel tells the function to quit next time the queue is empty
 	quit = make(chan chan bool)
@@ -75,28 +141,38 @@ func (p *Propolis) StartQueue() (check chan *File, quit chan chan bool) {
 	// this indicates whether or not a worker is preparing to signal timeout
 	waiting := false
 
-	// count of how many updates are in progress
-	inflight := 0
+	// count of how many updates of each kind are in progress
+	inflight := make([]int, update_kinds)
+	total := 0
+
+	// count of entries in all the queues
+	queued := func() (n int) {
+		for _, queue := range queues {
+			n += queue.Len()
+		}
+		return
+	}
 
 	go func() {
 		for {
 			select {
 			case data := <-check:
 				path := data.ServerPath
-				//fmt.Printf("Q: incoming request [%s]\n", path)
+				p.Log.Debugf("Q: incoming request [%s]\n", path)
 
 				// record the incoming request
 				now := time.Nanoseconds()
 
 				// are we already watching this file?
+				// note: it stays in the queue for the kind it started as
 				if elt, present := pendingCandidates[path]; present {
 					// touch an existing entry
 					elt.Updated = now
 					elt.Data = data
-					//fmt.Printf("Q: pending candidate touched [%s]\n", path)
+					p.Log.Debugf("Q: pending candidate touched [%s]\n", path)
 				} else {
 					// new entry
-					elt := &Candidate{path, now, now, data}
+					elt := &Candidate{path, now, now, updateKind(data), data}
 					if data.Immediate {
 						// move this request back in time
 						elt.Inserted -= int64(p.Delay) * 1e9
@@ -104,69 +180,81 @@ func (p *Propolis) StartQueue() (check chan *File, quit chan chan bool) {
 					}
 
 					// put it in the queue
-					heap.Push(queue, elt)
+					heap.Push(queues[elt.Kind], elt)
 
 					// and in the map so we can find it by path name
 					pendingCandidates[path] = elt
-					//fmt.Printf("Q: new candidate added [%s]\n", path)
+					p.Log.Debugf("Q: new %s candidate added [%s]\n", update_kind_names[elt.Kind], path)
 				}
 
 			case <-timeout:
-				//fmt.Printf("Q: timeout expired, checking queue\n")
+				p.Log.Debugf("Q: timeout expired, checking queue\n")
 				waiting = false
 				now := time.Nanoseconds()
 
-				// check the head of the queue
-				for queue.Len() > 0 {
-					elt := heap.Pop(queue).(*Candidate)
+				// check the head of each queue
+				for kind, queue := range queues {
+					for queue.Len() > 0 {
+						elt := heap.Pop(queue).(*Candidate)
 
-					// was this updated while it waited?
-					if elt.Inserted != elt.Updated {
-						elt.Inserted = elt.Updated
-						heap.Push(queue, elt)
-						//fmt.Printf("Q: touched candidate requeued [%s]\n", elt.Name)
-						continue
-					}
+						// was this updated while it waited?
+						if elt.Inserted != elt.Updated {
+							elt.Inserted = elt.Updated
+							heap.Push(queue, elt)
+							p.Log.Debugf("Q: touched candidate requeued [%s]\n", elt.Name)
+							continue
+						}
 
-					// has the delay been long enough?
-					if now-elt.Inserted < int64(p.Delay)*1e9 && shutdown == nil {
-						heap.Push(queue, elt)
-						//fmt.Printf("Q: oldest entry not old enough [%s]\n", elt.Name)
-						break
-					}
+						// has the delay been long enough?
+						if now-elt.Inserted < int64(p.Delay)*1e9 && shutdown == nil {
+							heap.Push(queue, elt)
+							p.Log.Debugf("Q: oldest entry not old enough [%s]\n", elt.Name)
+							break
+						}
+
+						// is there room for an update right now?
+						if inflight[kind] < p.concurrency(kind) {
+							inflight[kind]++
+							total++
+							pendingCandidates[elt.Name] = nil, false
+							p.Log.Debugf("Q: starting %s [%s]\n", update_kind_names[kind], elt.Name)
+							go func(kind int, data *File) {
+								// perform the actual update
+								err := p.SyncFile(data)
+								if err == errFileChanged && p.requeueChanged(data) {
+									err = nil
+								} else if err == nil {
+									p.writeManifest(data)
+									if p.checkpoints() {
+										err = p.Db.MarkDone(data.ServerPath)
+									}
+								}
+								if err != nil {
+									p.recordError(data, err)
+								}
 
-					// is there room for an update right now?
-					if inflight < p.Concurrent {
-						inflight++
-						pendingCandidates[elt.Name] = nil, false
-						//fmt.Printf("Q: starting update [%s]\n", elt.Name)
-						go func(path string, data *File) {
-							// perform the actual update
-							err := p.SyncFile(data)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "Error updating [%s]: %v\n", data.ServerPath, err)
-							}
-
-							// signal that this update is finished
-							// so another can begin
-							finished <- true
-						}(elt.Name, elt.Data)
-					} else {
-						heap.Push(queue, elt)
-						//fmt.Printf("Q: too many updates in flight [%s]\n", elt.Name)
-						break
+								// signal that this update is finished
+								// so another can begin
+								finished <- kind
+							}(kind, elt.Data)
+						} else {
+							heap.Push(queue, elt)
+							p.Log.Debugf("Q: too many %s updates in flight [%s]\n", update_kind_names[kind], elt.Name)
+							break
+						}
 					}
 				}
-				if queue.Len() == 0 {
-					//fmt.Printf("Q: queue empty\n")
+				if queued() == 0 {
+					p.Log.Debugf("Q: queue empty\n")
 				}
 
-			case <-finished:
+			case kind := <-finished:
 				// a single update finished
-				//fmt.Printf("Q: update finished\n")
-				inflight--
-				if inflight == 0 {
-					//fmt.Printf("Q: no more requests in flight\n")
+				p.Log.Debugf("Q: %s finished\n", update_kind_names[kind])
+				inflight[kind]--
+				total--
+				if total == 0 {
+					p.Log.Debugf("Q: no more requests in flight\n")
 				}
 
 			case shutdown = <-quit:
@@ -175,23 +263,34 @@ func (p *Propolis) StartQueue() (check chan *File, quit chan chan bool) {
 				// shutdown != nil signals intent to shutdown
 			}
 
-			// launch a sleeper if necessary
-			if !waiting && inflight < p.Concurrent && queue.Len() > 0 {
+			// launch a sleeper if necessary: wake up when the oldest
+			// entry that has room to start is old enough
+			var headofqueue int64
+			ready := false
+			for kind, queue := range queues {
+				if queue.Len() == 0 || inflight[kind] >= p.concurrency(kind) {
+					continue
+				}
+				if inserted := queue.At(0).(*Candidate).Inserted; !ready || inserted < headofqueue {
+					headofqueue = inserted
+					ready = true
+				}
+			}
+			if !waiting && ready {
 				now := time.Nanoseconds()
 				waiting = true
-				headofqueue := queue.At(0).(*Candidate).Inserted
 				howlong := headofqueue + int64(p.Delay)*1e9 - now
-				//fmt.Printf("Q: launching sleeper for %.2f seconds\n", float64(howlong)/1e9)
+				p.Log.Debugf("Q: launching sleeper for %.2f seconds\n", float64(howlong)/1e9)
 				go func(pause int64) {
 					if pause > 0 && shutdown == nil {
 						time.Sleep(pause)
 					}
-					//fmt.Printf("Q: sleeper finished\n")
+					p.Log.Debugf("Q: sleeper finished\n")
 					timeout <- true
 				}(howlong)
 			}
 
-			if shutdown != nil && inflight == 0 && queue.Len() == 0 {
+			if shutdown != nil && total == 0 && queued() == 0 {
 				shutdown <- true
 				return
 			}
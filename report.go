@@ -0,0 +1,173 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Structured results of a sync run
+
+package propolis
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// a single action taken on a file, or planned in a practice run
+type Action struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// a file that could not be synced
+type FileError struct {
+	Path  string
+	Error os.Error
+}
+
+// The outcome of a sync run. Everything is recorded here instead of
+// being printed, so callers can present it however they like.
+type Report struct {
+	Actions []*Action      // every action, in the order they were started
+	Counts  map[string]int // action -> number of times it was taken
+	Errors  []*FileError   // files that failed to sync
+	Skipped []string       // files skipped because they could not be read
+
+	Restoring []string // archived files that could not be downloaded yet
+	Conflicts []string // files changed on both sides in a bidirectional sync
+	Collided  []string // keys whose local name is taken by another key differing only in case
+
+	AbortedUploads int   // incomplete multipart uploads aborted (-cleanup-multipart)
+	AbortedBytes   int64 // storage the aborted uploads were using
+
+	CopiedFiles   int   // uploads resolved with a server-side copy
+	CopiedBytes   int64 // upload traffic the copies avoided
+	UploadedFiles int   // files whose contents were sent in full
+	UploadedBytes int64 // bytes sent for those uploads
+
+	// for a status run (Propolis.StatusOnly): category -> sorted paths,
+	// where category is local-only, remote-only, or different; for a
+	// verify run (Propolis.Verify) it is missing, corrupt, or changed
+	Status map[string][]string
+
+	Verified int // objects whose server contents matched the cache (Propolis.Verify)
+}
+
+func newReport() *Report {
+	return &Report{
+		Counts: make(map[string]int),
+		Status: make(map[string][]string),
+	}
+}
+
+// guards the report, which is updated by concurrent workers
+var reportLock sync.Mutex
+
+func (p *Propolis) recordAction(action *Action) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Actions = append(p.report.Actions, action)
+	p.report.Counts[action.Action]++
+}
+
+func (p *Propolis) recordError(elt *File, err os.Error) {
+	p.Log.Errorf("Error updating [%s]: %v\n", elt.ServerPath, err)
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Errors = append(p.report.Errors, &FileError{elt.ServerPath, err})
+}
+
+func (p *Propolis) recordSkipped(elt *File) {
+	p.writeManifestEntry(elt, "skip", 0, elt.Reason)
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Skipped = append(p.report.Skipped, elt.ServerPath)
+}
+
+func (p *Propolis) recordRestoring(path string) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Restoring = append(p.report.Restoring, path)
+}
+
+func (p *Propolis) recordConflict(elt *File) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Conflicts = append(p.report.Conflicts, elt.ServerPath)
+}
+
+func (p *Propolis) recordCollided(elt *File) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Collided = append(p.report.Collided, elt.ServerPath)
+}
+
+func (p *Propolis) recordAborted(size int64) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.AbortedUploads++
+	p.report.AbortedBytes += size
+}
+
+func (p *Propolis) recordCopied(size int64) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.CopiedFiles++
+	p.report.CopiedBytes += size
+}
+
+func (p *Propolis) recordUploaded(size int64) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.UploadedFiles++
+	p.report.UploadedBytes += size
+}
+
+func (p *Propolis) recordStatus(elt *File, category string) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Status[category] = append(p.report.Status[category], elt.ServerPath)
+}
+
+func (p *Propolis) recordVerified() {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	p.report.Verified++
+}
+
+// Sort the lists of paths once all files have been checked. Workers
+// finish in no particular order, so this makes successive runs over
+// the same files produce the same report.
+func (r *Report) sortPaths() {
+	for _, paths := range r.Status {
+		sort.Strings(paths)
+	}
+	sort.Strings(r.Skipped)
+	sort.Strings(r.Restoring)
+	sort.Strings(r.Conflicts)
+	sort.Strings(r.Collided)
+	sort.Sort(errorsByPath(r.Errors))
+}
+
+type errorsByPath []*FileError
+
+func (a errorsByPath) Len() int           { return len(a) }
+func (a errorsByPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
+func (a errorsByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,115 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Restoring archived files
+
+package propolis
+
+import (
+	"fmt"
+	"http"
+	"os"
+	"strings"
+	"time"
+	"url"
+)
+
+// how often to check on a restore when waiting for it (ns)
+const restore_poll_interval = 5 * 60 * 1e9
+
+// Is this the error S3 returns when downloading a file that is in an
+// archive storage class (GLACIER, DEEP_ARCHIVE) and not restored?
+func isArchived(err os.Error) bool {
+	e, ok := err.(*S3Error)
+	return ok && e.Code == "InvalidObjectState"
+}
+
+// Ask S3 to make a temporary copy of an archived file available for
+// p.RestoreDays days, using the p.RestoreTier retrieval tier.
+func (p *Propolis) RestoreRequest(elt *File) (err os.Error) {
+	body := fmt.Sprintf("<RestoreRequest><Days>%d</Days>"+
+		"<GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters>"+
+		"</RestoreRequest>", p.RestoreDays, p.RestoreTier)
+
+	u := new(url.URL)
+	*u = *elt.Url
+	u.RawQuery = "restore"
+	extra := make(http.Header)
+	extra.Set("Content-Type", "application/xml")
+
+	var resp *http.Response
+	if resp, err = p.SendRequest("POST", false, "", u, newDocument(body), "", nil, extra); err != nil {
+		// asking twice is harmless
+		if e, ok := err.(*S3Error); ok && e.Code == "RestoreAlreadyInProgress" {
+			err = nil
+		}
+		return
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	return
+}
+
+// Check if a restore of an archived file is still in progress.
+func (p *Propolis) RestoringRequest(elt *File) (ongoing bool, err os.Error) {
+	var resp *http.Response
+	if resp, err = p.SendRequest("HEAD", false, "", elt.Url, nil, "", nil, nil); err != nil {
+		return
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	ongoing = strings.Contains(resp.Header.Get("X-Amz-Restore"), `ongoing-request="true"`)
+	return
+}
+
+// Handle a download that failed because the file is archived. Without
+// -restore-days the file is just reported. Otherwise a restore is
+// requested, and with -wait-restore this waits until it finishes so
+// the download can be retried; if not, the file is picked up on a
+// later run.
+func (p *Propolis) restoreArchived(elt *File) (retry bool, err os.Error) {
+	if p.RestoreDays <= 0 {
+		p.Log.Warnf("Skipping archived file [%s] (use -restore-days to restore it)\n", elt.ServerPath)
+		p.recordRestoring(elt.ServerPath)
+		return
+	}
+
+	p.Log.Infof("Requesting restore of archived file [%s]\n", elt.ServerPath)
+	if err = p.RestoreRequest(elt); err != nil {
+		return
+	}
+	if !p.WaitRestore {
+		p.recordRestoring(elt.ServerPath)
+		return
+	}
+
+	for {
+		var ongoing bool
+		if ongoing, err = p.RestoringRequest(elt); err != nil || !ongoing {
+			retry = err == nil
+			return
+		}
+		p.Log.Debugf("Waiting for restore [%s]\n", elt.ServerPath)
+		time.Sleep(restore_poll_interval)
+	}
+	return
+}
@@ -0,0 +1,89 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Resuming interrupted runs
+
+package propolis
+
+import (
+	"fmt"
+	"os"
+)
+
+// names of the progress values kept in the cache
+const (
+	progress_run     = "run"     // which sync the progress belongs to
+	progress_marker  = "marker"  // where the server scan got to
+	progress_scanned = "scanned" // set once the server scan is complete
+)
+
+// Is progress recorded as the sync goes? Runs that change nothing
+// have nothing worth resuming, and -reset always starts over.
+func (p *Propolis) checkpoints() bool {
+	return p.Resume && !p.Practice && !p.StatusOnly && !p.Reset
+}
+
+// identifies a sync, so only a repeat of the same sync resumes it
+func (p *Propolis) runSignature() string {
+	return fmt.Sprintf("push=%v bidirectional=%v local=%s root=%s",
+		p.push, p.Bidirectional, p.LocalRoot, p.BucketRoot)
+}
+
+// Pick up the progress of an interrupted run of the same sync, or
+// start afresh. The catalog is kept when resuming, but the local scan
+// is repeated, so every entry becomes unseen again.
+func (p *Propolis) startProgress() (resumed bool, err os.Error) {
+	signature := p.runSignature()
+	if p.checkpoints() {
+		var previous string
+		if previous, err = p.Db.GetProgress(progress_run); err != nil {
+			return
+		}
+		if previous == signature {
+			p.Status("Resuming interrupted sync...")
+			return true, p.Db.ClearSeen()
+		}
+	}
+
+	// any other run starts over
+	if err = p.Db.ResetProgress(); err != nil {
+		return
+	}
+	if err = p.Db.ResetCatalog(); err != nil {
+		return
+	}
+	if p.checkpoints() {
+		err = p.Db.SetProgress(progress_run, signature)
+	}
+	return
+}
+
+// Was a path synced before an interrupted run stopped?
+func (p *Propolis) alreadyDone(serverpath string) bool {
+	if !p.checkpoints() {
+		return false
+	}
+	done, err := p.Db.IsDone(serverpath)
+	if err != nil {
+		p.Log.Errorf("Error reading progress for [%s]: %v\n", serverpath, err)
+		return false
+	}
+	return done
+}
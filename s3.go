@@ -20,22 +20,26 @@
 
 // Amazon S3 transaction handlers
 
-package main
+package propolis
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/hmac"
-	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"http"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net"
 	"os"
 	"os/user"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -48,13 +52,21 @@ const (
 	directory_mime_type     = "inode/directory"
 	symlink_mime_type       = "inode/symlink"
 	alt_directory_mime_type = "application/x-directory"
+	fifo_mime_type          = "inode/fifo"
+	socket_mime_type        = "inode/socket"
+	chardevice_mime_type    = "inode/chardevice"
+	blockdevice_mime_type   = "inode/blockdevice"
 )
 
 const (
-	s_ifmt  = 0170000
-	s_iflnk = 0120000
-	s_ifreg = 0100000
-	s_ifdir = 040000
+	s_ifmt   = 0170000
+	s_iflnk  = 0120000
+	s_ifreg  = 0100000
+	s_ifdir  = 040000
+	s_ififo  = 010000
+	s_ifsock = 0140000
+	s_ifchr  = 020000
+	s_ifblk  = 060000
 
 	s_iroth = 04
 )
@@ -62,20 +74,123 @@ const (
 const (
 	acl_public  = "public-read"
 	acl_private = "private"
+
+	// pick public or private based on the file's permissions
+	ACLAuto = "auto"
 )
 
+// the canned ACLs S3 accepts for objects
+var CannedACLs = []string{
+	"private",
+	"public-read",
+	"public-read-write",
+	"authenticated-read",
+	"aws-exec-read",
+	"bucket-owner-read",
+	"bucket-owner-full-control",
+}
+
+// the storage classes S3 accepts for uploads
+var StorageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+}
+
 // in-order list of headers that are included in the request signature
 var AWS_HEADERS []string = []string{
 	"X-Amz-Acl",
+	"X-Amz-Checksum-Crc32",
+	"X-Amz-Checksum-Crc32c",
+	"X-Amz-Checksum-Mode",
+	"X-Amz-Checksum-Sha1",
+	"X-Amz-Checksum-Sha256",
 	"X-Amz-Copy-Source",
+	"X-Amz-Copy-Source-If-Match",
+	"X-Amz-Copy-Source-Range",
+	"X-Amz-Meta-Atime",
 	"X-Amz-Meta-Gid",
+	"X-Amz-Meta-Hardlink-Target",
+	"X-Amz-Meta-Md5",
 	"X-Amz-Meta-Mode",
 	"X-Amz-Meta-Mtime",
+	"X-Amz-Meta-Rdev",
 	"X-Amz-Meta-Uid",
+	"X-Amz-Meta-Uncompressed-Size",
 	"X-Amz-Metadata-Directive",
+	"X-Amz-Request-Payer",
+	"X-Amz-Security-Token",
 	"X-Amz-Storage-Class",
 }
 
+// query parameters that name a sub-resource, which is signed as part
+// of the resource (sorted)
+var AWS_SUBRESOURCES []string = []string{
+	"acl",
+	"delete",
+	"lifecycle",
+	"location",
+	"logging",
+	"notification",
+	"partNumber",
+	"policy",
+	"requestPayment",
+	"restore",
+	"torrent",
+	"uploadId",
+	"uploads",
+	"versionId",
+	"versioning",
+	"versions",
+	"website",
+}
+
+// prefixes of variable headers that are also included in the request signature
+var AWS_HEADER_PREFIXES []string = []string{
+	xattr_header_prefix,
+	meta_header_prefix,
+}
+
+const (
+	// extended attributes are stored as one metadata header each
+	xattr_header_prefix = "X-Amz-Meta-Xattr-"
+
+	// marks an empty object as a hard link to another key
+	hardlink_header = "X-Amz-Meta-Hardlink-Target"
+
+	// the md5 hash (hex) of an object stored in parts, whose ETag is
+	// not one
+	md5_meta_header = "X-Amz-Meta-Md5"
+
+	// the device number of a device node marker, as major,minor
+	rdev_header = "X-Amz-Meta-Rdev"
+
+	// base64 md5 hash of an empty file, for Content-MD5
+	empty_file_md5_base64 = "1B2M2Y8AsgTpgAmY7PhCfg=="
+)
+
+// The ETag of an object uploaded or copied in parts is not the md5
+// hash of its contents, but a hash of the part hashes ending in
+// -<number of parts>.
+func isMultipartETag(etag string) bool {
+	return strings.Contains(etag, "-")
+}
+
+// returned when downloaded contents do not match the ETag
+var errMd5Mismatch = os.NewError("md5sum mismatch")
+var errChecksumMismatch = os.NewError("checksum mismatch")
+
+// returned when a conditional download finds the contents unchanged
+var errNotModified = os.NewError("not modified")
+
+// format of LastModified in bucket list results
+const list_time_format = "2006-01-02T15:04:05.000Z"
+
 // results from bucket list requests
 type Contents struct {
 	Key          string
@@ -84,6 +199,62 @@ type Contents struct {
 	Size         int64
 }
 
+// a group of keys rolled up at the delimiter, e.g. "photos/2011/"
+type CommonPrefixes struct {
+	Prefix string
+}
+
+// error responses
+type S3Error struct {
+	StatusCode int    // HTTP status code
+	Status     string // HTTP status line
+	Code       string // S3 error code, e.g. AccessDenied or SlowDown
+	Message    string
+	Resource   string
+	RequestId  string
+	HostId     string
+	ServerTime string // only for RequestTimeTooSkewed
+}
+
+func (e *S3Error) String() string {
+	if e.Code == "" {
+		return e.Status
+	}
+	msg := e.Code
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestId != "" {
+		msg += " (RequestId " + e.RequestId + ")"
+	}
+	return msg
+}
+
+// Turn a failed response into an *S3Error, using the XML error
+// document in the body if there is one (HEAD responses have none).
+// The body is consumed and closed.
+func ParseError(resp *http.Response) os.Error {
+	e := &S3Error{StatusCode: resp.StatusCode, Status: resp.Status}
+
+	// responses with no error document (like HEAD) still identify
+	// the request in their headers
+	e.RequestId = resp.Header.Get("X-Amz-Request-Id")
+	e.HostId = resp.Header.Get("X-Amz-Id-2")
+	if resp.Body == nil {
+		return e
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(body) == 0 {
+		return e
+	}
+	if err = xml.Unmarshal(bytes.NewBuffer(body), e); err != nil {
+		// not an S3 error document; report the status alone
+		e.Code, e.Message = "", ""
+	}
+	return e
+}
+
 type ListBucketResult struct {
 	Name        string
 	Prefix      string
@@ -92,21 +263,116 @@ type ListBucketResult struct {
 	MaxKeys     int
 	IsTruncated bool
 	Contents    []Contents
+
+	// subdirectories, only returned when listing with a delimiter
+	CommonPrefixes []CommonPrefixes
+
+	// ListObjectsV2 only
+	ContinuationToken     string
+	NextContinuationToken string
+	StartAfter            string
+	KeyCount              int
+}
+
+// extra headers that describe a file beyond its basic metadata
+func (p *Propolis) FileHeaders(elt *File) (extra http.Header) {
+	extra = make(http.Header)
+
+	// extended attributes, one header each with a base64-encoded value
+	for name, value := range elt.Xattrs {
+		extra.Set(xattr_header_prefix+encodeXattrName(name),
+			base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+
+	// user metadata, one header each
+	for name, value := range elt.Metadata {
+		extra.Set(meta_header_prefix+name, value)
+	}
+
+	// a content type found by sniffing replaces the default
+	if elt.ContentType != "" {
+		extra.Set("Content-Type", elt.ContentType)
+	}
+
+	// compressed contents, along with the real size
+	if elt.Gzip {
+		extra.Set("Content-Encoding", "gzip")
+		extra.Set(uncompressed_size_header, strconv.Itoa64(elt.LocalInfo.Size))
+	}
+	return
+}
+
+// ask for the second checksum, if one is kept, to come back with an
+// object's metadata
+func (p *Propolis) checksumMode(extra http.Header) http.Header {
+	if p.Hasher != nil {
+		if extra == nil {
+			extra = make(http.Header)
+		}
+		extra.Set("X-Amz-Checksum-Mode", "ENABLED")
+	}
+	return extra
+}
+
+// the second checksum, if one is kept, from an object's metadata
+func (p *Propolis) responseChecksum(resp *http.Response) string {
+	if p.Hasher == nil {
+		return ""
+	}
+	return checksumFromHeader(resp.Header.Get(p.Hasher.Header()))
 }
 
 func (p *Propolis) UploadRequest(elt *File) (err os.Error) {
-	_, err = p.SendRequest("PUT", p.ReducedRedundancy, "", elt.Url, elt.Contents, elt.LocalHashBase64, elt.LocalInfo)
+	if p.uploadInParts(elt) {
+		return p.MultipartUploadRequest(elt)
+	}
+
+	// the length sent is the length of the contents as uploaded,
+	// which may be compressed
+	info := new(os.FileInfo)
+	*info = *elt.LocalInfo
+	info.Size = elt.UploadSize
+
+	// S3 checks the second checksum, if one is kept, as well as the md5
+	extra := p.FileHeaders(elt)
+	if p.Hasher != nil && elt.LocalChecksumHex != "" {
+		extra.Set(p.Hasher.Header(), checksumHeader(elt.LocalChecksumHex))
+	}
+
+	body := p.Progress.Reader(elt.Contents, elt.UploadSize)
+	var resp *http.Response
+	if resp, err = p.SendRequest("PUT", p.ReducedRedundancy, "", elt.Url, body, elt.LocalHashBase64, info, extra); err != nil {
+		return
+	}
+	elt.ServerETag = ""
+
+	// with -no-hash the md5 hash is not known until S3 reports it
+	if etag := resp.Header.Get("Etag"); elt.LocalHashHex == "" && len(etag) > 2 {
+		elt.LocalHashHex = etag[1 : len(etag)-1]
+	}
+	return
+}
+
+// upload an empty marker object recording that elt is a hard link to elt.LinkTarget
+func (p *Propolis) LinkRequest(elt *File) (err os.Error) {
+	info := new(os.FileInfo)
+	*info = *elt.LocalInfo
+	info.Size = 0
+	extra := p.FileHeaders(elt)
+	extra.Set(hardlink_header, elt.LinkTarget)
+	body := ioutil.NopCloser(new(bytes.Buffer))
+	_, err = p.SendRequest("PUT", p.ReducedRedundancy, "", elt.Url, body, empty_file_md5_base64, info, extra)
 	return
 }
 
 func (p *Propolis) DeleteRequest(elt *File) (err os.Error) {
-	_, err = p.SendRequest("DELETE", false, "", elt.Url, nil, "", nil)
+	_, err = p.SendRequest("DELETE", false, "", elt.Url, nil, "", nil, nil)
 	return
 }
 
 func (p *Propolis) StatRequest(elt *File) (err os.Error) {
 	var resp *http.Response
-	if resp, err = p.SendRequest("HEAD", false, "", elt.Url, nil, "", nil); err != nil {
+	if resp, err = p.SendRequest("HEAD", false, "", elt.Url, nil, "", nil, p.checksumMode(nil)); err != nil {
 		// we don't consider "not found" an error
 		if resp != nil && resp.StatusCode == 404 {
 			err = nil
@@ -119,42 +385,166 @@ func (p *Propolis) StatRequest(elt *File) (err os.Error) {
 	etag := resp.Header.Get("Etag")
 	elt.ServerHashHex = etag[1 : len(etag)-1]
 	elt.CacheHashHex = elt.ServerHashHex
+	elt.CacheChecksumHex = p.responseChecksum(resp)
+	elt.ServerETag = ""
+	if isMultipartETag(elt.ServerHashHex) {
+		elt.ServerETag = elt.ServerHashHex
+	}
+	if p.HardLinks {
+		elt.LinkTarget = resp.Header.Get(hardlink_header)
+	}
 	return
 }
 
+// Copy src to elt on the server. The source must still have the
+// contents elt is expected to end up with, so a source that is being
+// replaced at the same time fails the copy instead of being copied.
 func (p *Propolis) CopyRequest(elt *File, src string) (err os.Error) {
-	_, err = p.SendRequest("PUT", p.ReducedRedundancy, src, elt.Url, nil, "", elt.LocalInfo)
+	extra := p.FileHeaders(elt)
+
+	// S3 rejects single copies of objects over 5 GB. The copy is
+	// stored in parts, so its ETag is not the md5 hash; that is kept
+	// as metadata so downloads can still be checked.
+	if elt.UploadSize > max_copy_size {
+		extra.Set(md5_meta_header, elt.LocalHashHex)
+		elt.ServerETag, err = p.MultipartCopyRequest(src, elt.ServerPath, elt.UploadSize, elt.LocalInfo, extra, elt.LocalHashHex)
+		return
+	}
+	extra.Set("X-Amz-Copy-Source-If-Match", "\""+elt.LocalHashHex+"\"")
+	_, err = p.SendRequest("PUT", p.ReducedRedundancy, src, elt.Url, nil, "", elt.LocalInfo, extra)
+	elt.ServerETag = ""
 	return
 }
 
 func (p *Propolis) SetStatRequest(elt *File) (err os.Error) {
-	_, err = p.SendRequest("PUT", p.ReducedRedundancy, elt.FullServerPath, elt.Url, nil, "", elt.LocalInfo)
+	_, err = p.SendRequest("PUT", p.ReducedRedundancy, elt.FullServerPath, elt.Url, nil, "", elt.LocalInfo, p.FileHeaders(elt))
 	return
 }
 
-// TODO:
-func (p *Propolis) DownloadRequest(path string, body io.WriteCloser) (info *os.FileInfo, err os.Error) {
+// Download a file into body, which is always closed. The metadata
+// and extended attributes found on the server are stored in elt.
+func (p *Propolis) DownloadRequest(elt *File, body io.WriteCloser) os.Error {
+	return p.DownloadRangeRequest(elt, body, 0, md5Hasher.New(), "")
+}
+
+// the parts of *os.File needed to throw away a partial download
+type truncater interface {
+	Truncate(size int64) os.Error
+	Seek(offset int64, whence int) (int64, os.Error)
+}
+
+// Download the rest of a file into body, starting at offset. md5hash
+// must already contain the first offset bytes. The range request is
+// made conditional on the ETag from the scan, so if the file changed
+// on the server the partial contents are discarded and the whole file
+// is downloaded again.
+//
+// A full download can be made conditional with notmatch, the md5 hash
+// of contents that are already present locally. If the server has the
+// same contents, nothing is downloaded and errNotModified is returned.
+func (p *Propolis) DownloadRangeRequest(elt *File, body io.WriteCloser, offset int64, md5hash hash.Hash, notmatch string) (err os.Error) {
+	extra := make(http.Header)
+	if offset > 0 {
+		extra.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		etag := elt.ServerHashHex
+		if elt.ServerETag != "" {
+			etag = elt.ServerETag
+		}
+		extra.Set("If-Match", "\""+etag+"\"")
+	} else if notmatch != "" {
+		extra.Set("If-None-Match", "\""+notmatch+"\"")
+	}
+
 	var resp *http.Response
-	if resp, err = p.SendRequest("GET", false, "", nil, nil, "", nil); err != nil {
+	if resp, err = p.SendRequest("GET", false, "", elt.Url, nil, "", nil, p.checksumMode(extra)); err != nil {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		// the local contents are already right
+		if e, ok := err.(*S3Error); ok && offset == 0 && e.StatusCode == http.StatusNotModified {
+			body.Close()
+			return errNotModified
+		}
+
+		// the file changed or the partial file is no good: start over
+		if e, ok := err.(*S3Error); ok && offset > 0 &&
+			(e.StatusCode == http.StatusPreconditionFailed || e.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
+			if err = restartDownload(body, md5hash); err == nil {
+				return p.DownloadRangeRequest(elt, body, 0, md5hash, "")
+			}
+		}
+		body.Close()
 		return
 	}
-	info = new(os.FileInfo)
-	info.Name = path
+	defer resp.Body.Close()
+
+	// the server ignored the range and sent everything
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		if err = restartDownload(body, md5hash); err != nil {
+			body.Close()
+			return
+		}
+		offset = 0
+	}
+
+	info := new(os.FileInfo)
+	info.Name = elt.ServerPath
 	p.GetResponseMetaData(resp, info)
+	elt.Gzip = resp.Header.Get("Content-Encoding") == "gzip"
+
+	// the size of the contents as stored, which is compressed for gzip files
+	stored := resp.ContentLength
+	if offset > 0 {
+		// the full size is at the end of "bytes start-end/size"
+		contentRange := resp.Header.Get("Content-Range")
+		if slash := strings.LastIndex(contentRange, "/"); slash >= 0 {
+			if size, er := strconv.Atoi64(contentRange[slash+1:]); er == nil {
+				stored = size
+			}
+		}
+	}
+	info.Size = stored
+	elt.CacheInfo = info
+	if p.Xattrs {
+		elt.Xattrs = p.GetResponseXattrs(resp)
+	}
+	if p.UserMetadata {
+		elt.Metadata = p.GetResponseUserMetadata(resp)
+	}
+	if p.HardLinks {
+		elt.LinkTarget = resp.Header.Get(hardlink_header)
+	}
+	elt.CacheChecksumHex = p.responseChecksum(resp)
+
+	// the whole download is also checked against the second checksum,
+	// if one is kept; a resumed download only has the md5 hash of its
+	// first part
+	var checksum hash.Hash
+	if p.Hasher != nil && offset == 0 && elt.CacheChecksumHex != "" {
+		checksum = p.Hasher.New()
+	}
 
 	// download and compute MD5 hash as we go
-	md5hash := md5.New()
 
 	// adapted from io.Copy
-	written := int64(0)
-	buf := make([]byte, 32*1024)
+	written := offset
+	p.Progress.begin(stored - offset)
+	defer p.Progress.end()
+	var reported int64
+	buf := make([]byte, p.BufferSize)
 	for {
 		nr, er := resp.Body.Read(buf)
 		if nr > 0 {
 			md5hash.Write(buf[0:nr])
+			if checksum != nil {
+				checksum.Write(buf[0:nr])
+			}
 			nw, ew := body.Write(buf[0:nr])
 			if nw > 0 {
 				written += int64(nw)
+				p.Progress.add(int64(nw))
+				reported = p.downloaded(elt, written, stored, reported)
 			}
 			if ew != nil {
 				err = ew
@@ -175,19 +565,83 @@ func (p *Propolis) DownloadRequest(path string, body io.WriteCloser) (info *os.F
 	}
 	body.Close()
 
-	if err == nil && written != info.Size {
+	if err == nil && written != stored {
 		err = io.ErrUnexpectedEOF
 	}
 
-	// hex-encode the md5 hash
-	md5hex := "\"" + hex.EncodeToString(md5hash.Sum()) + "\""
-	if md5hex != resp.Header.Get("Etag") {
-		err = os.NewError("md5sum mismatch for " + path)
+	if err != nil {
+		return
+	}
+	if p.OnDownload != nil {
+		p.OnDownload(elt, written, stored)
+	}
+
+	if checksum != nil && hex.EncodeToString(checksum.Sum()) != elt.CacheChecksumHex {
+		return errChecksumMismatch
+	}
+
+	// hex-encode the md5 hash. the ETag of an object stored in parts
+	// is not an md5 hash, so the md5 recorded when it was stored is
+	// used instead; without one, only a second checksum vouches for it
+	md5hex := hex.EncodeToString(md5hash.Sum())
+	etag := resp.Header.Get("Etag")
+	if len(etag) > 2 {
+		etag = etag[1 : len(etag)-1]
+	}
+	expected := etag
+	elt.ServerETag = ""
+	if isMultipartETag(etag) {
+		elt.ServerETag = etag
+		if expected = resp.Header.Get(md5_meta_header); expected == "" {
+			if checksum == nil {
+				p.Log.Debugf("No md5 hash to check the download against [%s]\n", elt.ServerPath)
+			}
+			expected = md5hex
+		}
+	}
+	if md5hex != expected {
+		return errMd5Mismatch
+	}
+	elt.ServerHashHex = md5hex
+	elt.CacheHashHex = md5hex
+
+	return
+}
+
+// Tell OnDownload how far a download has got, at most once per
+// progress_interval. last is when it was last told, and the time it
+// was told now is returned.
+func (p *Propolis) downloaded(elt *File, done, total, last int64) int64 {
+	if p.OnDownload == nil {
+		return last
+	}
+	now := time.Nanoseconds()
+	if now-last < progress_interval {
+		return last
 	}
+	p.OnDownload(elt, done, total)
+	return now
+}
 
+// throw away a partial download so it can be started from scratch
+func restartDownload(body io.WriteCloser, md5hash hash.Hash) (err os.Error) {
+	t, ok := body.(truncater)
+	if !ok {
+		return os.NewError("cannot restart a partial download")
+	}
+	if err = t.Truncate(0); err != nil {
+		return
+	}
+	if _, err = t.Seek(0, 0); err != nil {
+		return
+	}
+	md5hash.Reset()
 	return
 }
 
+// List the keys under path. marker continues an earlier listing: it
+// is the last key seen when using the original list API (p.ListV1),
+// or the NextContinuationToken from the previous page otherwise.
 func (p *Propolis) ListRequest(path string, marker string, maxEntries int, includeAll bool) (listresult *ListBucketResult, err os.Error) {
 	// set up the query string
 	var prefix string
@@ -198,6 +652,9 @@ func (p *Propolis) ListRequest(path string, marker string, maxEntries int, inclu
 	}
 
 	query := make(url.Values)
+	if !p.ListV1 {
+		query.Add("list-type", "2")
+	}
 	query.Add("prefix", prefix)
 
 	// are we scanning just a single directory or getting everything?
@@ -206,8 +663,12 @@ func (p *Propolis) ListRequest(path string, marker string, maxEntries int, inclu
 	}
 
 	// are we continuing an earlier scan?
-	if marker != "" {
+	switch {
+	case marker == "":
+	case p.ListV1:
 		query.Add("marker", marker)
+	default:
+		query.Add("continuation-token", marker)
 	}
 
 	// restrict the maximum number of entries returned
@@ -219,7 +680,7 @@ func (p *Propolis) ListRequest(path string, marker string, maxEntries int, inclu
 
 	// issue the request
 	var resp *http.Response
-	if resp, err = p.SendRequest("GET", false, "", u, nil, "", nil); err != nil {
+	if resp, err = p.SendRequest("GET", false, "", u, nil, "", nil, nil); err != nil {
 		return
 	}
 	if resp.Body != nil {
@@ -236,10 +697,14 @@ func (p *Propolis) ListRequest(path string, marker string, maxEntries int, inclu
 }
 
 func (p *Propolis) SetRequestMetaData(req *http.Request, info *os.FileInfo) {
-	// file permissions: grant "public-read" if the file grants world read permission
-	if info.Permission()&s_iroth != 0 {
+	// file permissions: grant "public-read" if the file grants world
+	// read permission and p.Public is set, unless a fixed ACL was chosen
+	switch {
+	case p.ACL != ACLAuto:
+		req.Header.Set("X-Amz-Acl", p.ACL)
+	case p.Public && info.Permission()&s_iroth != 0:
 		req.Header.Set("X-Amz-Acl", acl_public)
-	} else {
+	default:
 		req.Header.Set("X-Amz-Acl", acl_private)
 	}
 
@@ -257,23 +722,62 @@ func (p *Propolis) SetRequestMetaData(req *http.Request, info *os.FileInfo) {
 	// store the permissions as an octal number
 	req.Header.Set("X-Amz-Meta-Mode", fmt.Sprintf("0%o", info.Mode))
 
-	// store the modified date in a nice format
-	sec := info.Mtime_ns / 1e9
-	ns := info.Mtime_ns % 1e9
-	date := time.SecondsToLocalTime(sec).String()
-	if ns == 0 {
-		req.Header.Set("X-Amz-Meta-Mtime", fmt.Sprintf("%d (%s)", sec, date))
-	} else {
-		req.Header.Set("X-Amz-Meta-Mtime", fmt.Sprintf("%d.%09d (%s)", sec, ns, date))
+	// store the modified date, and the access date if asked
+	req.Header.Set("X-Amz-Meta-Mtime", formatMtime(info.Mtime_ns))
+	if p.PreserveAtime {
+		req.Header.Set("X-Amz-Meta-Atime", formatMtime(info.Atime_ns))
+	}
+
+	// device nodes record which device they are
+	if info.IsChar() || info.IsBlock() {
+		req.Header.Set(rdev_header, formatRdev(info.Rdev))
 	}
 
 	// set the content-type by looking up the MIME type
-	mimetype := default_mime_type
+	mimetype := contentType(info)
+	if mimetype == "" {
+		mimetype = p.DefaultContentType
+	}
+	req.Header.Set("Content-Type", mimetype)
+
+	// caching and download behavior from the header rules
+	if !info.IsDirectory() && !info.IsSymlink() {
+		p.SetRuleHeaders(req, info.Name)
+	}
+}
+
+// Guess the MIME type of a file from its first 512 bytes.
+// Returns "" if nothing better than the default turns up.
+func sniffContentType(filename string) string {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer fp.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(fp, buf)
+	if mimetype := http.DetectContentType(buf[:n]); mimetype != default_mime_type {
+		return mimetype
+	}
+	return ""
+}
+
+// the MIME type to store for a file, based on its name, or "" if the
+// name does not say
+func contentType(info *os.FileInfo) (mimetype string) {
 	switch {
 	case info.IsDirectory():
 		mimetype = directory_mime_type
 	case info.IsSymlink():
 		mimetype = symlink_mime_type
+	case info.IsFifo():
+		mimetype = fifo_mime_type
+	case info.IsSocket():
+		mimetype = socket_mime_type
+	case info.IsChar():
+		mimetype = chardevice_mime_type
+	case info.IsBlock():
+		mimetype = blockdevice_mime_type
 	default:
 		if dot := strings.LastIndex(info.Name, "."); dot >= 0 && dot+1 < len(info.Name) {
 			extension := strings.ToLower(info.Name[dot:])
@@ -282,7 +786,69 @@ func (p *Propolis) SetRequestMetaData(req *http.Request, info *os.FileInfo) {
 			}
 		}
 	}
-	req.Header.Set("Content-Type", mimetype)
+	return
+}
+
+// Extended attribute names are case sensitive but header names are not,
+// so escape anything other than lowercase letters, digits, '.', and '_'
+// as %XX.
+func encodeXattrName(name string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '_' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func decodeXattrName(encoded string) (name string, err os.Error) {
+	// header names may come back with any capitalization
+	encoded = strings.ToLower(encoded)
+	var buf bytes.Buffer
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != '%' {
+			buf.WriteByte(encoded[i])
+			continue
+		}
+		if i+2 >= len(encoded) {
+			return "", os.NewError("truncated escape in xattr name: " + encoded)
+		}
+		var c []byte
+		if c, err = hex.DecodeString(encoded[i+1 : i+3]); err != nil {
+			return
+		}
+		buf.Write(c)
+		i += 2
+	}
+	return buf.String(), nil
+}
+
+// gather the extended attributes stored in a response
+func (p *Propolis) GetResponseXattrs(resp *http.Response) (xattrs map[string]string) {
+	xattrs = make(map[string]string)
+	for key, values := range resp.Header {
+		if len(key) <= len(xattr_header_prefix) ||
+			!strings.HasPrefix(strings.ToLower(key), strings.ToLower(xattr_header_prefix)) ||
+			len(values) == 0 {
+			continue
+		}
+		name, err := decodeXattrName(key[len(xattr_header_prefix):])
+		if err != nil {
+			p.Log.Warnf("Ignoring malformed xattr header [%s]: %v\n", key, err)
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(values[0])
+		if err != nil {
+			p.Log.Warnf("Ignoring malformed xattr header [%s]: %v\n", key, err)
+			continue
+		}
+		xattrs[name] = string(value)
+	}
+	return
 }
 
 func (p *Propolis) GetResponseMetaData(resp *http.Response, info *os.FileInfo) {
@@ -337,6 +903,14 @@ func (p *Propolis) GetResponseMetaData(resp *http.Response, info *os.FileInfo) {
 			mode = 0755 | s_ifdir // permissions + directory
 		case resp.Header.Get("Content-Type") == symlink_mime_type:
 			mode = 0777 | s_iflnk // permissions + symlink
+		case resp.Header.Get("Content-Type") == fifo_mime_type:
+			mode = 0644 | s_ififo // permissions + named pipe
+		case resp.Header.Get("Content-Type") == socket_mime_type:
+			mode = 0755 | s_ifsock // permissions + socket
+		case resp.Header.Get("Content-Type") == chardevice_mime_type:
+			mode = 0600 | s_ifchr // permissions + character device
+		case resp.Header.Get("Content-Type") == blockdevice_mime_type:
+			mode = 0600 | s_ifblk // permissions + block device
 		default:
 			mode = 0644 | s_ifreg // permissions + regular file
 		}
@@ -345,33 +919,29 @@ func (p *Propolis) GetResponseMetaData(resp *http.Response, info *os.FileInfo) {
 
 	// get the mtime/atime/ctime
 	// prefer X-Amz-Meta-Mtime header
-	found := false
-	var mtime int64
-	if line := resp.Header.Get("X-Amz-Meta-Mtime"); line != "" {
-		var sec, ns int64
-		if n, _ := fmt.Sscanf(line, "%d.%d", &sec, &ns); n == 2 {
-			mtime = sec*1e9 + ns
-			found = true
-		} else {
-			if n, _ := fmt.Sscanf(line, "%d", &sec); n == 1 {
-				mtime = sec * 1e9
-				found = true
-			}
-		}
-	}
+	mtime, found := parseMtime(resp.Header.Get("X-Amz-Meta-Mtime"))
+
 	// fall back to Last-Modified
 	if !found {
-		when, err := time.Parse(time.RFC1123, resp.Header.Get("Last-Modified"))
-		if err != nil {
+		var err os.Error
+		if mtime, err = parseHttpDate(resp.Header.Get("Last-Modified")); err != nil {
 			mtime = time.Nanoseconds()
-		} else {
-			mtime = when.Seconds() * 1e9
 		}
 	}
 	info.Atime_ns = mtime
 	info.Mtime_ns = mtime
 	info.Ctime_ns = mtime
 
+	// device nodes record which device they are
+	if rdev, found := parseRdev(resp.Header.Get(rdev_header)); found {
+		info.Rdev = rdev
+	}
+
+	// the access time is only there if it was uploaded with -preserve-atime
+	if atime, found := parseMtime(resp.Header.Get("X-Amz-Meta-Atime")); found {
+		info.Atime_ns = atime
+	}
+
 	// get the length from Content-Length
 	if line := resp.Header.Get("Content-Length"); line != "" {
 		var size int64
@@ -381,9 +951,111 @@ func (p *Propolis) GetResponseMetaData(resp *http.Response, info *os.FileInfo) {
 			info.Size = 0
 		}
 	}
+
+	// compressed files record their real size
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if size, err := strconv.Atoi64(resp.Header.Get(uncompressed_size_header)); err == nil {
+			info.Size = size
+		}
+	}
 }
 
-func (p *Propolis) SendRequest(method string, reduced bool, src string, target *url.URL, body io.ReadCloser, hash string, info *os.FileInfo) (resp *http.Response, err os.Error) {
+// Format a time (ns) for an X-Amz-Meta-Mtime or -Atime header, in UTC
+// so the header is the same no matter which machine uploaded the file.
+func formatMtime(when int64) string {
+	sec := when / 1e9
+	ns := when % 1e9
+	date := time.SecondsToUTC(sec).Format(time.RFC3339)
+	if ns == 0 {
+		return fmt.Sprintf("%d (%s)", sec, date)
+	}
+	return fmt.Sprintf("%d.%09d (%s)", sec, ns, date)
+}
+
+// Parse an X-Amz-Meta-Mtime header: epoch seconds with an optional
+// fraction, followed by a date in parentheses. Only the number counts;
+// the date is for people, and older versions wrote it in local time.
+func parseMtime(line string) (mtime int64, ok bool) {
+	field := line
+	if end := strings.IndexAny(line, " ("); end >= 0 {
+		field = line[:end]
+	}
+	sec, frac := field, ""
+	if dot := strings.Index(field, "."); dot >= 0 {
+		sec, frac = field[:dot], field[dot+1:]
+	}
+	s, err := strconv.Atoi64(sec)
+	if err != nil {
+		return 0, false
+	}
+	var ns int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		if ns, err = strconv.Atoi64(frac + strings.Repeat("0", 9-len(frac))); err != nil {
+			return 0, false
+		}
+	}
+	return s*1e9 + ns, true
+}
+
+// Parse a date from an HTTP header (ns). These are always in GMT, which
+// is forced here so the local time zone never shifts the result.
+func parseHttpDate(value string) (when int64, err os.Error) {
+	var t *time.Time
+	if t, err = time.Parse(time.RFC1123, value); err != nil {
+		return
+	}
+	t.ZoneOffset = 0
+	t.Zone = "UTC"
+	return t.Seconds() * 1e9, nil
+}
+
+// A request body held in memory, such as an xml document or one part of
+// a multipart upload. Its length is known without any file metadata,
+// and it can be sent again if the request is retried.
+type document struct {
+	bytes.Buffer
+}
+
+func newDocument(text string) *document {
+	doc := new(document)
+	doc.WriteString(text)
+	return doc
+}
+
+func (doc *document) Close() os.Error {
+	return nil
+}
+
+func (p *Propolis) SendRequest(method string, reduced bool, src string, target *url.URL, body io.ReadCloser, hash string, info *os.FileInfo, extra http.Header) (resp *http.Response, err os.Error) {
+	doc, isdoc := body.(*document)
+	var text string
+	if isdoc {
+		text = doc.String()
+	}
+	resp, err = p.sendRequest(method, reduced, src, target, body, hash, info, extra)
+
+	// if our clock is off, use the server's time from now on
+	if e, ok := err.(*S3Error); ok && e.Code == "RequestTimeTooSkewed" {
+		p.AdjustClock(resp, e)
+
+		// an upload body has been consumed and cannot be replayed,
+		// but anything else can be retried right away
+		switch {
+		case body == nil:
+			resp, err = p.sendRequest(method, reduced, src, target, body, hash, info, extra)
+		case isdoc:
+			resp, err = p.sendRequest(method, reduced, src, target, newDocument(text), hash, info, extra)
+		}
+	}
+
+	p.observe(err)
+	return
+}
+
+func (p *Propolis) sendRequest(method string, reduced bool, src string, target *url.URL, body io.ReadCloser, hash string, info *os.FileInfo, extra http.Header) (resp *http.Response, err os.Error) {
 	defer func() {
 		// if anything goes wrong, close the body reader
 		// if it ends normally, this will be closed already and set to nil
@@ -397,25 +1069,48 @@ func (p *Propolis) SendRequest(method string, reduced bool, src string, target *
 		return
 	}
 
-	// set upload file info if applicable
+	// set the upload length. an empty upload has no body at all, so the
+	// client sends Content-Length: 0 instead of a chunked request,
+	// which S3 rejects. copies and metadata updates are empty uploads.
 	if info != nil && body != nil {
-		// TODO: 0-length files fail because the Content-Length field is missing
-		// a fix is in the works in the Go library
 		req.ContentLength = info.Size
 	}
+	if doc, ok := body.(*document); ok {
+		req.ContentLength = int64(doc.Len())
+	}
+	if req.ContentLength == 0 {
+		if body != nil {
+			body.Close()
+			body = nil
+		}
+		req.Body = nil
+	}
 
 	if info != nil {
 		p.SetRequestMetaData(req, info)
 	}
 
-	// reduced redundancy?
-	if reduced {
+	// temporary credentials must present their session token
+	if _, _, token := p.Credentials(); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	// add any extra headers supplied by the caller, replacing defaults
+	for key, values := range extra {
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	// reduced redundancy, unless a header rule chose a storage class?
+	if reduced && req.Header.Get("X-Amz-Storage-Class") == "" {
 		req.Header.Set("X-Amz-Storage-Class", "REDUCED_REDUNDANCY")
 	}
 
 	// are we uploading a file with a content hash?
 	if hash != "" {
-		req.Header.Set("Content-MD5", hash)
+		req.Header.Set(md5Hasher.Header(), hash)
 	}
 
 	// is this a copy/metadata update?
@@ -424,12 +1119,13 @@ func (p *Propolis) SendRequest(method string, reduced bool, src string, target *
 		u := new(url.URL)
 		u.Path = src
 		req.Header.Set("X-Amz-Copy-Source", u.String())
-		req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+		if req.Header.Get("X-Amz-Metadata-Directive") == "" {
+			req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+		}
 	}
 
 	// sign and execute the request
-	// note: 2nd argument is temporary hack to set Content-Length: 0 when needed
-	if resp, err = p.SignAndExecute(req, method == "PUT" && body == nil || (info != nil && info.Size == 0)); err != nil {
+	if resp, err = p.SignAndExecute(req); err != nil {
 		return
 	}
 
@@ -438,59 +1134,242 @@ func (p *Propolis) SendRequest(method string, reduced bool, src string, target *
 	body = nil
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		err = os.NewError(resp.Status)
+		err = ParseError(resp)
+
+		// AWS support needs these to trace a failed request
+		p.Log.Debugf("Request failed [%s %s]: x-amz-request-id %s, x-amz-id-2 %s\n", method, target.Path,
+			resp.Header.Get("X-Amz-Request-Id"), resp.Header.Get("X-Amz-Id-2"))
 		return
 	}
 
 	return
 }
 
+// Open a connection, giving up if it takes longer than the request
+// timeout. The timeout also applies to each read and write on the
+// connection, so a server that stops responding fails the request
+// instead of blocking a queue worker forever.
+func (p *Propolis) Dial(network, addr string) (conn net.Conn, err os.Error) {
+	if p.Timeout <= 0 {
+		return net.Dial(network, addr)
+	}
+	timeout := int64(p.Timeout) * 1e9
+
+	type result struct {
+		conn net.Conn
+		err  os.Error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, e := net.Dial(network, addr)
+		done <- result{c, e}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		conn = res.conn
+	case <-time.After(timeout):
+		// close the connection if it eventually opens
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, os.NewError(fmt.Sprintf("timed out connecting to %s", addr))
+	}
+
+	if err = conn.SetTimeout(timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+// Set up the HTTP client used for all requests. Proxies are taken
+// from HTTP_PROXY, HTTPS_PROXY, and NO_PROXY unless proxy is
+// non-empty, in which case it is used for every request.
+// Secure connections are verified against the system roots, or
+// against the PEM certificates in caCert if it is non-empty.
+func (p *Propolis) SetupClient(proxy, caCert string, insecure bool) (err os.Error) {
+	config := new(tls.Config)
+	if caCert != "" {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(caCert); err != nil {
+			return
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return os.NewError("no certificates found in " + caCert)
+		}
+	}
+	if insecure {
+		p.Log.Warnf("WARNING: server certificates will NOT be verified.\n")
+		p.Log.Warnf("WARNING: anyone on the network path can read and alter your data.\n")
+		config.InsecureSkipVerify = true
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		Dial:            p.Dial,
+		TLSClientConfig: config,
+	}
+	if proxy != "" {
+		var u *url.URL
+		if u, err = url.Parse(proxy); err != nil {
+			return
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	p.Client = &http.Client{Transport: transport}
+	return
+}
+
+// the current time in nanoseconds, corrected to match the server's clock
+func (p *Propolis) Now() int64 {
+	p.clockLock.Lock()
+	defer p.clockLock.Unlock()
+	return time.Nanoseconds() + p.ClockOffset
+}
+
+// Record how far our clock is from the server's, taken from a
+// RequestTimeTooSkewed response.
+func (p *Propolis) AdjustClock(resp *http.Response, e *S3Error) {
+	// prefer the time reported in the error document,
+	// then the Date header on the response
+	var now int64
+	when, err := time.Parse("2006-01-02T15:04:05Z", e.ServerTime)
+	if err == nil {
+		now = when.Seconds() * 1e9
+	} else if resp != nil {
+		now, err = parseHttpDate(resp.Header.Get("Date"))
+	}
+	if err != nil {
+		p.Log.Warnf("Clock skew detected, but server time is unknown\n")
+		return
+	}
+
+	offset := now - time.Nanoseconds()
+	p.clockLock.Lock()
+	p.ClockOffset = offset
+	p.clockLock.Unlock()
+	p.Log.Warnf("Local clock is off by %d seconds; using server time\n", -offset/1e9)
+}
+
 // execute a request; date it, sign it, send it
-// note: specialcase is temporary hack to set Content-Length: 0 when needed
-func (p *Propolis) SignAndExecute(req *http.Request, specialcase bool) (resp *http.Response, err os.Error) {
+// the signature covers the bucket and path only, so it is the same
+// whether the request goes directly to S3 or through a proxy
+func (p *Propolis) SignAndExecute(req *http.Request) (resp *http.Response, err os.Error) {
 	// time stamp it
-	date := time.LocalTime().Format(time.RFC1123)
+	date := time.SecondsToUTC(p.Now() / 1e9).Format(http.TimeFormat)
 	req.Header.Set("Date", date)
+	req.Header.Set("User-Agent", p.UserAgent)
+
+	// requester-pays buckets reject requests that do not agree to pay
+	if p.RequestPayer {
+		req.Header.Set("X-Amz-Request-Payer", "requester")
+	}
 
 	// sign the request
 	p.SignRequest(req)
 
-	// open a connection
-	conn, err := net.Dial("tcp", req.URL.Host+":"+req.URL.Scheme)
-	if err != nil {
-		return nil, err
+	// send the request and read the response headers
+	if resp, err = p.Client.Do(req); err != nil || !p.RequestPayer {
+		return
 	}
 
-	// send the request
-	if specialcase {
-		var buf bytes.Buffer
-		req.Write(&buf)
-		fixed := bytes.Replace(buf.Bytes(),
-			[]byte("User-Agent: Go http package\r\n"),
-			[]byte("User-Agent: Go http package\r\nContent-Length: 0\r\n"), 1)
-		_, err = conn.Write(fixed)
-	} else {
-		err = req.Write(conn)
+	// the bucket only says it is charging us if it is requester-pays
+	if resp.StatusCode < 300 && resp.Header.Get("X-Amz-Request-Charged") != "requester" {
+		p.chargedOnce.Do(func() {
+			p.Log.Warnf("Bucket [%s] is not charging the requester; -request-payer has no effect\n", p.Bucket)
+		})
 	}
-	if err != nil {
+	return
+}
+
+func (p *Propolis) SignRequest(req *http.Request) {
+	// public buckets accept requests with no Authorization header
+	if p.Anonymous {
 		return
 	}
+	msg := p.StringToSign(req, req.Header.Get("Date"))
+	key, signature := p.Sign(msg)
+	req.Header.Set("Authorization", "AWS "+key+":"+signature)
+}
 
-	// now read the response
-	reader := bufio.NewReader(conn)
-	resp, err = http.ReadResponse(reader, req)
-	if err != nil {
-		return nil, err
+// Create a pre-signed url that lets anyone holding it make a method
+// request for key (relative to the bucket) for the next lifetime
+// seconds, without needing credentials. No request is made.
+func (p *Propolis) Presign(method, key string, lifetime int64) (signed string, err os.Error) {
+	if p.Anonymous {
+		return "", os.NewError("anonymous access has no credentials to sign with")
 	}
+	expires := strconv.Itoa64(p.Now()/1e9 + lifetime)
+	u := p.keyUrl(key, nil)
 
+	var req *http.Request
+	if req, err = http.NewRequest(method, u.String(), nil); err != nil {
+		return
+	}
+
+	// a session token is signed like any other x-amz header
+	_, _, token := p.Credentials()
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	if p.RequestPayer {
+		req.Header.Set("X-Amz-Request-Payer", "requester")
+	}
+
+	// the expiration time takes the place of the date
+	accesskey, signature := p.Sign(p.StringToSign(req, expires))
+	query := make(url.Values)
+	query.Add("AWSAccessKeyId", accesskey)
+	query.Add("Expires", expires)
+	query.Add("Signature", signature)
+	if token != "" {
+		query.Add("x-amz-security-token", token)
+	}
+	if p.RequestPayer {
+		query.Add("x-amz-request-payer", "requester")
+	}
+	u.RawQuery = query.Encode()
+	signed = u.String()
 	return
 }
 
-func (p *Propolis) SignRequest(req *http.Request) {
-	// gather the string to be signed
+// The url path for a key, which includes the bucket name when using
+// path-style addressing.
+func (p *Propolis) keyPath(key string) string {
+	if p.PathStyle {
+		return "/" + p.Bucket + path.Join("/", key)
+	}
+	return path.Join("/", key)
+}
+
+// is this header included in the request signature?
+func signedHeader(key string) bool {
+	for _, name := range AWS_HEADERS {
+		if strings.ToLower(key) == strings.ToLower(name) {
+			return true
+		}
+	}
+	for _, prefix := range AWS_HEADER_PREFIXES {
+		if strings.HasPrefix(strings.ToLower(key), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
 
+// Gather the canonical string to be signed for a request. date is the
+// Date header for a normal request, or the expiration time for a
+// pre-signed url.
+func (p *Propolis) StringToSign(req *http.Request, date string) (msg string) {
 	// method
-	msg := req.Method + "\n"
+	msg = req.Method + "\n"
 
 	// md5sum
 	msg += req.Header.Get("Content-MD5") + "\n"
@@ -499,22 +1378,53 @@ func (p *Propolis) SignRequest(req *http.Request) {
 	msg += req.Header.Get("Content-Type") + "\n"
 
 	// date
-	msg += req.Header.Get("Date") + "\n"
-
-	// add headers
-	for _, key := range AWS_HEADERS {
-		if value := req.Header.Get(key); value != "" {
-			msg += strings.ToLower(key) + ":" + value + "\n"
+	msg += date + "\n"
+
+	// add headers: the fixed list plus any with a signed prefix,
+	// sorted by their lowercase names. The prefixes overlap the fixed
+	// list, so each header is checked once.
+	var keys []string
+	for key := range req.Header {
+		if req.Header.Get(key) != "" && signedHeader(key) {
+			keys = append(keys, strings.ToLower(key))
 		}
 	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		msg += key + ":" + req.Header.Get(key) + "\n"
+	}
 
 	// resource: the path components should be URL-encoded, but not the slashes
 	u := new(url.URL)
-	u.Path = "/" + p.Bucket + req.URL.Path
+	u.Path = req.URL.Path
+	if !p.PathStyle {
+		u.Path = "/" + p.Bucket + u.Path
+	}
 	msg += u.String()
 
+	// followed by any sub-resources named in the query string
+	query := req.URL.Query()
+	separator := "?"
+	for _, name := range AWS_SUBRESOURCES {
+		values, present := query[name]
+		if !present {
+			continue
+		}
+		msg += separator + name
+		if len(values) > 0 && values[0] != "" {
+			msg += "=" + values[0]
+		}
+		separator = "&"
+	}
+	return
+}
+
+// Sign a canonical string with the current credentials, returning the
+// access key to present with the base64-encoded signature.
+func (p *Propolis) Sign(msg string) (key, signature string) {
 	// create the signature
-	hmac := hmac.NewSHA1([]byte(p.Secret))
+	key, secret, _ := p.Credentials()
+	hmac := hmac.NewSHA1([]byte(secret))
 	hmac.Write([]byte(msg))
 
 	// get a base64 encoding of the signature
@@ -522,7 +1432,6 @@ func (p *Propolis) SignRequest(req *http.Request) {
 	encoder := base64.NewEncoder(base64.StdEncoding, &encoded)
 	encoder.Write(hmac.Sum())
 	encoder.Close()
-	signature := encoded.String()
-
-	req.Header.Set("Authorization", "AWS "+p.Key+":"+signature)
+	signature = encoded.String()
+	return
 }
@@ -0,0 +1,132 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of request building and signing
+
+package propolis
+
+import (
+	"exec"
+	"fmt"
+	"http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Over https, a bucket name with dots is named in the url path, and
+// the signature covers the same resource either way.
+func TestDottedBucketPathStyle(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	for _, test := range []struct {
+		bucket    string
+		secure    bool
+		pathstyle bool
+		url       string
+	}{
+		{"plain-bucket", true, false, "https://plain-bucket.s3.amazonaws.com/dir/file.txt"},
+		{"my.bucket.com", false, false, "http://my.bucket.com.s3.amazonaws.com/dir/file.txt"},
+		{"my.bucket.com", true, true, "https://s3.amazonaws.com/my.bucket.com/dir/file.txt"},
+	} {
+		c := testConfig(root)
+		c.Bucket = test.bucket
+		c.Secure = test.secure
+		p, err := newTestPropolis(c)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if p.PathStyle != test.pathstyle {
+			t.Errorf("%s: PathStyle is %v", test.bucket, p.PathStyle)
+		}
+
+		elt := p.NewFile("dir/file.txt", true, true)
+		if u := elt.Url.String(); u != test.url {
+			t.Errorf("%s: url is %s, expected %s", test.bucket, u, test.url)
+		}
+
+		req, err := http.NewRequest("GET", elt.Url.String(), nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		resource := "\n/" + test.bucket + "/dir/file.txt"
+		if msg := p.StringToSign(req, "date"); !strings.HasSuffix(msg, resource) {
+			t.Errorf("%s: string to sign %q does not end with resource %q", test.bucket, msg, resource[1:])
+		}
+	}
+}
+
+// the modification time given to the file uploaded by the helper
+const helper_mtime = 1300000000123456789
+
+// Run in a child process by TestMtimeTimeZones: push a file with a
+// known mtime and print the X-Amz-Meta-Mtime header it was stored with.
+func TestMtimeHelper(t *testing.T) {
+	if os.Getenv("PROPOLIS_MTIME_HELPER") == "" {
+		return
+	}
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+
+	name := filepath.Join(root, "file.txt")
+	writeFile(t, name, "contents\n")
+	if err := os.Chtimes(name, helper_mtime, helper_mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	runSync(t, newFakePropolis(t, testConfig(root), s), true)
+	if obj := s.get("file.txt"); obj != nil {
+		fmt.Printf("mtime: %s\n", obj.header.Get("X-Amz-Meta-Mtime"))
+	}
+}
+
+// The mtime header of a file is the same no matter what time zone the
+// machine that uploaded it is in. The local time zone is only read
+// once, so each zone gets its own process.
+func TestMtimeTimeZones(t *testing.T) {
+	var headers []string
+	for _, zone := range []string{"America/Los_Angeles", "Asia/Tokyo"} {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMtimeHelper")
+		cmd.Env = append(os.Environ(), "PROPOLIS_MTIME_HELPER=1", "TZ="+zone)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("running helper in %s: %v\n%s", zone, err, out)
+		}
+		header := ""
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "mtime: ") {
+				header = line[len("mtime: "):]
+			}
+		}
+		if mtime, ok := parseMtime(header); !ok || mtime != helper_mtime {
+			t.Errorf("%s: mtime header %q does not give %d", zone, header, int64(helper_mtime))
+		}
+		headers = append(headers, header)
+	}
+	if headers[0] != headers[1] {
+		t.Errorf("mtime headers differ between time zones: %q and %q", headers[0], headers[1])
+	}
+	if expected := formatMtime(helper_mtime); headers[0] != expected {
+		t.Errorf("mtime header is %q, expected %q", headers[0], expected)
+	}
+}
@@ -0,0 +1,103 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Helpers shared by the tests
+
+package propolis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a config for syncing root with a memory cache and made-up credentials
+func testConfig(root string) *Config {
+	return &Config{
+		Bucket:       "propolis-test",
+		LocalRoot:    root,
+		Key:          "test-key",
+		Secret:       "test-secret",
+		CacheBackend: "memory",
+		Concurrent:   4,
+	}
+}
+
+// Create a propolis instance whose methods can be called directly,
+// outside of a sync.
+func newTestPropolis(c *Config) (p *Propolis, err os.Error) {
+	if p, err = New(c); err != nil {
+		return
+	}
+	p.report = newReport()
+	p.caseClaims = make(map[string]string)
+	return
+}
+
+// a scratch directory for a test to remove when it is done
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "propolis-test-")
+	if err != nil {
+		t.Fatalf("creating scratch directory: %v", err)
+	}
+	return dir
+}
+
+// write a local file, creating its directory as needed
+func writeFile(t *testing.T, name, contents string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("creating directory for %s: %v", name, err)
+	}
+	if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+}
+
+// read a local file, or "" if it is not there
+func readFile(name string) string {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	return string(contents)
+}
+
+// a propolis instance that syncs with a fake server
+func newFakePropolis(t *testing.T, c *Config, s *fakeS3) *Propolis {
+	p, err := newTestPropolis(c)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.connect(p)
+	return p
+}
+
+// sync in one direction, failing the test on any error
+func runSync(t *testing.T, p *Propolis, push bool) *Report {
+	report, err := p.Sync(push)
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	for _, e := range report.Errors {
+		t.Errorf("syncing %s: %v", e.Path, e.Error)
+	}
+	return report
+}
@@ -0,0 +1,114 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Temporary storage for downloads
+
+package propolis
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// bytes available to an unprivileged user on the file system holding path
+func freeSpace(path string) (free int64, err os.Error) {
+	var buf syscall.Statfs_t
+	if errno := syscall.Statfs(path, &buf); errno != 0 {
+		return 0, os.NewSyscallError("statfs", errno)
+	}
+	return int64(buf.Bavail) * int64(buf.Bsize), nil
+}
+
+// Make sure there is room to download size bytes into tmp, counting
+// any partial download already there, and then to move the result to
+// target if it is on a different file system. Fails with the shortfall
+// rather than running out of space part way through.
+func checkSpace(tmp, target string, size int64) (err os.Error) {
+	need := size
+	if partial, er := os.Stat(tmp); er == nil {
+		need -= partial.Size
+	}
+	dir := filepath.Dir(tmp)
+	if err = checkFree(dir, need); err != nil {
+		return
+	}
+
+	// the finished file is copied if it cannot be renamed into place
+	var from, to *os.FileInfo
+	if from, err = os.Stat(dir); err != nil {
+		return
+	}
+	if to, err = os.Stat(filepath.Dir(target)); err != nil {
+		return
+	}
+	if from.Dev != to.Dev {
+		err = checkFree(filepath.Dir(target), size)
+	}
+	return
+}
+
+func checkFree(dir string, need int64) (err os.Error) {
+	var free int64
+	if free, err = freeSpace(dir); err != nil {
+		return
+	}
+	if free < need {
+		return fmt.Errorf("not enough free space in %s: need %d bytes, have %d (%d short)",
+			dir, need, free, need-free)
+	}
+	return
+}
+
+// Rename src to dst, copying it if they are on different file systems
+// (as they may be with -tmp-dir). The copy goes into a temporary file
+// next to dst first, so dst is still replaced atomically.
+func moveFile(src, dst string) (err os.Error) {
+	if err = os.Rename(src, dst); err == nil {
+		return
+	}
+	if e, ok := err.(*os.LinkError); !ok || e.Error != os.Errno(syscall.EXDEV) {
+		return
+	}
+
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = ioutil.TempFile(filepath.Dir(dst), ".propolis-"); err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if er := out.Close(); err == nil {
+		err = er
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,89 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// FIFOs, sockets, and device files
+
+package propolis
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Is this a named pipe, socket, or device node? With -special-files
+// these are stored as empty markers, like directories, and the device
+// number of a device node goes in a metadata header.
+func isSpecial(info *os.FileInfo) bool {
+	return info.IsFifo() || info.IsSocket() || info.IsChar() || info.IsBlock()
+}
+
+// split a device number into major and minor numbers (Linux encoding)
+func devMajor(dev uint64) uint64 {
+	return dev>>8&0xfff | dev>>32&^0xfff
+}
+
+func devMinor(dev uint64) uint64 {
+	return dev&0xff | dev>>12&^0xff
+}
+
+func makeDev(major, minor uint64) uint64 {
+	return minor&0xff | major&0xfff<<8 | minor&^0xff<<12 | major&^0xfff<<32
+}
+
+// the X-Amz-Meta-Rdev header value for a device number
+func formatRdev(dev uint64) string {
+	return fmt.Sprintf("%d,%d", devMajor(dev), devMinor(dev))
+}
+
+func parseRdev(line string) (dev uint64, ok bool) {
+	var major, minor uint64
+	if n, _ := fmt.Sscanf(line, "%d,%d", &major, &minor); n != 2 {
+		return 0, false
+	}
+	return makeDev(major, minor), true
+}
+
+// Recreate a special file from its marker. Device nodes can normally
+// only be made by root, so a failure to make one is a warning and the
+// file is skipped.
+func (p *Propolis) makeSpecial(elt *File) (err os.Error) {
+	info := elt.CacheInfo
+
+	// replace whatever is there now
+	os.Remove(elt.LocalPath)
+
+	var errno int
+	if info.IsFifo() {
+		errno = syscall.Mkfifo(elt.LocalPath, info.Mode&07777)
+	} else {
+		errno = syscall.Mknod(elt.LocalPath, info.Mode, int(info.Rdev))
+	}
+	if errno == 0 {
+		return
+	}
+	err = &os.PathError{"mknod", elt.LocalPath, os.Errno(errno)}
+	if errno != syscall.EPERM {
+		return
+	}
+	p.Log.Warnf("Skipping special file that cannot be created [%s]: %v\n", elt.ServerPath, err)
+	p.recordSkipped(elt)
+	return errSkipped
+}
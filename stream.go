@@ -0,0 +1,169 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Streaming single objects to and from the server
+
+package propolis
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// Upload everything from src as a single object. The local file
+// system and cache are not involved.
+func (p *Propolis) Put(key string, src io.Reader) (err os.Error) {
+	if p.Anonymous {
+		return errAnonymousPush
+	}
+
+	// the contents are an ordinary file owned by this process;
+	// the key decides the content type
+	info := &os.FileInfo{
+		Name:     path.Base(key),
+		Mode:     s_ifreg | 0644,
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+		Mtime_ns: time.Nanoseconds(),
+	}
+	info.Atime_ns = info.Mtime_ns
+	info.Ctime_ns = info.Mtime_ns
+
+	elt := new(File)
+	elt.ServerPath = key
+	elt.FullServerPath = path.Join("/", p.Bucket, key)
+	elt.Url = p.keyUrl(key, nil)
+	elt.Push = true
+	elt.LocalInfo = info
+	return p.UploadStream(elt, src)
+}
+
+// Upload the contents of src as elt, for sources that cannot be read
+// twice or do not know their length, like pipes or generated
+// contents. elt.LocalInfo supplies the metadata, and its size is set
+// once everything has been read. Regular files use UploadFile instead.
+func (p *Propolis) UploadStream(elt *File, src io.Reader) (err os.Error) {
+	var sum []byte
+	if elt.Contents, elt.UploadSize, sum, err = p.bufferContents(src); err != nil {
+		return
+	}
+	elt.LocalInfo.Size = elt.UploadSize
+	elt.LocalHashHex = hex.EncodeToString(sum)
+	elt.LocalHashBase64 = base64.StdEncoding.EncodeToString(sum)
+
+	p.Log.Debugf("Uploading [%s] (%d bytes)\n", elt.ServerPath, elt.UploadSize)
+	return p.UploadRequest(elt)
+}
+
+// Read everything from src, since S3 needs the length and md5 hash
+// before an upload starts. Up to small_file_size bytes are kept in
+// memory, and anything longer is spooled to a temporary file that is
+// removed when the contents are closed.
+func (p *Propolis) bufferContents(src io.Reader) (contents io.ReadCloser, size int64, sum []byte, err os.Error) {
+	hash := md5Hasher.New()
+	buffer := new(bytes.Buffer)
+	if size, err = p.copyBuffer(io.MultiWriter(buffer, hash), io.LimitReader(src, small_file_size+1)); err != nil {
+		return
+	}
+	if size <= small_file_size {
+		return ioutil.NopCloser(buffer), size, hash.Sum(), nil
+	}
+
+	// too big for memory
+	var fp *os.File
+	if fp, err = ioutil.TempFile(p.TmpDir, "propolis"); err != nil {
+		return
+	}
+	var n int64
+	if _, err = buffer.WriteTo(fp); err == nil {
+		if n, err = p.copyBuffer(io.MultiWriter(fp, hash), src); err == nil {
+			_, err = fp.Seek(0, os.SEEK_SET)
+		}
+	}
+	if err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return
+	}
+	return &tempFile{fp}, size + n, hash.Sum(), nil
+}
+
+// a temporary file that is removed when it is closed
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() os.Error {
+	err := t.File.Close()
+	os.Remove(t.File.Name())
+	return err
+}
+
+// Download a single object and write its contents to dst, which is
+// closed when the download finishes. Compressed objects are
+// decompressed unless p.KeepGzip is set.
+func (p *Propolis) Get(key string, dst io.WriteCloser) (err os.Error) {
+	elt := new(File)
+	elt.ServerPath = key
+	elt.FullServerPath = path.Join("/", p.Bucket, key)
+	elt.Url = p.keyUrl(key, nil)
+
+	p.Log.Debugf("Downloading [%s]\n", key)
+	w := &streamWriter{p: p, elt: elt, dst: dst}
+	if err = p.DownloadRequest(elt, w); err != nil {
+		return
+	}
+	return w.err
+}
+
+// Picks the final destination once the response headers have said
+// whether the contents are compressed.
+type streamWriter struct {
+	p   *Propolis
+	elt *File
+	dst io.WriteCloser
+	w   io.WriteCloser
+	err os.Error // from closing the destination
+}
+
+func (s *streamWriter) Write(buf []byte) (int, os.Error) {
+	if s.w == nil {
+		if s.elt.Gzip && !s.p.KeepGzip {
+			s.w = gunzipWriter(s.dst)
+		} else {
+			s.w = s.dst
+		}
+	}
+	return s.w.Write(buf)
+}
+
+func (s *streamWriter) Close() os.Error {
+	if s.w == nil {
+		s.w = s.dst
+	}
+	s.err = s.w.Close()
+	return s.err
+}
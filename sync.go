@@ -20,20 +20,23 @@
 
 // Synchronization logic
 
-package main
+package propolis
 
 import (
 	"bytes"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
-	"fmt"
+	"exp/norm"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 	"url"
 )
 
@@ -43,78 +46,360 @@ type File struct {
 	FullServerPath string   // full path on the server including bucket prefix
 	Url            *url.URL // url to access this item
 
-	Push      bool // should local state override server state?
-	Immediate bool // should changes bypass the normal delay?
+	Push      bool   // should local state override server state?
+	Immediate bool   // should changes bypass the normal delay?
+	Reason    string // why this file needs updating (for reports)
 
 	LocalInfo       *os.FileInfo // metadata found locally
 	LocalHashHex    string       // md5 hash of local file in hex
 	LocalHashBase64 string       // md5 hash of local file in base64
 	CacheInfo       *os.FileInfo // metadata found in cache
 	CacheHashHex    string       // cached md5 hash of remote file in hex
+	CacheSynced     int64        // when the cache entry was last synced (ns)
 	ServerHashHex   string       // md5 hash of remote file in hex
 	ServerSize      int64        // size as reported by a server scan
+	ServerModified  int64        // last modified time (ns) as reported by a server scan
+	UploadSize      int64        // size of the contents as uploaded
+	Gzip            bool         // contents are stored compressed
+	ContentType     string       // MIME type, if found by sniffing the contents
+
+	Xattrs     map[string]string // extended attributes to store or restore
+	Metadata   map[string]string // user metadata from a .meta file to store or restore
+	LinkTarget string            // server path of the file this is a hard link to
+
+	LocalChecksumHex string // second checksum (see Config.Checksum) of the local contents as stored
+	CacheChecksumHex string // second checksum recorded in the cache or by the server
+
+	ServerETag string // the server's ETag when it is not the md5 hash (objects stored in parts)
 
 	Contents io.ReadCloser
+
+	Retries int // times this file was requeued because it changed while being read
+
+	actions []*Action // actions announced so far, for the manifest
+
+	sampleDrawn bool // has -verify-sample decided about this file yet?
+	sampled     bool // and was it chosen?
 }
 
 const empty_file_md5_hash = "d41d8cd98f00b204e9800998ecf8427e"
 
+// files up to this size are read into memory once instead of being
+// read twice (once for the md5 hash and again for the upload)
+const small_file_size = 1024 * 1024
+
+// serializes output from concurrent workers
+var outputLock sync.Mutex
+
+// returned when a file cannot be read and should be left alone
+var errSkipped = os.NewError("file skipped")
+
+// returned when a file changes while it is being hashed
+var errFileChanged = os.NewError("file changed while being read")
+
+// times to wait for a file that keeps changing before giving up on it
+const changed_file_retries = 3
+
+// Decide if a local read error means the file should be skipped
+// rather than treated as a failure: it is unreadable, or it vanished
+// between the scan and the sync. Prints a warning and records it.
+func (p *Propolis) skipUnreadable(elt *File, err os.Error) os.Error {
+	pe, ok := err.(*os.PathError)
+	if !ok || (pe.Error != os.EACCES && pe.Error != os.ENOENT) {
+		return err
+	}
+	p.recordSkipped(elt)
+	if pe.Error == os.ENOENT {
+		p.Log.Warnf("Skipping vanished file [%s]\n", elt.ServerPath)
+	} else {
+		p.Log.Warnf("Skipping unreadable file [%s]\n", elt.ServerPath)
+	}
+	return errSkipped
+}
+
+// Report an action on a file. The human-readable message goes to
+// p.Log, and unless action is "" the action is recorded in the
+// report and passed to p.OnAction.
+func (p *Propolis) Announce(elt *File, action string, format string, args ...interface{}) {
+	p.Log.Infof(format, args...)
+	if action == "" {
+		return
+	}
+
+	// report the size of whichever side is the source of truth
+	var size int64
+	switch {
+	case elt.Push && elt.LocalInfo != nil:
+		size = elt.LocalInfo.Size
+	case !elt.Push && elt.CacheInfo != nil:
+		size = elt.CacheInfo.Size
+	case elt.LocalInfo != nil:
+		size = elt.LocalInfo.Size
+	case elt.CacheInfo != nil:
+		size = elt.CacheInfo.Size
+	}
+
+	msg := &Action{
+		Action: action,
+		Path:   elt.ServerPath,
+		Size:   size,
+		Reason: elt.Reason,
+	}
+	p.recordAction(msg)
+	elt.actions = append(elt.actions, msg)
+	if p.OnAction != nil {
+		outputLock.Lock()
+		defer outputLock.Unlock()
+		p.OnAction(msg)
+	}
+}
+
+// Do the local contents match the cached ones? When a second checksum
+// is kept, it must match too, when both sides have one.
+func (p *Propolis) sameContents(elt *File) bool {
+	if elt.LocalHashHex != elt.CacheHashHex {
+		return false
+	}
+	if p.Hasher != nil && elt.LocalChecksumHex != "" && elt.CacheChecksumHex != "" {
+		return elt.LocalChecksumHex == elt.CacheChecksumHex
+	}
+	return true
+}
+
+// name the first metadata field that differs between two versions of a file
+func changeReason(src, dst *os.FileInfo) string {
+	switch {
+	case src == nil:
+		return "missing"
+	case dst == nil:
+		return "new"
+	case src.Mode != dst.Mode:
+		return "mode"
+	case src.Uid != dst.Uid:
+		return "uid"
+	case src.Gid != dst.Gid:
+		return "gid"
+	case src.Size != dst.Size:
+		return "size"
+	case src.Mtime_ns != dst.Mtime_ns:
+		return "mtime"
+	}
+	return ""
+}
+
+// The key to use for a local name. With -normalize-unicode, names are
+// stored in NFC form, so the NFD names a Mac produces and the NFC names
+// most other systems use end up as one key. Downloads use the key as
+// the local name, so files come back in NFC form.
+func (p *Propolis) keyName(name string) string {
+	if p.NormalizeUnicode {
+		return norm.NFC.String(name)
+	}
+	return name
+}
+
 func (p *Propolis) NewFile(pathname string, push bool, immediate bool) (elt *File) {
 	// form all the different file name variations we need
 	elt = new(File)
-	elt.LocalPath = filepath.Join(p.LocalRoot, pathname)
-	elt.ServerPath = path.Join(p.BucketRoot, pathname)
+	elt.LocalPath = filepath.Join(p.LocalRoot, filepath.FromSlash(pathname))
+	elt.ServerPath = path.Join(p.BucketRoot, p.keyName(pathname))
 	elt.FullServerPath = path.Join("/", p.Bucket, elt.ServerPath)
 	elt.Url = new(url.URL)
 	*elt.Url = *p.Url
-	elt.Url.Path = path.Join("/", elt.ServerPath)
+	elt.Url.Path = p.keyPath(elt.ServerPath)
 	elt.Push = push
 	elt.Immediate = immediate
 	return
 }
 
-func (p *Propolis) NewFileServer(servername string, push bool) (elt *File) {
+func (p *Propolis) NewFileServer(servername string, push bool, immediate bool) (elt *File) {
 	root := p.BucketRoot
 	if root != "" {
 		root += "/"
 	}
 	if strings.HasPrefix(servername, root) {
-		return p.NewFile(servername[len(root):], push, true)
+		return p.NewFile(servername[len(root):], push, immediate)
 	}
 	panic("NewFileServer: path with incorrect prefix [" + servername + "]")
 }
 
+// Get local file metadata. With -follow-symlinks this describes the
+// file a link points to, unless the link is dangling.
+func (p *Propolis) LocalStat(name string) (info *os.FileInfo, err os.Error) {
+	if p.Follow {
+		if info, err = os.Stat(name); err == nil {
+			return
+		}
+	}
+	return os.Lstat(name)
+}
+
+// Should the contents of a file be checked even though its metadata
+// matches the cache? Always with -paranoid, otherwise only if the cache
+// entry has not been confirmed since p.ResyncCutoff.
+func (p *Propolis) verify(elt *File) bool {
+	if p.NoHash {
+		return false
+	}
+	return p.Paranoid || p.ResyncCutoff > 0 && elt.CacheSynced < p.ResyncCutoff || p.sampled(elt)
+}
+
+// Remove dir if a delete left it empty, then its parents, stopping at
+// the first directory that is not empty and never removing LocalRoot.
+// Only empty directories can be removed, so a directory holding files
+// that are excluded from the sync stays put. With -directories, a
+// directory that is still tracked on the server is kept as well.
+func (p *Propolis) pruneEmptyDirs(dir string) {
+	root := filepath.Clean(p.LocalRoot)
+	for {
+		dir = filepath.Clean(dir)
+		rel, ok := relativePath(root, dir)
+		if !ok || rel == "" {
+			return
+		}
+		if p.Directories {
+			if info, _, _, err := p.Db.Get(p.NewFile(rel, false, false).ServerPath); err != nil || info != nil {
+				return
+			}
+		}
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		p.Log.Infof("Removed empty directory [%s]\n", dir)
+		dir = filepath.Dir(dir)
+	}
+}
+
+// the slash-separated path of name inside root ("" for root itself),
+// or false if it is not inside root
+func relativePath(root, name string) (rel string, ok bool) {
+	if name == root {
+		return "", true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	return filepath.ToSlash(name[len(prefix):]), true
+}
+
+// Is this a kind of file that is synced? Regular files and symlinks
+// always are; directories and special files only when asked for.
+func (p *Propolis) tracked(info *os.FileInfo) bool {
+	switch {
+	case info.IsRegular(), info.IsSymlink():
+		return true
+	case info.IsDirectory():
+		return p.Directories
+	case isSpecial(info):
+		return p.SpecialFiles
+	}
+	return false
+}
+
+// Is the local file for a server path gone? Paths outside the bucket
+// root have no local file to check.
+func (p *Propolis) missingLocally(serverpath string) bool {
+	root := p.BucketRoot
+	if root != "" {
+		root += "/"
+	}
+	if !strings.HasPrefix(serverpath, root) {
+		return false
+	}
+	_, err := os.Lstat(p.NewFileServer(serverpath, true, false).LocalPath)
+	return err != nil
+}
+
+// Put a file that changed while it was being read back in the queue,
+// without bypassing the delay, so it is tried again once it settles.
+// Returns false if it has already been tried too many times.
+func (p *Propolis) requeueChanged(elt *File) bool {
+	if elt.Retries >= changed_file_retries {
+		return false
+	}
+	p.Log.Infof("Changed while reading, will retry [%s]\n", elt.ServerPath)
+	retry := &File{
+		LocalPath:      elt.LocalPath,
+		ServerPath:     elt.ServerPath,
+		FullServerPath: elt.FullServerPath,
+		Url:            elt.Url,
+		Push:           elt.Push,
+		ServerHashHex:  elt.ServerHashHex,
+		ServerSize:     elt.ServerSize,
+		ServerModified: elt.ServerModified,
+		Retries:        elt.Retries + 1,
+	}
+	p.enqueue(retry, false)
+	return true
+}
+
 // Sync a single file between the local file system and the server.
 func (p *Propolis) SyncFile(elt *File) (err os.Error) {
+	// unreadable files have already been reported
+	defer func() {
+		if err == errSkipped {
+			err = nil
+		}
+	}()
+
 	// see what is in the local file system
 	var er os.Error
 	if elt.LocalInfo == nil {
-		elt.LocalInfo, er = os.Lstat(elt.LocalPath)
+		elt.LocalInfo, er = p.LocalStat(elt.LocalPath)
 		if er != nil {
 			elt.LocalInfo = nil
 		}
 	}
 	if elt.LocalInfo != nil {
 		elt.LocalInfo.Name = elt.ServerPath
+
+		// directories are tracked as empty markers, so the size the
+		// file system reports for them means nothing
+		if elt.LocalInfo.IsDirectory() {
+			elt.LocalInfo.Size = 0
+		}
 	}
 
-	// see what is on the server
-	if err = p.LstatServer(elt); err != nil {
+	// see what is on the server; a bidirectional sync also picks the
+	// direction here
+	if p.Bidirectional {
+		var proceed bool
+		if proceed, err = p.reconcile(elt); err != nil || !proceed {
+			return
+		}
+	} else if err = p.LstatServer(elt); err != nil {
 		return
 	}
 
+	// a sampled file's server copy is checked against the cache too
+	if p.VerifyServer && elt.CacheInfo != nil && p.sampled(elt) {
+		if err = p.checkSampledServer(elt); err != nil {
+			return
+		}
+	}
+
 	// decide if anything needs updating
 	if elt.LocalInfo == nil && elt.CacheInfo == nil {
 		// nothing to do
-		fmt.Printf("No such file locally or on server [%s]\n", elt.ServerPath)
+		p.Announce(elt, "", "No such file locally or on server [%s]\n", elt.ServerPath)
 		return
 	}
 
 	if elt.Push {
 		switch {
 		case elt.LocalInfo == nil && elt.CacheInfo != nil:
+			if !p.Delete {
+				p.Announce(elt, "", "Keeping remote file missing locally [%s]\n", elt.ServerPath)
+				return
+			}
+
 			// delete the remote file
-			fmt.Printf("Deleting remote file [%s]\n", elt.ServerPath)
+			elt.Reason = "deleted"
+			p.Announce(elt, "delete", "Deleting remote file [%s]\n", elt.ServerPath)
 			if p.Practice {
 				return
 			}
@@ -122,7 +407,7 @@ func (p *Propolis) SyncFile(elt *File) (err os.Error) {
 			// delete the file before the metadata: if something goes wrong, the
 			// delete request will be repeated on reload, but that's better than
 			// leaving a dead file on the server and forgetting about it
-			if err = p.DeleteRequest(elt); err != nil {
+			if err = p.deleteRemote(elt); err != nil {
 				return
 			}
 			// delete the cache entry
@@ -137,40 +422,71 @@ func (p *Propolis) SyncFile(elt *File) (err os.Error) {
 			elt.LocalInfo.Size != elt.CacheInfo.Size ||
 			elt.LocalInfo.Mtime_ns != elt.CacheInfo.Mtime_ns):
 			// remote update needed
+			elt.Reason = changeReason(elt.LocalInfo, elt.CacheInfo)
 
-			err = p.UploadFile(elt)
+			if err = p.UploadFile(elt); err != nil {
+				return
+			}
+			err = p.purgeNoncurrent(elt)
 
-		case p.Paranoid:
+		case p.verify(elt):
 			// compute the local md5 hash
 			if err = p.GetMd5(elt); err != nil {
 				return
 			}
 
 			// do they match?
-			if elt.LocalHashHex == elt.CacheHashHex {
-				fmt.Printf("No change [%s]\n", elt.ServerPath)
+			if p.sameContents(elt) {
+				p.Announce(elt, "", "No change [%s]\n", elt.ServerPath)
 				elt.Contents.Close()
-				return
+				return p.SetFileInfo(elt, true)
 			}
 
-			fmt.Printf("MD5 mismatch, uploading [%s]\n", elt.ServerPath)
+			elt.Reason = "md5"
+			p.warnSampled(elt)
+			p.Announce(elt, "", "MD5 mismatch, uploading [%s]\n", elt.ServerPath)
 			if err = p.UploadFile(elt); err != nil {
 				return
 			}
+			err = p.purgeNoncurrent(elt)
 		}
 	} else {
 		// this is a pull request
 		switch {
+		case elt.CacheInfo != nil && !p.tracked(elt.CacheInfo):
+			// markers left by -directories or -special-files are
+			// only honored with them
+			p.Log.Debugf("Ignoring untracked marker [%s]\n", elt.ServerPath)
+
 		case elt.LocalInfo != nil && elt.CacheInfo == nil:
+			if !p.tracked(elt.LocalInfo) || elt.LocalPath == p.LocalRoot {
+				p.Log.Debugf("Ignoring untracked file [%s]\n", elt.ServerPath)
+				return
+			}
+			if !p.Delete {
+				p.Announce(elt, "", "Keeping local file missing on server [%s]\n", elt.ServerPath)
+				return
+			}
+
 			// delete the local file
-			fmt.Printf("Deleting local file [%s]\n", elt.ServerPath)
+			elt.Reason = "deleted"
+			p.Announce(elt, "delete", "Deleting local file [%s]\n", elt.ServerPath)
 			if p.Practice {
 				return
 			}
 
-			if err = os.Remove(elt.LocalPath); err != nil {
+			if err = p.removeLocal(elt); err != nil {
+				// a directory may still hold files that are kept, or
+				// that are deleted later in this pass
+				if elt.LocalInfo.IsDirectory() {
+					p.Log.Infof("Keeping non-empty directory [%s]\n", elt.ServerPath)
+					err = nil
+				}
 				return
 			}
+			if p.PruneEmptyDirs {
+				p.pruneEmptyDirs(filepath.Dir(elt.LocalPath))
+			}
 
 		case (elt.LocalInfo == nil && elt.CacheInfo != nil ||
 			elt.LocalInfo.Mode != elt.CacheInfo.Mode ||
@@ -179,10 +495,11 @@ func (p *Propolis) SyncFile(elt *File) (err os.Error) {
 			elt.LocalInfo.Size != elt.CacheInfo.Size ||
 			elt.LocalInfo.Mtime_ns != elt.CacheInfo.Mtime_ns):
 			// local update needed
+			elt.Reason = changeReason(elt.CacheInfo, elt.LocalInfo)
 
 			err = p.DownloadFile(elt)
 
-		case p.Paranoid:
+		case p.verify(elt):
 			// compute the local md5 hash
 			if err = p.GetMd5(elt); err != nil {
 				return
@@ -190,13 +507,15 @@ func (p *Propolis) SyncFile(elt *File) (err os.Error) {
 			elt.Contents.Close()
 
 			// do they match?
-			if elt.LocalHashHex == elt.CacheHashHex {
-				fmt.Printf("No change [%s]\n", elt.ServerPath)
-				return
+			if p.sameContents(elt) {
+				p.Announce(elt, "", "No change [%s]\n", elt.ServerPath)
+				return p.SetFileInfo(elt, true)
 			}
 
 			// download if different
-			fmt.Printf("MD5 mismatch, downloading [%s]\n", elt.ServerPath)
+			elt.Reason = "md5"
+			p.warnSampled(elt)
+			p.Announce(elt, "", "MD5 mismatch, downloading [%s]\n", elt.ServerPath)
 			if err = p.DownloadFile(elt); err != nil {
 				return
 			}
@@ -206,6 +525,93 @@ func (p *Propolis) SyncFile(elt *File) (err os.Error) {
 	return
 }
 
+// Classify a single file without issuing any server requests.
+// Returns "local-only", "remote-only", "different", or "" if the
+// file appears to be in sync.
+func (p *Propolis) CompareFile(elt *File) (status string, err os.Error) {
+	// see what is in the local file system
+	if elt.LocalInfo == nil {
+		if info, er := p.LocalStat(elt.LocalPath); er == nil {
+			elt.LocalInfo = info
+		}
+	}
+	if elt.LocalInfo != nil && elt.LocalInfo.IsDirectory() {
+		elt.LocalInfo.Size = 0
+	}
+
+	// ignore the root and kinds of files we don't track
+	if elt.LocalInfo != nil && (elt.LocalPath == p.LocalRoot || !p.tracked(elt.LocalInfo)) {
+		elt.LocalInfo = nil
+	}
+
+	// see what the cache knows, but do not ask the server
+	if elt.CacheInfo == nil {
+		if err = p.GetFileInfo(elt); err != nil {
+			return
+		}
+	}
+	remote := elt.CacheInfo != nil || elt.ServerHashHex != ""
+
+	switch {
+	case elt.LocalInfo == nil && !remote:
+		return "", nil
+	case elt.LocalInfo == nil:
+		return "remote-only", nil
+	case !remote:
+		return "local-only", nil
+	case elt.CacheInfo == nil:
+		// only the scan results are available, so compare sizes
+		if elt.LocalInfo.Size != elt.ServerSize {
+			return "different", nil
+		}
+		return "", nil
+	case changeReason(elt.LocalInfo, elt.CacheInfo) != "":
+		return "different", nil
+	case p.verify(elt):
+		if err = p.GetMd5(elt); err != nil {
+			return
+		}
+		elt.Contents.Close()
+		if !p.sameContents(elt) {
+			return "different", nil
+		}
+	}
+	return "", nil
+}
+
+// Start a status collector. It accepts the same requests as the
+// queue returned by StartQueue, but instead of syncing each file
+// it records how it differs in the report, grouped by category.
+func (p *Propolis) StartStatus() (check chan *File, quit chan chan bool) {
+	check = make(chan *File)
+	quit = make(chan chan bool)
+
+	go func() {
+		for {
+			select {
+			case elt := <-check:
+				status, err := p.CompareFile(elt)
+				if err == errSkipped {
+					continue
+				}
+				if err != nil {
+					p.recordError(elt, err)
+					continue
+				}
+				if status != "" {
+					p.recordStatus(elt, status)
+				}
+
+			case done := <-quit:
+				p.report.sortPaths()
+				done <- true
+				return
+			}
+		}
+	}()
+	return
+}
+
 func (p *Propolis) LstatServer(elt *File) (err os.Error) {
 	// check the cache (if we don't already have the entry loaded)
 	if elt.CacheInfo == nil {
@@ -215,14 +621,16 @@ func (p *Propolis) LstatServer(elt *File) (err os.Error) {
 	}
 
 	// should we issue a stat request to the server?
-	if elt.ServerHashHex != "" && elt.CacheInfo == nil {
+	// when pushing a file we have locally, the scan results are enough:
+	// UploadFile can compare the server hash with the local one
+	if elt.ServerHashHex != "" && elt.CacheInfo == nil && !(elt.Push && elt.LocalInfo != nil) {
 		if err = p.StatRequest(elt); err != nil {
 			return
 		}
 
 		// if we got a hit on the server, update the cache
 		if elt.CacheInfo != nil {
-			//fmt.Printf("Adding missing cache entry [%s]\n", elt.ServerPath)
+			p.Log.Debugf("Adding missing cache entry [%s]\n", elt.ServerPath)
 			if err = p.SetFileInfo(elt, false); err != nil {
 				return
 			}
@@ -231,11 +639,77 @@ func (p *Propolis) LstatServer(elt *File) (err os.Error) {
 	return
 }
 
+// copy from src to dst, reading BufferSize bytes at a time
+// (adapted from io.Copy)
+func (p *Propolis) copyBuffer(dst io.Writer, src io.Reader) (written int64, err os.Error) {
+	buf := make([]byte, p.BufferSize)
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[0:nr])
+			if nw > 0 {
+				written += int64(nw)
+			}
+			if ew != nil {
+				err = ew
+				break
+			}
+			if nr != nw {
+				err = io.ErrShortWrite
+				break
+			}
+		}
+		if er == os.EOF {
+			break
+		}
+		if er != nil {
+			err = er
+			break
+		}
+	}
+	return
+}
+
+// compute the md5 hash of a file's contents in hex
+func (p *Propolis) md5File(filename string) (hashHex string, err os.Error) {
+	var fp *os.File
+	if fp, err = os.Open(filename); err != nil {
+		return
+	}
+	defer fp.Close()
+	hash := md5Hasher.New()
+	if _, err = p.copyBuffer(hash, fp); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum()), nil
+}
+
 // open a file and compute an md5 hash for its contents
 // this fills in the hash values and sets the Contents field
 // to an open file handle ready to read the file
 func (p *Propolis) GetMd5(elt *File) (err os.Error) {
-	hash := md5.New()
+	md5sum := md5Hasher.New()
+	elt.UploadSize = elt.LocalInfo.Size
+
+	// a second checksum, if one is kept, sees the same bytes
+	var checksum hash.Hash
+	var hashes io.Writer = md5sum
+	if p.Hasher != nil {
+		checksum = p.Hasher.New()
+		hashes = io.MultiWriter(md5sum, checksum)
+	}
+
+	// look at the contents if the name does not give the type away
+	mimetype := contentType(elt.LocalInfo)
+	regular := elt.LocalInfo.IsRegular() && elt.LocalInfo.Size > 0
+	if p.SniffContentType && regular && mimetype == "" {
+		mimetype = sniffContentType(elt.LocalPath)
+		elt.ContentType = mimetype
+	}
+	if mimetype == "" {
+		mimetype = p.DefaultContentType
+	}
+	elt.Gzip = p.Gzip && regular && compressible(mimetype)
 
 	switch {
 	case elt.LocalInfo.IsSymlink():
@@ -244,32 +718,67 @@ func (p *Propolis) GetMd5(elt *File) (err os.Error) {
 
 		// read the link
 		if target, err = os.Readlink(elt.LocalPath); err != nil {
-			return
+			return p.skipUnreadable(elt, err)
 		}
 
 		// compute the hash
-		hash.Write([]byte(target))
+		hashes.Write([]byte(target))
 
 		// wrap it up as an io.ReadCloser
 		elt.Contents = ioutil.NopCloser(bytes.NewBufferString(target))
 
-	case elt.LocalInfo.Size == 0 || elt.LocalInfo.IsDirectory():
+	case elt.LocalInfo.Size == 0 || elt.LocalInfo.IsDirectory() || isSpecial(elt.LocalInfo):
 		// empty file
 		var buffer bytes.Buffer
 		elt.Contents = ioutil.NopCloser(&buffer)
 
-		// treat directories as empty files
+		// treat directories and special files as empty files
 		elt.LocalInfo.Size = 0
 
-	default:
-		// regular file
+	case elt.LocalInfo.Size <= small_file_size:
+		// small file: read it once and upload from memory
 		var fp *os.File
 		if fp, err = os.Open(elt.LocalPath); err != nil {
+			return p.skipUnreadable(elt, err)
+		}
+		var contents []byte
+		contents, err = ioutil.ReadAll(fp)
+		fp.Close()
+		if err != nil {
 			return
 		}
 
+		// the stored (and hashed) contents are compressed with -gzip
+		if elt.Gzip {
+			var buffer bytes.Buffer
+			if err = gzipTo(&buffer, bytes.NewBuffer(contents)); err != nil {
+				return
+			}
+			contents = buffer.Bytes()
+			elt.UploadSize = int64(len(contents))
+		}
+		hashes.Write(contents)
+		elt.Contents = ioutil.NopCloser(bytes.NewBuffer(contents))
+
+	default:
+		// large file: the hash must be known before the upload starts,
+		// so it takes two passes over the same open file
+		var fp *os.File
+		if fp, err = os.Open(elt.LocalPath); err != nil {
+			return p.skipUnreadable(elt, err)
+		}
+
 		// compute md5 hash
-		if _, err = io.Copy(hash, fp); err != nil {
+		if elt.Gzip {
+			// compress it once to get the hash and size, then
+			// again on the fly while uploading
+			counter := new(countingWriter)
+			err = gzipTo(io.MultiWriter(hashes, counter), fp)
+			elt.UploadSize = counter.n
+		} else {
+			_, err = p.copyBuffer(hashes, fp)
+		}
+		if err != nil {
 			fp.Close()
 			return
 		}
@@ -278,12 +787,35 @@ func (p *Propolis) GetMd5(elt *File) (err os.Error) {
 			fp.Close()
 			return
 		}
-		elt.Contents = fp
+		if elt.Gzip {
+			elt.Contents = gzipReader(fp)
+		} else {
+			elt.Contents = fp
+		}
+	}
+
+	// a file that is being written may have changed since it was
+	// hashed, and the upload would not match the hash
+	if elt.LocalInfo.IsRegular() {
+		if now, er := p.LocalStat(elt.LocalPath); er == nil &&
+			(now.Size != elt.LocalInfo.Size || now.Mtime_ns != elt.LocalInfo.Mtime_ns) {
+			elt.Contents.Close()
+			return errFileChanged
+		}
+	}
+
+	// gather metadata to be stored with the contents
+	if err = p.getLocalMetadata(elt); err != nil {
+		elt.Contents.Close()
+		return
 	}
 
 	// get the hash in hex
-	sum := hash.Sum()
+	sum := md5sum.Sum()
 	elt.LocalHashHex = hex.EncodeToString(sum)
+	if checksum != nil {
+		elt.LocalChecksumHex = hex.EncodeToString(checksum.Sum())
+	}
 
 	// and in base64
 	var buf bytes.Buffer
@@ -295,55 +827,223 @@ func (p *Propolis) GetMd5(elt *File) (err os.Error) {
 	return
 }
 
-func (p *Propolis) UploadFile(elt *File) (err os.Error) {
-	// clear cache entry first: if something fails, the update
-	// will be repeated on restart
-	if elt.CacheInfo != nil {
-		if err = p.DeleteFileInfo(elt); err != nil {
-			if elt.Contents != nil {
-				elt.Contents.Close()
-			}
+// Take the hashes of a file from the cache instead of reading it. This
+// is only done when nothing but the metadata (mode or owner) changed:
+// the size and modification time match the cache, there is no reason
+// to doubt the cached hash, and the stored form of the contents does
+// not depend on looking at them. elt.Contents is left nil; openContents
+// reads the file if it turns out to be needed after all.
+func (p *Propolis) cachedMd5(elt *File) (ok bool, err os.Error) {
+	switch {
+	case elt.CacheInfo == nil || elt.CacheHashHex == "" || p.verify(elt):
+		return
+	case !elt.LocalInfo.IsRegular() || !elt.CacheInfo.IsRegular():
+		return
+	case elt.LocalInfo.Size != elt.CacheInfo.Size || elt.LocalInfo.Mtime_ns != elt.CacheInfo.Mtime_ns:
+		return
+	case p.Gzip || p.SniffContentType && contentType(elt.LocalInfo) == "":
+		return
+	case p.Hasher != nil && elt.CacheChecksumHex == "":
+		return
+	}
+
+	var sum []byte
+	if sum, err = hex.DecodeString(elt.CacheHashHex); err != nil {
+		return false, nil
+	}
+	if err = p.getLocalMetadata(elt); err != nil {
+		return
+	}
+	elt.LocalHashHex = elt.CacheHashHex
+	elt.LocalHashBase64 = base64.StdEncoding.EncodeToString(sum)
+	elt.LocalChecksumHex = elt.CacheChecksumHex
+	elt.UploadSize = elt.LocalInfo.Size
+	p.Log.Debugf("Using cached hash [%s]\n", elt.ServerPath)
+	return true, nil
+}
+
+// Make sure elt.Contents is ready to upload, reading the file if its
+// hash came from the cache.
+func (p *Propolis) openContents(elt *File) (err os.Error) {
+	if elt.Contents != nil {
+		return
+	}
+	if p.NoHash {
+		return p.openUnhashed(elt)
+	}
+	return p.GetMd5(elt)
+}
+
+// Open a file for upload without hashing it, for -no-hash. The md5
+// hash is left empty (except for empty files, whose hash is known), so
+// the upload goes without a Content-MD5 header and UploadRequest takes
+// the hash from the ETag S3 returns.
+func (p *Propolis) openUnhashed(elt *File) (err os.Error) {
+	elt.LocalHashHex = ""
+	elt.LocalHashBase64 = ""
+	elt.LocalChecksumHex = ""
+	elt.UploadSize = elt.LocalInfo.Size
+
+	// look at the start of the file if the name does not give the type away
+	if p.SniffContentType && elt.LocalInfo.IsRegular() && elt.LocalInfo.Size > 0 && contentType(elt.LocalInfo) == "" {
+		elt.ContentType = sniffContentType(elt.LocalPath)
+	}
+
+	switch {
+	case elt.LocalInfo.IsSymlink():
+		var target string
+		if target, err = os.Readlink(elt.LocalPath); err != nil {
+			return p.skipUnreadable(elt, err)
+		}
+		elt.UploadSize = int64(len(target))
+		elt.Contents = ioutil.NopCloser(bytes.NewBufferString(target))
+
+	case elt.LocalInfo.Size == 0 || elt.LocalInfo.IsDirectory() || isSpecial(elt.LocalInfo):
+		// treat directories and special files as empty files
+		elt.LocalInfo.Size = 0
+		elt.UploadSize = 0
+		elt.LocalHashHex = empty_file_md5_hash
+		elt.Contents = ioutil.NopCloser(new(bytes.Buffer))
+
+	default:
+		var fp *os.File
+		if fp, err = os.Open(elt.LocalPath); err != nil {
+			return p.skipUnreadable(elt, err)
+		}
+		elt.Contents = fp
+	}
+
+	if err = p.getLocalMetadata(elt); err != nil {
+		elt.Contents.Close()
+		return
+	}
+	return
+}
+
+// close elt.Contents if it was ever opened
+func closeContents(elt *File) {
+	if elt.Contents != nil {
+		elt.Contents.Close()
+	}
+}
+
+// gather the extended attributes and user metadata stored with a file
+func (p *Propolis) getLocalMetadata(elt *File) (err os.Error) {
+	if p.Xattrs {
+		if elt.Xattrs, err = getXattrs(elt.LocalPath); err != nil {
 			return
 		}
 	}
 
+	// user metadata comes from the sidecar file
+	if p.UserMetadata {
+		if elt.Metadata, err = readMetaFile(elt.LocalPath + meta_file_suffix); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Upload a file, or copy it from another key with the same contents.
+//
+// The cache entry is only replaced once the server has the new
+// contents. S3 replaces an object all at once, so until then the old
+// entry still describes what is on the server. A run that dies partway
+// leaves at worst an out-of-date entry, which the next run sees as a
+// local change and uploads again. Copies from that key are guarded by
+// CopyRequest, since its contents may be changing underneath them.
+func (p *Propolis) UploadFile(elt *File) (err os.Error) {
 	// is this a kind of file we don't track?
-	if elt.ServerPath == "" ||
-		(!elt.LocalInfo.IsRegular() &&
-			!elt.LocalInfo.IsSymlink() &&
-			(!p.Directories || !elt.LocalInfo.IsDirectory())) {
+	if elt.ServerPath == "" || !p.tracked(elt.LocalInfo) {
 		if elt.Contents != nil {
 			elt.Contents.Close()
 		}
 		if elt.CacheInfo != nil {
 			// the current file must have replaced an old regular file
-			fmt.Printf("Deleting old file masked by untracked file [%s]\n", elt.ServerPath)
+			elt.Reason = "untracked"
+			p.Announce(elt, "delete", "Deleting old file masked by untracked file [%s]\n", elt.ServerPath)
 			if p.Practice {
 				return
 			}
 
-			if err = p.DeleteRequest(elt); err != nil {
+			if err = p.deleteRemote(elt); err != nil {
 				return
 			}
 			if err = p.DeleteFileInfo(elt); err != nil {
 				return
 			}
 		} else {
-			//fmt.Printf("Ignoring untracked file [%s]\n", elt.ServerPath)
+			p.Log.Debugf("Ignoring untracked file [%s]\n", elt.ServerPath)
 		}
 
 		return
 	}
 
-	// get the md5sum of the local file
+	// a second path to an already-seen inode is stored as a marker
+	if elt.LinkTarget != "" {
+		if elt.Contents != nil {
+			elt.Contents.Close()
+		}
+		p.Announce(elt, "link", "Linking [%s] to [%s]\n", elt.ServerPath, elt.LinkTarget)
+		if p.Practice {
+			return
+		}
+
+		if err = p.LinkRequest(elt); err != nil {
+			return
+		}
+		elt.LocalHashHex = empty_file_md5_hash
+		return p.SetFileInfo(elt, true)
+	}
+
+	// get the md5sum of the local file, without reading it if only
+	// the metadata changed
 	// note: this treats directories like empty files
 	if elt.LocalHashHex == "" {
-		if err = p.GetMd5(elt); err != nil {
+		var cached bool
+		if cached, err = p.cachedMd5(elt); err != nil {
 			return
 		}
+		if !cached {
+			if err = p.openContents(elt); err != nil {
+				return
+			}
+		}
 	}
 
-	// elt.Contents is live now, so make sure it gets closed
+	// elt.Contents may be live now, so make sure it gets closed
+
+	// the scan found identical contents on the server for a file that
+	// was missing from the cache. The listing has no metadata, so get
+	// it: if it matches too there is nothing to upload. Otherwise the
+	// object is in the cache now, and is copied onto itself below to
+	// replace its metadata (a mode, owner, or mtime change, or a
+	// symlink whose target reads like the object's contents).
+	if elt.CacheInfo == nil && elt.LocalHashHex != "" && elt.ServerHashHex == elt.LocalHashHex &&
+		elt.ServerSize == elt.UploadSize {
+		if err = p.StatRequest(elt); err != nil {
+			closeContents(elt)
+			return
+		}
+
+		// a hard link marker is not what the local file is
+		marker := elt.LinkTarget
+		elt.LinkTarget = ""
+		if elt.CacheInfo != nil && marker == "" && changeReason(elt.LocalInfo, elt.CacheInfo) == "" {
+			closeContents(elt)
+			p.Announce(elt, "", "Already on server [%s]\n", elt.ServerPath)
+			if p.Practice {
+				return
+			}
+			return p.SetFileInfo(elt, true)
+		}
+		if elt.CacheInfo != nil {
+			elt.Reason = changeReason(elt.LocalInfo, elt.CacheInfo)
+			if marker != "" {
+				elt.Reason = "link"
+			}
+		}
+	}
 
 	// see if we can do a server-to-server copy
 	var src string
@@ -353,7 +1053,11 @@ func (p *Propolis) UploadFile(elt *File) (err os.Error) {
 		// uploading an empty file is easy; don't bother with anything fancy
 		src = ""
 
-	case elt.LocalHashHex == elt.CacheHashHex:
+	case elt.LocalHashHex == "":
+		// with -no-hash there is nothing to match a copy source with
+		src = ""
+
+	case p.sameContents(elt):
 		// this is just a metadata update with no content change
 		src = elt.ServerPath
 
@@ -361,38 +1065,46 @@ func (p *Propolis) UploadFile(elt *File) (err os.Error) {
 		// look for another file with the same contents
 		// so we can do a server-to-server copy
 
-		// try the scan results first
-		if p.Refresh && p.ByContents != nil {
-			if entry, present := p.ByContents[elt.LocalHashHex]; present && entry.ServerSize == elt.LocalInfo.Size {
-				src = entry.ServerPath
-			}
+		// the contents index covers everything known to be on the
+		// server, from this scan and earlier runs
+		if src, err = p.GetPathFromMd5(elt); err != nil {
+			closeContents(elt)
+			return
 		}
 
-		// try the cache
-		if src == "" {
-			if src, err = p.GetPathFromMd5(elt); err != nil {
-				elt.Contents.Close()
-				return
-			}
+		// a source that is gone locally was renamed or moved, and its
+		// old key is deleted once the uploads are finished
+		if src != "" && p.missingLocally(src) {
+			elt.Reason = "renamed"
 		}
 	}
 
 	// we can do a server-to-server copy
 	if src != "" {
-		fmt.Printf("Copying file [%s] to [%s]\n", src, elt.ServerPath)
+		if elt.Reason == "renamed" {
+			p.Announce(elt, "copy", "Moving file [%s] to [%s]\n", src, elt.ServerPath)
+		} else {
+			p.Announce(elt, "copy", "Copying file [%s] to [%s]\n", src, elt.ServerPath)
+		}
 		if p.Practice {
+			p.recordCopied(elt.UploadSize)
 			return
 		}
 
 		if err = p.CopyRequest(elt, path.Join("/", p.Bucket, src)); err != nil {
 			// copy failed, so try a regular upload
-			fmt.Printf("Copy failed, uploading [%s]\n", elt.ServerPath)
+			p.Announce(elt, "upload", "Copy failed, uploading [%s]\n", elt.ServerPath)
+			if err = p.openContents(elt); err != nil {
+				return
+			}
 			if err = p.UploadRequest(elt); err != nil {
 				// elt.Contents is closed by upload
 				return
 			}
+			p.recordUploaded(elt.UploadSize)
 		} else {
-			elt.Contents.Close()
+			closeContents(elt)
+			p.recordCopied(elt.UploadSize)
 		}
 		if err = p.SetFileInfo(elt, true); err != nil {
 			return
@@ -401,86 +1113,479 @@ func (p *Propolis) UploadFile(elt *File) (err os.Error) {
 	}
 
 	// upload the file
-	fmt.Printf("Uploading [%s]\n", elt.ServerPath)
+	p.Announce(elt, "upload", "Uploading [%s]\n", elt.ServerPath)
 	if p.Practice {
+		p.recordUploaded(elt.UploadSize)
 		return
 	}
 
+	if err = p.openContents(elt); err != nil {
+		return
+	}
 	if err = p.UploadRequest(elt); err != nil {
 		// elt.Contents is closed by upload
 		return
 	}
+	p.recordUploaded(elt.UploadSize)
 	if err = p.SetFileInfo(elt, true); err != nil {
 		return
 	}
 	return
 }
 
+// a bytes.Buffer that can be used as a download target
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() os.Error {
+	return nil
+}
+
 func (p *Propolis) DownloadFile(elt *File) (err os.Error) {
+	p.Announce(elt, "download", "Downloading [%s]\n", elt.ServerPath)
+	if p.Practice {
+		return
+	}
+
 	// make sure the directory containing this file exists
+	dir := filepath.Dir(elt.LocalPath)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	info := elt.CacheInfo
+	switch {
+	case info.IsDirectory():
+		// directory markers become real directories
+		if err = os.MkdirAll(elt.LocalPath, info.Mode&07777); err != nil {
+			return
+		}
+
+		// the marker has no contents, but it may carry metadata
+		if p.Xattrs || p.UserMetadata {
+			if err = p.DownloadRequest(elt, new(bufferCloser)); err != nil {
+				return
+			}
+		}
+
+	case isSpecial(info):
+		// special file markers become real pipes, sockets, and devices
+		if err = p.makeSpecial(elt); err != nil {
+			return
+		}
+
+	case info.IsSymlink():
+		// the contents are the link target
+		target := new(bufferCloser)
+		if err = p.DownloadRequest(elt, target); err != nil {
+			return
+		}
+
+		// replace whatever is there now
+		os.Remove(elt.LocalPath)
+		if err = os.Symlink(target.String(), elt.LocalPath); err != nil {
+			return
+		}
+
+	case elt.LinkTarget != "":
+		// hard link markers are empty; link to the real file instead
+		if err = p.LinkLocal(elt); err != nil {
+			return
+		}
+
+	case info.Size == 0 && !p.Xattrs && !p.UserMetadata:
+		// empty files are a special case: no need to download or compute md5
+		var fp *os.File
+		if fp, err = os.Create(elt.LocalPath); err != nil {
+			return
+		}
+		fp.Close()
+		elt.ServerHashHex = empty_file_md5_hash
+
+	default:
+		// download into a partial file in the same directory (or
+		// -tmp-dir) so the final rename is atomic. A partial file left
+		// over from an interrupted run is picked up where it left off.
+		tmp := p.partialName(elt.LocalPath)
+		if err = checkSpace(tmp, elt.LocalPath, info.Size); err != nil {
+			return
+		}
+		err = p.ResumeDownload(elt, tmp)
+		if isArchived(err) {
+			// archived files must be restored before they can be read
+			os.Remove(tmp)
+			var retry bool
+			if retry, err = p.restoreArchived(elt); !retry {
+				return
+			}
+			err = p.ResumeDownload(elt, tmp)
+		}
+		if err == errNotModified {
+			// the local file already has the contents, so only the
+			// metadata needs updating
+			os.Remove(tmp)
+			p.Log.Debugf("Contents unchanged [%s]\n", elt.ServerPath)
+			elt.ServerHashHex = elt.LocalHashHex
+			err = nil
+			break
+		}
+		if err != nil {
+			// keep the partial file for next time unless it is bad
+			if err == errMd5Mismatch {
+				os.Remove(tmp)
+			}
+			return
+		}
 
-	// empty files are a special case: no need to download or compute md5
+		// compressed files are unpacked unless -keep-gzip is set
+		if elt.Gzip && !p.KeepGzip {
+			if err = gunzipFile(tmp, p.partialName(elt.LocalPath+".gunzip")); err != nil {
+				os.Remove(tmp)
+				return
+			}
+			var unpacked *os.FileInfo
+			if unpacked, err = os.Stat(tmp); err != nil {
+				return
+			}
+			elt.CacheInfo.Size = unpacked.Size
+		}
 
-	// try finding another file with the same contents
+		// hard link markers are empty; link to the real file instead
+		if elt.LinkTarget != "" {
+			os.Remove(tmp)
+			if err = p.LinkLocal(elt); err != nil {
+				return
+			}
+			break
+		}
 
-	// download the file
+		if err = moveFile(tmp, elt.LocalPath); err != nil {
+			os.Remove(tmp)
+			return
+		}
+	}
 
 	// set file metadata
+	if err = p.SetLocalMetaData(elt); err != nil {
+		return
+	}
+
+	// record the new state in the cache
+	if elt.ServerHashHex == "" {
+		elt.ServerHashHex = elt.CacheHashHex
+	}
+	return p.SetFileInfo(elt, false)
+}
+
+// the name of the partial file used while downloading to target
+func (p *Propolis) partialName(target string) string {
+	dir, file := filepath.Split(target)
+	if p.TmpDir != "" {
+		// files from different directories share -tmp-dir, so name
+		// them after the full path
+		hash := md5.New()
+		hash.Write([]byte(target))
+		return filepath.Join(p.TmpDir, ".propolis-"+hex.EncodeToString(hash.Sum())+".part")
+	}
+	return filepath.Join(dir, ".propolis-"+file+".part")
+}
+
+func isPartialName(name string) bool {
+	return strings.HasPrefix(name, ".propolis-") && strings.HasSuffix(name, ".part")
+}
 
+// Download a file into tmp, appending to whatever an earlier attempt
+// left there. The existing bytes are hashed first so the md5 check
+// still covers the whole file.
+func (p *Propolis) ResumeDownload(elt *File, tmp string) (err os.Error) {
+	var fp *os.File
+	if fp, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return
+	}
+	md5hash := md5Hasher.New()
+	var offset int64
+
+	// without a known ETag there is no way to tell if the partial file is stale
+	if elt.ServerHashHex != "" {
+		if offset, err = p.copyBuffer(md5hash, fp); err != nil {
+			fp.Close()
+			return
+		}
+	}
+	if offset > 0 {
+		p.Log.Infof("Resuming at byte %d [%s]\n", offset, elt.ServerPath)
+	} else if err = fp.Truncate(0); err != nil {
+		fp.Close()
+		return
+	}
+	// a local file of the right size may already have the right
+	// contents, in which case the download can be skipped
+	notmatch := ""
+	if offset == 0 && elt.LocalInfo != nil && elt.LocalInfo.IsRegular() &&
+		elt.CacheInfo != nil && elt.LocalInfo.Size == elt.CacheInfo.Size {
+		if elt.LocalHashHex == "" {
+			elt.LocalHashHex, _ = p.md5File(elt.LocalPath)
+		}
+		notmatch = elt.LocalHashHex
+	}
+	return p.DownloadRangeRequest(elt, fp, offset, md5hash, notmatch)
+}
+
+// Recreate a hard link described by a marker object. If the target
+// cannot be linked to, fall back to copying it, either from the local
+// file system or from the server.
+func (p *Propolis) LinkLocal(elt *File) (err os.Error) {
+	root := p.BucketRoot
+	if root != "" {
+		root += "/"
+	}
+
+	// try a real link first
+	var target *File
+	if strings.HasPrefix(elt.LinkTarget, root) {
+		target = p.NewFileServer(elt.LinkTarget, false, false)
+		os.Remove(elt.LocalPath)
+		if err = os.Link(target.LocalPath, elt.LocalPath); err == nil {
+			return p.linkedSize(elt)
+		}
+		p.Log.Warnf("Link failed, copying [%s] to [%s]\n", elt.LinkTarget, elt.ServerPath)
+	}
+
+	dir := filepath.Dir(elt.LocalPath)
+	var fp *os.File
+	if fp, err = ioutil.TempFile(dir, ".propolis-"); err != nil {
+		return
+	}
+	tmp := fp.Name()
+
+	// copy the local target if it is already present
+	var src *os.File
+	if target != nil {
+		src, _ = os.Open(target.LocalPath)
+	}
+	if src != nil {
+		_, err = p.copyBuffer(fp, src)
+		src.Close()
+		fp.Close()
+	} else {
+		// otherwise download the target contents
+		from := new(File)
+		from.ServerPath = elt.LinkTarget
+		from.Url = new(url.URL)
+		*from.Url = *p.Url
+		from.Url.Path = p.keyPath(elt.LinkTarget)
+		err = p.DownloadRequest(from, fp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err = os.Rename(tmp, elt.LocalPath); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return p.linkedSize(elt)
+}
+
+// the marker object is empty, but the cache should record the size
+// of the local file it stands for
+func (p *Propolis) linkedSize(elt *File) (err os.Error) {
+	var info *os.FileInfo
+	if info, err = os.Lstat(elt.LocalPath); err != nil {
+		return
+	}
+	elt.CacheInfo.Size = info.Size
 	return
 }
 
-func (p *Propolis) ScanServer(push bool) (catalog map[string]*File, bycontents map[string]*File, err os.Error) {
-	// scan the entire server directory
-	catalog = make(map[string]*File)
-	bycontents = make(map[string]*File)
+// apply the metadata from the server to a freshly downloaded file
+func (p *Propolis) SetLocalMetaData(elt *File) (err os.Error) {
+	info := elt.CacheInfo
 
-	marker := ""
-	truncated := true
-	for truncated {
-		var listresult *ListBucketResult
+	// changing ownership only works as root, so failure is not an error
+	os.Lchown(elt.LocalPath, info.Uid, info.Gid)
 
-		// how long is the prefix that should be chopped off?
-		prefixlen := len(p.BucketRoot)
+	// permissions and times cannot be set on the link itself
+	if !info.IsSymlink() {
+		if err = os.Chmod(elt.LocalPath, info.Mode&07777); err != nil {
+			return
+		}
+		// the local access time stands unless -preserve-atime restores
+		// the stored one. Change times cannot be set at all.
+		atime := info.Atime_ns
+		if !p.PreserveAtime {
+			if now, e := os.Stat(elt.LocalPath); e == nil {
+				atime = now.Atime_ns
+			}
+		}
+		if err = os.Chtimes(elt.LocalPath, atime, info.Mtime_ns); err != nil {
+			return
+		}
+	}
 
-		// if non-empty, it will be followed by an extra slash
-		if prefixlen > 0 {
-			prefixlen++
+	// the sidecar follows whatever the server has
+	if p.UserMetadata && elt.Metadata != nil {
+		if err = writeMetaFile(elt.LocalPath+meta_file_suffix, elt.Metadata); err != nil {
+			return
+		}
+	}
+
+	// restore extended attributes where the file system allows it
+	for name, value := range elt.Xattrs {
+		if e := setXattr(elt.LocalPath, name, value); e != nil {
+			p.Log.Warnf("Unable to set xattr %s on [%s]: %v\n", name, elt.ServerPath, e)
 		}
+	}
+	return
+}
+
+// Scan the bucket under the root directory, adding each file found to
+// the catalog. Only one page of results is held in memory at a time.
+func (p *Propolis) ScanServer() (err os.Error) {
+	if p.LazyScan {
+		return p.scanServerDir(p.BucketRoot)
+	}
+
+	// scan the entire server directory, starting where an interrupted
+	// scan stopped (the marker is only set while resuming)
+	var marker string
+	if marker, err = p.Db.GetProgress(progress_marker); err != nil {
+		return
+	}
+	truncated := true
+	for truncated {
+		var listresult *ListBucketResult
 
 		// grab a slice of results
-		listresult, err = p.ListRequest(p.BucketRoot, marker, list_request_size, true)
+		listresult, err = p.ListRequest(p.BucketRoot, marker, p.PageSize, true)
 		if err != nil {
 			return
 		}
+		if marker, truncated, err = p.nextMarker(listresult); err != nil {
+			return
+		}
+		if err = p.catalogContents(listresult); err != nil {
+			return
+		}
+		if p.checkpoints() && truncated {
+			if err = p.Db.SetProgress(progress_marker, marker); err != nil {
+				return
+			}
+		}
+	}
 
-		truncated = listresult.IsTruncated
-		if len(listresult.Contents) > 0 {
-			marker = listresult.Contents[len(listresult.Contents)-1].Key
+	return
+}
+
+// scan one server directory, recursing into each subdirectory as it
+// is listed so that only a page of keys is held at a time
+func (p *Propolis) scanServerDir(path string) (err os.Error) {
+	p.Log.Debugf("Listing server directory [%s/]\n", path)
+	marker := ""
+	truncated := true
+	for truncated {
+		var listresult *ListBucketResult
+		listresult, err = p.ListRequest(path, marker, p.PageSize, false)
+		if err != nil {
+			return
+		}
+		if marker, truncated, err = p.nextMarker(listresult); err != nil {
+			return
+		}
+		if err = p.catalogContents(listresult); err != nil {
+			return
 		}
 
-		// process entries one at a time
-		for _, elt := range listresult.Contents {
-			// get the entry
-			path := elt.Key
-			if prefixlen > 0 && !strings.HasPrefix(path, p.BucketRoot+"/") {
-				err = os.NewError("Bucket list returned key without required prefix: " + path)
+		// the prefix includes the trailing slash; the directory key
+		// itself is listed as the first entry of its own scan
+		for _, sub := range listresult.CommonPrefixes {
+			if path != "" && !strings.HasPrefix(sub.Prefix, path+"/") {
+				return os.NewError("Bucket list returned prefix outside directory: " + sub.Prefix)
+			}
+
+			// nothing inside a directory at the depth limit is synced
+			if p.tooDeep(p.keyDepth(sub.Prefix[:len(sub.Prefix)-1]) + 1) {
+				continue
+			}
+			if err = p.scanServerDir(sub.Prefix[:len(sub.Prefix)-1]); err != nil {
 				return
 			}
-			hash := elt.ETag[1 : len(elt.ETag)-1]
-			size := elt.Size
+		}
+	}
 
-			info := p.NewFileServer(path, push)
-			info.ServerHashHex = hash
-			info.ServerSize = size
-			catalog[path] = info
+	return
+}
 
-			// track all non-empty files by content hash
-			if hash != empty_file_md5_hash {
-				bycontents[hash] = info
-			}
+// find where the next page of a bucket list should start
+func (p *Propolis) nextMarker(listresult *ListBucketResult) (marker string, truncated bool, err os.Error) {
+	truncated = listresult.IsTruncated
+	switch {
+	case !p.ListV1:
+		marker = listresult.NextContinuationToken
+		if truncated && marker == "" {
+			err = os.NewError("Bucket list was truncated but had no continuation token")
+		}
+	case listresult.NextMarker != "":
+		// only returned when listing with a delimiter, and may be a
+		// common prefix that sorts after the last key
+		marker = listresult.NextMarker
+	default:
+		// otherwise continue after whichever of the last key and the
+		// last common prefix sorts later, so a page that ends in
+		// subdirectories does not list them again (or, if the server
+		// omits NextMarker, skip the keys between them)
+		if n := len(listresult.Contents); n > 0 {
+			marker = listresult.Contents[n-1].Key
+		}
+		if n := len(listresult.CommonPrefixes); n > 0 && listresult.CommonPrefixes[n-1].Prefix > marker {
+			marker = listresult.CommonPrefixes[n-1].Prefix
+		}
+		if truncated && marker == "" {
+			err = os.NewError("Bucket list was truncated but had no marker")
 		}
 	}
+	return
+}
+
+// add the keys from one page of a bucket list to the catalog
+func (p *Propolis) catalogContents(listresult *ListBucketResult) (err os.Error) {
+	// process entries one at a time
+	for _, elt := range listresult.Contents {
+		// get the entry
+		path := elt.Key
+		if len(p.BucketRoot) > 0 && !strings.HasPrefix(path, p.BucketRoot+"/") {
+			return os.NewError("Bucket list returned key without required prefix: " + path)
+		}
+
+		// deleted files kept by -trash-prefix are not part of the sync
+		if p.isRemoteTrash(path) {
+			continue
+		}
+
+		// neither are files below -max-depth
+		if p.tooDeep(p.keyDepth(path)) {
+			continue
+		}
 
+		// "folder" placeholders made by other tools end with a slash;
+		// they cannot be mapped to a local name, and our own directory
+		// markers never have one
+		if strings.HasSuffix(path, "/") {
+			p.Log.Debugf("Ignoring folder placeholder [%s]\n", path)
+			continue
+		}
+		entry := &CatalogEntry{
+			Path:    path,
+			HashHex: elt.ETag[1 : len(elt.ETag)-1],
+			Size:    elt.Size,
+		}
+		if when, err := time.Parse(list_time_format, elt.LastModified); err == nil {
+			entry.Modified = when.Seconds() * 1e9
+		}
+		if err = p.Db.PutCatalog(entry); err != nil {
+			return
+		}
+	}
 	return
 }
@@ -0,0 +1,718 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Tests of whole sync runs against a fake server
+
+package propolis
+
+import (
+	"fmt"
+	"http"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A file already on the server with the same contents is not sent
+// again when the cache does not know about it. If the stored metadata
+// matches, only the cache entry is written; if not, the object is
+// copied onto itself with the local metadata. A symlink whose target
+// matches a plain object's contents is a metadata change too.
+func TestPushAlreadyOnServer(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+
+	writeFile(t, filepath.Join(root, "same.txt"), "unchanged contents\n")
+	writeFile(t, filepath.Join(root, "new.txt"), "new contents\n")
+	if err := os.Symlink("same.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	s.put("same.txt", "unchanged contents\n", nil)
+	s.put("link", "same.txt", nil)
+
+	// the server objects have no metadata, so both are copied
+	p := newFakePropolis(t, testConfig(root), s)
+	runSync(t, p, true)
+	for _, name := range []string{"same.txt", "link"} {
+		if n := s.count("PUT", name); n != 0 {
+			t.Errorf("%s was uploaded %d times", name, n)
+		}
+		if n := s.count("COPY", name); n != 1 {
+			t.Errorf("%s was copied %d times, expected once", name, n)
+		}
+	}
+	if n := s.count("PUT", "new.txt"); n != 1 {
+		t.Errorf("new.txt was sent %d times, expected once", n)
+	}
+	if obj := s.get("link"); obj == nil {
+		t.Errorf("link is missing from the server")
+	} else if mode, err := strconv.Btoui64(obj.header.Get("X-Amz-Meta-Mode"), 8); err != nil || mode&syscall.S_IFMT != syscall.S_IFLNK {
+		t.Errorf("link was stored with mode %q", obj.header.Get("X-Amz-Meta-Mode"))
+	}
+	info, hashHex, _, err := p.Db.Get("same.txt")
+	switch {
+	case err != nil:
+		t.Errorf("Get: %v", err)
+	case info == nil:
+		t.Errorf("no cache entry for same.txt")
+	case hashHex != md5Hex([]byte("unchanged contents\n")):
+		t.Errorf("cache entry for same.txt has hash %s", hashHex)
+	}
+
+	// with the metadata in place, a run with an empty cache sends nothing
+	s.clearRequests()
+	p = newFakePropolis(t, testConfig(root), s)
+	runSync(t, p, true)
+	for _, name := range []string{"same.txt", "link", "new.txt"} {
+		if n := s.count("PUT", name) + s.count("COPY", name); n != 0 {
+			t.Errorf("%s was sent %d times after its metadata was stored", name, n)
+		}
+	}
+
+	// a mode change is copied, not uploaded
+	if err := os.Chmod(filepath.Join(root, "same.txt"), 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	s.clearRequests()
+	p = newFakePropolis(t, testConfig(root), s)
+	runSync(t, p, true)
+	if n := s.count("PUT", "same.txt"); n != 0 {
+		t.Errorf("same.txt was uploaded %d times after a mode change", n)
+	}
+	if n := s.count("COPY", "same.txt"); n != 1 {
+		t.Errorf("same.txt was copied %d times after a mode change, expected once", n)
+	}
+}
+
+// Hash a file of the given size and read its contents as an upload
+// would. Files up to small_file_size are read once; bigger ones are
+// read twice, once for the hash and again for the upload.
+func benchmarkHashAndRead(b *testing.B, size int64) {
+	b.StopTimer()
+	p, cleanup := benchPropolis()
+	defer cleanup()
+	name := filepath.Join(p.LocalRoot, "contents")
+	if err := ioutil.WriteFile(name, make([]byte, size), 0644); err != nil {
+		panic(err.String())
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		panic(err.String())
+	}
+	b.SetBytes(size)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		elt := p.NewFile("contents", true, true)
+		elt.LocalInfo = new(os.FileInfo)
+		*elt.LocalInfo = *info
+		if err := p.GetMd5(elt); err != nil {
+			panic(err.String())
+		}
+		if _, err := p.copyBuffer(ioutil.Discard, elt.Contents); err != nil {
+			panic(err.String())
+		}
+		elt.Contents.Close()
+	}
+}
+
+func BenchmarkHashOnePass(b *testing.B) {
+	benchmarkHashAndRead(b, small_file_size)
+}
+
+func BenchmarkHashTwoPasses(b *testing.B) {
+	benchmarkHashAndRead(b, small_file_size+1)
+}
+
+// a config for syncing root with a sqlite cache kept in cachedir, so
+// that it persists from one run to the next
+func sqliteConfig(root, cachedir string) *Config {
+	c := testConfig(root)
+	c.CacheBackend = "sqlite"
+	c.CacheLocation = cachedir
+	return c
+}
+
+// A file with the same contents as one uploaded in an earlier run is
+// copied on the server instead of being uploaded again.
+func TestCopyFromEarlierRun(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	cachedir := tempDir(t)
+	defer os.RemoveAll(cachedir)
+	s := newFakeS3()
+	defer s.Close()
+
+	writeFile(t, filepath.Join(root, "first.txt"), "shared contents\n")
+	p := newFakePropolis(t, sqliteConfig(root, cachedir), s)
+	runSync(t, p, true)
+	p.Close()
+	if n := s.count("PUT", "first.txt"); n != 1 {
+		t.Fatalf("first.txt was sent %d times, expected once", n)
+	}
+
+	writeFile(t, filepath.Join(root, "second.txt"), "shared contents\n")
+	p = newFakePropolis(t, sqliteConfig(root, cachedir), s)
+	defer p.Close()
+	runSync(t, p, true)
+
+	if n := s.count("PUT", "second.txt"); n != 0 {
+		t.Errorf("second.txt was uploaded %d times", n)
+	}
+	if n := s.count("COPY", "second.txt"); n != 1 {
+		t.Errorf("second.txt was copied %d times, expected once", n)
+	}
+	if obj := s.get("second.txt"); obj == nil || string(obj.data) != "shared contents\n" {
+		t.Errorf("second.txt is missing or wrong on the server")
+	}
+}
+
+// World-readable files are uploaded public-read only with -public;
+// everything else is private.
+func TestPublicACL(t *testing.T) {
+	for _, public := range []bool{false, true} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		s := newFakeS3()
+		defer s.Close()
+
+		for name, mode := range map[string]uint32{"shared.txt": 0644, "secret.txt": 0600} {
+			writeFile(t, filepath.Join(root, name), name+"\n")
+			if err := os.Chmod(filepath.Join(root, name), mode); err != nil {
+				t.Fatalf("Chmod: %v", err)
+			}
+		}
+		c := testConfig(root)
+		c.Public = public
+		runSync(t, newFakePropolis(t, c, s), true)
+
+		expected := map[string]string{"shared.txt": acl_private, "secret.txt": acl_private}
+		if public {
+			expected["shared.txt"] = acl_public
+		}
+		for name, acl := range expected {
+			obj := s.get(name)
+			if obj == nil {
+				t.Errorf("public=%v: %s was not uploaded", public, name)
+				continue
+			}
+			if got := obj.header.Get("X-Amz-Acl"); got != acl {
+				t.Errorf("public=%v: %s was uploaded with acl %q, expected %q", public, name, got, acl)
+			}
+		}
+	}
+}
+
+// Files missing from the other side are only deleted with -delete, in
+// both directions.
+func TestDeleteFlag(t *testing.T) {
+	for _, remove := range []bool{false, true} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		s := newFakeS3()
+		defer s.Close()
+		c := testConfig(root)
+		c.Delete = remove
+
+		// push: a key with no local file
+		writeFile(t, filepath.Join(root, "local.txt"), "local\n")
+		s.put("remote-only.txt", "remote\n", nil)
+		runSync(t, newFakePropolis(t, c, s), true)
+		if gone := s.get("remote-only.txt") == nil; gone != remove {
+			t.Errorf("delete=%v: push deleted remote-only.txt: %v", remove, gone)
+		}
+		if s.get("local.txt") == nil {
+			t.Errorf("delete=%v: push did not upload local.txt", remove)
+		}
+
+		// pull: a local file with no key
+		writeFile(t, filepath.Join(root, "local-only.txt"), "local only\n")
+		runSync(t, newFakePropolis(t, c, s), false)
+		_, err := os.Lstat(filepath.Join(root, "local-only.txt"))
+		if gone := err != nil; gone != remove {
+			t.Errorf("delete=%v: pull deleted local-only.txt: %v", remove, gone)
+		}
+		if !remove && readFile(filepath.Join(root, "remote-only.txt")) != "remote\n" {
+			t.Errorf("delete=%v: pull did not download remote-only.txt", remove)
+		}
+	}
+}
+
+// "café" as a Mac writes it (NFD) and as Linux does (NFC)
+const nfd_name = "cafe\u0301.txt"
+const nfc_name = "caf\u00e9.txt"
+
+// With -normalize-unicode, an accented name pushed from a Mac and the
+// same name pushed from Linux end up as one key.
+func TestNormalizeUnicode(t *testing.T) {
+	s := newFakeS3()
+	defer s.Close()
+
+	for _, name := range []string{nfd_name, nfc_name} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		writeFile(t, filepath.Join(root, name), "same contents\n")
+		c := testConfig(root)
+		c.NormalizeUnicode = true
+		c.Delete = true
+		p := newFakePropolis(t, c, s)
+		if key := p.NewFile(name, true, true).ServerPath; key != nfc_name {
+			t.Errorf("key for %q is %q, expected %q", name, key, nfc_name)
+		}
+		runSync(t, p, true)
+	}
+
+	if keys := s.keys(); len(keys) != 1 || keys[0] != nfc_name {
+		t.Errorf("keys on the server are %q, expected only %q", keys, nfc_name)
+	}
+	if n := s.count("PUT", nfc_name); n != 1 {
+		t.Errorf("%q was uploaded %d times, expected once", nfc_name, n)
+	}
+	if n := s.count("DELETE", nfc_name); n != 0 {
+		t.Errorf("%q was deleted %d times", nfc_name, n)
+	}
+}
+
+// does name exist locally?
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// With -prune-empty-dirs, directories emptied by pull-side deletes are
+// removed up to, but not including, the local root. A directory that
+// still holds an excluded file is kept.
+func TestPruneEmptyDirs(t *testing.T) {
+	for _, files := range [][]string{
+		{"x/y/gone.txt", "a/keep/.hidden", "a/keep/gone.txt"},
+		{"x/y/gone.txt"},
+	} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		s := newFakeS3()
+		defer s.Close()
+
+		for _, name := range files {
+			writeFile(t, filepath.Join(root, name), name+"\n")
+		}
+		c := testConfig(root)
+		c.Delete = true
+		c.PruneEmptyDirs = true
+		c.IgnoreHidden = true
+		runSync(t, newFakePropolis(t, c, s), false)
+
+		if !exists(root) {
+			t.Fatalf("%v: the local root was removed", files)
+		}
+		for _, name := range []string{"x/y/gone.txt", "x/y", "x", "a/keep/gone.txt"} {
+			if exists(filepath.Join(root, name)) {
+				t.Errorf("%v: %s was not removed", files, name)
+			}
+		}
+		if len(files) > 1 && !exists(filepath.Join(root, "a/keep/.hidden")) {
+			t.Errorf("%v: a/keep/.hidden was removed", files)
+		}
+	}
+}
+
+// With -directories, a directory marker made on the server becomes a
+// local directory with the stored permissions, and the next push does
+// not turn it into an empty regular file.
+func TestDirectoryMarker(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+
+	marker := make(http.Header)
+	marker.Set("Content-Type", directory_mime_type)
+	marker.Set("X-Amz-Meta-Mode", fmt.Sprintf("0%o", s_ifdir|0750))
+	s.put("photos", "", marker)
+	s.put("photos/cat.jpg", "meow\n", nil)
+
+	c := testConfig(root)
+	c.Directories = true
+	p := newFakePropolis(t, c, s)
+	runSync(t, p, false)
+
+	info, err := os.Lstat(filepath.Join(root, "photos"))
+	switch {
+	case err != nil:
+		t.Fatalf("photos was not created: %v", err)
+	case !info.IsDirectory():
+		t.Errorf("photos is not a directory")
+	case info.Permission() != 0750:
+		t.Errorf("photos has permissions 0%o, expected 0750", info.Permission())
+	}
+	if readFile(filepath.Join(root, "photos/cat.jpg")) != "meow\n" {
+		t.Errorf("photos/cat.jpg was not downloaded")
+	}
+
+	// the directory's mtime may have changed as files were written
+	// in it, so the marker may be sent again, but only as a marker
+	runSync(t, p, true)
+	var mode uint32
+	obj := s.get("photos")
+	switch {
+	case obj == nil:
+		t.Errorf("the photos marker was deleted")
+	case obj.header.Get("Content-Type") != directory_mime_type || obj.size != 0:
+		t.Errorf("the photos marker was replaced by a regular file")
+	default:
+		fmt.Sscanf(obj.header.Get("X-Amz-Meta-Mode"), "0%o", &mode)
+		if mode != s_ifdir|0750 {
+			t.Errorf("the photos marker has mode 0%o, expected 0%o", mode, s_ifdir|0750)
+		}
+	}
+}
+
+// A file renamed between runs is copied on the server from its old
+// key, which is then deleted, instead of being uploaded again.
+func TestRenameCopies(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+	c := testConfig(root)
+	c.Delete = true
+
+	writeFile(t, filepath.Join(root, "old/name.txt"), "renamed contents\n")
+	runSync(t, newFakePropolis(t, c, s), true)
+
+	if err := os.MkdirAll(filepath.Join(root, "new"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.Rename(filepath.Join(root, "old/name.txt"), filepath.Join(root, "new/name.txt")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	s.clearRequests()
+	report := runSync(t, newFakePropolis(t, c, s), true)
+
+	if n := s.count("PUT", "new/name.txt"); n != 0 {
+		t.Errorf("new/name.txt was uploaded %d times", n)
+	}
+	if n := s.count("COPY", "new/name.txt"); n != 1 {
+		t.Errorf("new/name.txt was copied %d times, expected once", n)
+	}
+	if s.get("old/name.txt") != nil {
+		t.Errorf("old/name.txt was not deleted")
+	}
+	if obj := s.get("new/name.txt"); obj == nil || string(obj.data) != "renamed contents\n" {
+		t.Errorf("new/name.txt is missing or wrong on the server")
+	}
+	if report.CopiedFiles != 1 || report.UploadedFiles != 0 {
+		t.Errorf("report shows %d copies and %d uploads, expected 1 and 0", report.CopiedFiles, report.UploadedFiles)
+	}
+}
+
+// A reader that waits before each read, like a connection with a long
+// round trip, then returns as much as the read asks for.
+type slowReader struct {
+	remaining int64
+	delay     int64 // ns
+}
+
+func (r *slowReader) Read(buf []byte) (n int, err os.Error) {
+	if r.remaining == 0 {
+		return 0, os.EOF
+	}
+	time.Sleep(r.delay)
+	n = len(buf)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+	}
+	r.remaining -= int64(n)
+	return
+}
+
+const bench_copy_size = 16 * 1024 * 1024
+
+// Copy from a connection that takes 1ms per read with the given buffer
+// size. Each read costs a round trip, so 32 KB buffers are held to
+// about 32 MB/s while 1 MB buffers move about 1 GB/s.
+func benchmarkCopyBuffer(b *testing.B, size int) {
+	b.StopTimer()
+	p, cleanup := benchPropolis()
+	defer cleanup()
+	p.BufferSize = size
+	b.SetBytes(bench_copy_size)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := p.copyBuffer(ioutil.Discard, &slowReader{bench_copy_size, 1e6}); err != nil {
+			panic(err.String())
+		}
+	}
+}
+
+func BenchmarkCopy32K(b *testing.B) {
+	benchmarkCopyBuffer(b, 32*1024)
+}
+
+func BenchmarkCopy1M(b *testing.B) {
+	benchmarkCopyBuffer(b, 1024*1024)
+}
+
+func TestRelativePath(t *testing.T) {
+	for _, test := range []struct {
+		root, name, rel string
+		ok              bool
+	}{
+		{"/", "/", "", true},
+		{"/", "/etc", "etc", true},
+		{"/", "/etc/hosts", "etc/hosts", true},
+		{"/a", "/a", "", true},
+		{"/a", "/a/b", "b", true},
+		{"/a", "/ab", "", false},
+		{"/a", "/", "", false},
+		{"/a/b/c/d", "/a/b/c/d/e/f", "e/f", true},
+		{"/a/b/c/d", "/a/b/c/dx/e", "", false},
+		{"/a/b/c/d", "/a/b/c", "", false},
+	} {
+		if rel, ok := relativePath(test.root, test.name); rel != test.rel || ok != test.ok {
+			t.Errorf("relativePath(%q, %q) = %q, %v; expected %q, %v",
+				test.root, test.name, rel, ok, test.rel, test.ok)
+		}
+	}
+}
+
+// An upload that dies partway leaves the cache entry for the old
+// contents, which still match the server, and the next run sends the
+// new contents.
+func TestInterruptedUpload(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	cachedir := tempDir(t)
+	defer os.RemoveAll(cachedir)
+	s := newFakeS3()
+	defer s.Close()
+	name := filepath.Join(root, "file.txt")
+	v1, v2 := "first version\n", "second, longer version\n"
+
+	writeFile(t, name, v1)
+	p := newFakePropolis(t, sqliteConfig(root, cachedir), s)
+	runSync(t, p, true)
+	p.Close()
+
+	// the connection drops during every upload of the new version
+	writeFile(t, name, v2)
+	s.fail = func(kind, key string) bool {
+		return kind == "PUT" && key == "file.txt"
+	}
+	p = newFakePropolis(t, sqliteConfig(root, cachedir), s)
+	if _, err := p.Sync(true); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	_, hashHex, _, err := p.Db.Get("file.txt")
+	if err != nil || hashHex != md5Hex([]byte(v1)) {
+		t.Errorf("after the failed upload the cache has hash %s, %v; expected the first version", hashHex, err)
+	}
+	if obj := s.get("file.txt"); obj == nil || string(obj.data) != v1 {
+		t.Errorf("after the failed upload the server does not have the first version")
+	}
+	p.Close()
+
+	s.fail = nil
+	p = newFakePropolis(t, sqliteConfig(root, cachedir), s)
+	defer p.Close()
+	runSync(t, p, true)
+	if _, hashHex, _, err = p.Db.Get("file.txt"); err != nil || hashHex != md5Hex([]byte(v2)) {
+		t.Errorf("after the next run the cache has hash %s, %v; expected the second version", hashHex, err)
+	}
+	if obj := s.get("file.txt"); obj == nil || string(obj.data) != v2 {
+		t.Errorf("after the next run the server does not have the second version")
+	}
+}
+
+func TestNextMarker(t *testing.T) {
+	p := new(Propolis)
+	for _, test := range []struct {
+		v1     bool
+		result ListBucketResult
+		marker string
+		err    bool
+	}{
+		// the original API with a delimiter, with and without NextMarker
+		{true, ListBucketResult{IsTruncated: true, NextMarker: "c/",
+			Contents: []Contents{{Key: "a"}}}, "c/", false},
+		{true, ListBucketResult{IsTruncated: true,
+			Contents: []Contents{{Key: "b"}}, CommonPrefixes: []CommonPrefixes{{"a/"}, {"c/"}}}, "c/", false},
+		{true, ListBucketResult{IsTruncated: true,
+			Contents: []Contents{{Key: "d"}}, CommonPrefixes: []CommonPrefixes{{"c/"}}}, "d", false},
+		{true, ListBucketResult{IsTruncated: true}, "", true},
+		{true, ListBucketResult{}, "", false},
+
+		// ListObjectsV2
+		{false, ListBucketResult{IsTruncated: true, NextContinuationToken: "token",
+			Contents: []Contents{{Key: "a"}}}, "token", false},
+		{false, ListBucketResult{IsTruncated: true, Contents: []Contents{{Key: "a"}}}, "", true},
+	} {
+		p.ListV1 = test.v1
+		marker, truncated, err := p.nextMarker(&test.result)
+		if marker != test.marker || truncated != test.result.IsTruncated || (err != nil) != test.err {
+			t.Errorf("v1=%v %+v: got %q, %v, %v", test.v1, test.result, marker, truncated, err)
+		}
+	}
+}
+
+// Every key is found however the listing is split into pages, with
+// either list API, listing everything at once or a directory at a
+// time, and whether or not the server sends NextMarker.
+func TestScanServerPages(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	s := newFakeS3()
+	defer s.Close()
+	keys := []string{"a/1", "a/2", "b", "c/d/e", "c/f", "d", "e/x"}
+	for _, key := range keys {
+		s.put(key, key+"\n", nil)
+	}
+
+	for _, v1 := range []bool{false, true} {
+		for _, lazy := range []bool{false, true} {
+			for _, omit := range []bool{false, true} {
+				for pagesize := 1; pagesize <= 3; pagesize++ {
+					label := fmt.Sprintf("v1=%v lazy=%v no-next-marker=%v page size %d", v1, lazy, omit, pagesize)
+					c := testConfig(root)
+					c.ListV1 = v1
+					c.LazyScan = lazy
+					c.PageSize = pagesize
+					p := newFakePropolis(t, c, s)
+					s.noNextMarker = omit
+					if err := p.ScanServer(); err != nil {
+						t.Errorf("%s: ScanServer: %v", label, err)
+						continue
+					}
+					entries, err := p.Db.Unseen("", len(keys)+1)
+					if err != nil {
+						t.Fatalf("%s: Unseen: %v", label, err)
+					}
+					paths := catalogPaths(entries)
+					sort.Strings(paths)
+					if strings.Join(paths, " ") != strings.Join(keys, " ") {
+						t.Errorf("%s: found %v", label, paths)
+					}
+				}
+			}
+		}
+	}
+}
+
+// With -max-depth, files deeper than the limit are left alone on both
+// sides, even with -delete, whether the server is listed all at once
+// or a directory at a time.
+func TestMaxDepth(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		root := tempDir(t)
+		defer os.RemoveAll(root)
+		s := newFakeS3()
+		defer s.Close()
+
+		for _, name := range []string{"top.txt", "a/mid.txt", "a/b/deep.txt"} {
+			writeFile(t, filepath.Join(root, name), name+"\n")
+		}
+		for _, key := range []string{"gone.txt", "a/gone.txt", "a/b/remote-deep.txt", "x/y/z.txt"} {
+			s.put(key, key+"\n", nil)
+		}
+		c := testConfig(root)
+		c.MaxDepth = 2
+		c.Delete = true
+		c.LazyScan = lazy
+
+		runSync(t, newFakePropolis(t, c, s), true)
+		expected := "a/b/remote-deep.txt a/mid.txt top.txt x/y/z.txt"
+		if keys := strings.Join(s.keys(), " "); keys != expected {
+			t.Errorf("lazy=%v: after push the server has %s, expected %s", lazy, keys, expected)
+		}
+
+		runSync(t, newFakePropolis(t, c, s), false)
+		if !exists(filepath.Join(root, "a/b/deep.txt")) {
+			t.Errorf("lazy=%v: pull deleted a/b/deep.txt", lazy)
+		}
+		for _, name := range []string{"a/b/remote-deep.txt", "x/y/z.txt"} {
+			if exists(filepath.Join(root, name)) {
+				t.Errorf("lazy=%v: pull downloaded %s", lazy, name)
+			}
+		}
+	}
+}
+
+// A run over files whose size and modification time match the cache
+// reads none of them. To prove it, the contents are changed behind
+// the cache's back, keeping the size and time: a run that read them
+// would upload the new contents. A file whose mode also changed gets
+// a metadata update, which is a copy of the object onto itself.
+func TestUnchangedNotRead(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	cachedir := tempDir(t)
+	defer os.RemoveAll(cachedir)
+	s := newFakeS3()
+	defer s.Close()
+
+	const mtime = 1300000000e9
+	names := []string{"same.txt", "chmod.txt"}
+	for _, name := range names {
+		writeFile(t, filepath.Join(root, name), "original\n")
+		if err := os.Chtimes(filepath.Join(root, name), mtime, mtime); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	p := newFakePropolis(t, sqliteConfig(root, cachedir), s)
+	runSync(t, p, true)
+	p.Close()
+
+	for _, name := range names {
+		writeFile(t, filepath.Join(root, name), "replaced\n")
+		if err := os.Chtimes(filepath.Join(root, name), mtime, mtime); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "chmod.txt"), 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	s.clearRequests()
+	p = newFakePropolis(t, sqliteConfig(root, cachedir), s)
+	defer p.Close()
+	runSync(t, p, true)
+
+	for _, name := range names {
+		if n := s.count("PUT", name); n != 0 {
+			t.Errorf("%s was read and uploaded %d times", name, n)
+		}
+		if obj := s.get(name); obj == nil || string(obj.data) != "original\n" {
+			t.Errorf("%s was replaced on the server", name)
+		}
+	}
+	if n := s.count("COPY", "same.txt"); n != 0 {
+		t.Errorf("same.txt was updated %d times", n)
+	}
+	if n := s.count("COPY", "chmod.txt"); n != 1 {
+		t.Errorf("chmod.txt had %d metadata updates, expected 1", n)
+	}
+}
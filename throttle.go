@@ -0,0 +1,100 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Backing off when the server is overloaded
+
+package propolis
+
+import (
+	"http"
+	"os"
+	"sync"
+)
+
+// Limits how many requests run at once, using additive increase and
+// multiplicative decrease: the limit is halved each time the server
+// says to slow down, and grows by one after a full limit's worth of
+// requests succeed in a row.
+type Throttle struct {
+	lock      sync.Mutex
+	limit     int // current limit
+	max       int // the limit never grows past this
+	successes int // successful requests since the last change
+}
+
+func NewThrottle(max int) *Throttle {
+	if max < 1 {
+		max = 1
+	}
+	return &Throttle{limit: max, max: max}
+}
+
+// the current limit
+func (t *Throttle) Limit() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.limit
+}
+
+// Record a successful request. Returns the new limit and whether it
+// changed.
+func (t *Throttle) Success() (limit int, changed bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.limit < t.max {
+		t.successes++
+		if t.successes >= t.limit {
+			t.limit++
+			t.successes = 0
+			changed = true
+		}
+	}
+	return t.limit, changed
+}
+
+// Record a request that the server turned away. Returns the new limit.
+func (t *Throttle) SlowDown() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.limit /= 2
+	if t.limit < 1 {
+		t.limit = 1
+	}
+	t.successes = 0
+	return t.limit
+}
+
+// Is this the server asking us to make fewer requests?
+func isThrottled(err os.Error) bool {
+	e, ok := err.(*S3Error)
+	return ok && (e.Code == "SlowDown" || e.StatusCode == http.StatusServiceUnavailable)
+}
+
+// adjust the throttle after a request
+func (p *Propolis) observe(err os.Error) {
+	switch {
+	case isThrottled(err):
+		p.Log.Warnf("Server is throttling requests, concurrency now %d\n", p.Throttle.SlowDown())
+	case err == nil:
+		if limit, changed := p.Throttle.Success(); changed {
+			p.Log.Debugf("Concurrency now %d\n", limit)
+		}
+	}
+}
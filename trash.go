@@ -0,0 +1,141 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Soft deletes into a trash area
+
+package propolis
+
+import (
+	"http"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// with -trash-prefix, local deletes are moved here, inside the local root
+const local_trash_dir = ".propolis-trash"
+
+// each run puts its trash in a directory named for when it started,
+// so everything one run deleted can be restored or purged together
+const trash_stamp_format = "20060102-150405"
+
+// is this the local trash directory?
+func (p *Propolis) isLocalTrash(name string) bool {
+	return filepath.Clean(name) == filepath.Join(p.LocalRoot, local_trash_dir)
+}
+
+// is this key inside the server trash?
+func (p *Propolis) isRemoteTrash(key string) bool {
+	return p.TrashPrefix != "" && (key == p.TrashPrefix || strings.HasPrefix(key, p.TrashPrefix+"/"))
+}
+
+// Copy a remote file into the trash before it is deleted. The copy
+// keeps the object's metadata, so copying it back restores the file.
+func (p *Propolis) trashRemote(elt *File) (err os.Error) {
+	key := path.Join(p.TrashPrefix, p.trashStamp, elt.ServerPath)
+	p.Log.Debugf("Moving to trash [%s]\n", key)
+
+	// objects over 5 GB have to be copied in parts
+	if elt.ServerSize > max_copy_size || elt.CacheInfo != nil && elt.CacheInfo.Size > max_copy_size {
+		var done bool
+		if done, err = p.copyLargeObject(elt, key); err != nil || done {
+			return
+		}
+	}
+	header := make(http.Header)
+	header.Set("X-Amz-Metadata-Directive", "COPY")
+	_, err = p.SendRequest("PUT", false, elt.FullServerPath, p.keyUrl(key, nil), nil, "", nil, header)
+	return
+}
+
+// Delete a local file, or with -trash-prefix move it into the trash
+// directory. Directories are only deleted when empty, so they are
+// removed either way.
+func (p *Propolis) removeLocal(elt *File) (err os.Error) {
+	if p.TrashPrefix == "" || elt.LocalInfo.IsDirectory() {
+		return os.Remove(elt.LocalPath)
+	}
+	rel, ok := relativePath(filepath.Clean(p.LocalRoot), elt.LocalPath)
+	if !ok || rel == "" {
+		return os.NewError("cannot move file outside the local root to the trash: " + elt.LocalPath)
+	}
+	target := filepath.Join(p.LocalRoot, local_trash_dir, p.trashStamp, filepath.FromSlash(rel))
+	p.Log.Debugf("Moving to trash [%s]\n", target)
+	if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return
+	}
+	return os.Rename(elt.LocalPath, target)
+}
+
+// Delete trash from before p.TrashCutoff, on the server and locally.
+func (p *Propolis) PurgeTrash() (err os.Error) {
+	// objects are dated by when they were copied into the trash
+	if !p.Anonymous {
+		marker := ""
+		truncated := true
+		for truncated {
+			var listresult *ListBucketResult
+			if listresult, err = p.ListRequest(p.TrashPrefix, marker, p.PageSize, true); err != nil {
+				return
+			}
+			if marker, truncated, err = p.nextMarker(listresult); err != nil {
+				return
+			}
+			for _, elt := range listresult.Contents {
+				when, er := time.Parse(list_time_format, elt.LastModified)
+				if er != nil || when.Seconds()*1e9 >= p.TrashCutoff {
+					continue
+				}
+				p.Log.Infof("Purging from trash [%s]\n", elt.Key)
+				if p.Practice {
+					continue
+				}
+				if _, err = p.SendRequest("DELETE", false, "", p.keyUrl(elt.Key, nil), nil, "", nil, nil); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	// local trash is dated by the name of each run's directory
+	dir := filepath.Join(p.LocalRoot, local_trash_dir)
+	runs, er := ioutil.ReadDir(dir)
+	if er != nil {
+		// no trash yet
+		return
+	}
+	for _, run := range runs {
+		when, er := time.Parse(trash_stamp_format, run.Name)
+		if er != nil || when.Seconds()*1e9 >= p.TrashCutoff {
+			continue
+		}
+		p.Log.Infof("Purging from trash [%s]\n", filepath.Join(dir, run.Name))
+		if p.Practice {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(dir, run.Name)); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,179 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// User metadata from .meta sidecar files
+
+package propolis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// user metadata is stored as one header per key
+	meta_header_prefix = "X-Amz-Meta-"
+
+	// with -user-metadata, name.meta holds the metadata for name
+	meta_file_suffix = ".meta"
+
+	// S3 limits the user-defined metadata on an object to 2 KB
+	max_user_metadata = 2 * 1024
+)
+
+// metadata names propolis uses itself, which a .meta file cannot set
+var reserved_meta_names = []string{
+	"atime",
+	"gid",
+	"hardlink-target",
+	"md5",
+	"mode",
+	"mtime",
+	"rdev",
+	"uid",
+	"uncompressed-size",
+}
+
+// is this a sidecar file rather than a file to sync?
+func isMetaFile(name string) bool {
+	return strings.HasSuffix(name, meta_file_suffix)
+}
+
+// Check that a metadata pair can be stored as a header and read back
+// unchanged: names are lowercase letters, digits, '-', and '_', and
+// values are printable ASCII.
+func checkMetaPair(name, value string) os.Error {
+	if name == "" {
+		return os.NewError("empty metadata name")
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q in metadata name %q", c, name)
+		}
+	}
+	for _, reserved := range reserved_meta_names {
+		if name == reserved {
+			return fmt.Errorf("metadata name %q is reserved", name)
+		}
+	}
+	if strings.HasPrefix(name, strings.ToLower(xattr_header_prefix[len(meta_header_prefix):])) {
+		return fmt.Errorf("metadata name %q is reserved", name)
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < ' ' || value[i] > '~' {
+			return fmt.Errorf("invalid character in value of metadata %q", name)
+		}
+	}
+	return nil
+}
+
+// Read the key=value pairs in a sidecar file. Blank lines and lines
+// starting with # are ignored, and a missing file means no metadata.
+func readMetaFile(filename string) (meta map[string]string, err os.Error) {
+	var fp *os.File
+	if fp, err = os.Open(filename); err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+			err = nil
+		}
+		return
+	}
+	defer fp.Close()
+
+	meta = make(map[string]string)
+	size := 0
+	reader := bufio.NewReader(fp)
+	for lineno := 1; ; lineno++ {
+		line, er := reader.ReadString('\n')
+		if er != nil && er != os.EOF {
+			return nil, er
+		}
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			eq := strings.Index(line, "=")
+			if eq < 0 {
+				return nil, fmt.Errorf("%s:%d: expected key=value", filename, lineno)
+			}
+			name := strings.ToLower(strings.TrimSpace(line[:eq]))
+			value := strings.TrimSpace(line[eq+1:])
+			if err = checkMetaPair(name, value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+			}
+			meta[name] = value
+			size += len(name) + len(value)
+		}
+		if er == os.EOF {
+			break
+		}
+	}
+	if size > max_user_metadata {
+		return nil, fmt.Errorf("%s: %d bytes of metadata, but only %d are allowed",
+			filename, size, max_user_metadata)
+	}
+	return
+}
+
+// Write a sidecar file, or remove it if there is no metadata.
+func writeMetaFile(filename string, meta map[string]string) os.Error {
+	if len(meta) == 0 {
+		err := os.Remove(filename)
+		if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+			err = nil
+		}
+		return err
+	}
+	var names []string
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s=%s\n", name, meta[name])
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// gather the user metadata stored in a response
+func (p *Propolis) GetResponseUserMetadata(resp *http.Response) (meta map[string]string) {
+	meta = make(map[string]string)
+	for key, values := range resp.Header {
+		if len(key) <= len(meta_header_prefix) ||
+			!strings.HasPrefix(strings.ToLower(key), strings.ToLower(meta_header_prefix)) ||
+			len(values) == 0 {
+			continue
+		}
+		name := strings.ToLower(key[len(meta_header_prefix):])
+
+		// skip propolis's own headers, and anything a .meta file
+		// could not hold
+		if checkMetaPair(name, values[0]) != nil {
+			continue
+		}
+		meta[name] = values[0]
+	}
+	return
+}
@@ -0,0 +1,175 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Checking the server copy of cached objects
+
+package propolis
+
+import (
+	"os"
+	"rand"
+	"sync"
+	"time"
+)
+
+// guards the random choices made by -verify-sample during a sync
+var sampleLock sync.Mutex
+var sampleSeed sync.Once
+
+// Download the cached objects under the bucket root and check that
+// their contents still match the md5 hashes in the cache. Nothing is
+// changed; problems are recorded in the report's Status under missing
+// (gone from the server), corrupt (contents do not match the ETag), or
+// changed (replaced since the cache was updated). sample is the
+// percent of objects to check, chosen at random.
+func (p *Propolis) Verify(sample float64) (report *Report, err os.Error) {
+	p.report = newReport()
+	report = p.report
+	p.Progress.Start()
+	defer p.Progress.Stop()
+
+	// pick the objects to check
+	rand.Seed(time.Nanoseconds())
+	hashes := make(map[string]string)
+	var paths []string
+	err = p.Db.Scan(p.BucketRoot, func(hashHex string, info *os.FileInfo, synced int64) {
+		if sample >= 100 || rand.Float64()*100 < sample {
+			hashes[info.Name] = hashHex
+			paths = append(paths, info.Name)
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+	p.Status("Verifying objects...")
+
+	// download them in parallel
+	todo := make(chan string)
+	done := make(chan bool)
+	for i := 0; i < p.DownloadConcurrency; i++ {
+		go func() {
+			for path := range todo {
+				p.verifyObject(path, hashes[path])
+			}
+			done <- true
+		}()
+	}
+	for _, path := range paths {
+		todo <- path
+	}
+	close(todo)
+	for i := 0; i < p.DownloadConcurrency; i++ {
+		<-done
+	}
+
+	report.sortPaths()
+	return
+}
+
+// check a single object against its cached md5 hash
+func (p *Propolis) verifyObject(path, hashHex string) {
+	elt := p.NewFileServer(path, false, false)
+	err := p.DownloadRequest(elt, discardWriter{})
+	switch {
+	case err == errMd5Mismatch:
+		p.Log.Warnf("Corrupt object [%s]\n", path)
+		p.recordStatus(elt, "corrupt")
+	case isArchived(err):
+		p.Log.Warnf("Skipping archived object [%s]\n", path)
+		p.recordSkipped(elt)
+	case err != nil:
+		if e, ok := err.(*S3Error); ok && e.StatusCode == 404 {
+			p.Log.Warnf("Missing object [%s]\n", path)
+			p.recordStatus(elt, "missing")
+			return
+		}
+		p.recordError(elt, err)
+	case elt.ServerHashHex != hashHex:
+		p.Log.Warnf("Changed object [%s]\n", path)
+		p.recordStatus(elt, "changed")
+	default:
+		p.Log.Debugf("Verified [%s]\n", path)
+		p.recordVerified()
+	}
+}
+
+// throws away downloaded contents once they have been hashed
+type discardWriter struct{}
+
+func (discardWriter) Write(buf []byte) (int, os.Error) {
+	return len(buf), nil
+}
+
+func (discardWriter) Close() os.Error {
+	return nil
+}
+
+// Is elt one of the files -verify-sample checks this run? The choice
+// is made the first time a file is asked about, and sticks.
+func (p *Propolis) sampled(elt *File) bool {
+	if p.VerifySample <= 0 {
+		return false
+	}
+	sampleLock.Lock()
+	defer sampleLock.Unlock()
+	if !elt.sampleDrawn {
+		sampleSeed.Do(func() { rand.Seed(time.Nanoseconds()) })
+		elt.sampleDrawn = true
+		elt.sampled = p.VerifySample >= 100 || rand.Float64()*100 < p.VerifySample
+	}
+	return elt.sampled
+}
+
+// report a sampled file whose contents did not match the cache; the
+// sync that follows corrects it
+func (p *Propolis) warnSampled(elt *File) {
+	if elt.sampled && !p.Paranoid {
+		p.Log.Warnf("Sampled file does not match the cache [%s]\n", elt.ServerPath)
+	}
+}
+
+// Check the server copy of a sampled file against its cache entry. If
+// they differ, the cache is corrected and elt describes what the server
+// has, so the sync that follows brings the two sides back together.
+func (p *Propolis) checkSampledServer(elt *File) (err os.Error) {
+	server := p.NewFileServer(elt.ServerPath, elt.Push, elt.Immediate)
+	if err = p.StatRequest(server); err != nil {
+		return
+	}
+	switch {
+	case server.CacheInfo == nil:
+		p.Log.Warnf("Cached file is missing from the server [%s]\n", elt.ServerPath)
+		if err = p.DeleteFileInfo(elt); err != nil {
+			return
+		}
+		elt.CacheInfo = nil
+		elt.CacheHashHex = ""
+		elt.CacheChecksumHex = ""
+
+	case server.CacheHashHex != elt.CacheHashHex || changeReason(server.CacheInfo, elt.CacheInfo) != "":
+		p.Log.Warnf("Server copy does not match the cache [%s]\n", elt.ServerPath)
+		elt.CacheInfo = server.CacheInfo
+		elt.CacheHashHex = server.CacheHashHex
+		elt.CacheChecksumHex = server.CacheChecksumHex
+		elt.ServerHashHex = server.ServerHashHex
+		err = p.SetFileInfo(elt, false)
+	}
+	return
+}
@@ -0,0 +1,158 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Versioned bucket support
+
+package propolis
+
+import (
+	"os"
+	"url"
+)
+
+// result from a bucket versioning request
+type VersioningConfiguration struct {
+	Status string
+}
+
+// results from a version list request
+type ListVersionsResult struct {
+	IsTruncated         bool
+	NextKeyMarker       string
+	NextVersionIdMarker string
+	Version             []Version
+	DeleteMarker        []Version
+}
+
+type Version struct {
+	Key       string
+	VersionId string
+	IsLatest  bool
+	Size      int64
+}
+
+// Get the versioning status of the bucket: "Enabled", "Suspended",
+// or "" if versioning has never been turned on.
+func (p *Propolis) GetVersioningRequest() (status string, err os.Error) {
+	u := p.keyUrl("", nil)
+	u.RawQuery = "versioning"
+	result := new(VersioningConfiguration)
+	if err = p.getXml(u, result); err != nil {
+		return
+	}
+	status = result.Status
+	return
+}
+
+// List the versions of key, continuing from the given markers.
+// Other keys that have key as a prefix are also returned.
+func (p *Propolis) ListVersionsRequest(key, keymarker, versionidmarker string) (result *ListVersionsResult, err os.Error) {
+	query := make(url.Values)
+	query.Add("prefix", key)
+	if keymarker != "" {
+		query.Add("key-marker", keymarker)
+		query.Add("version-id-marker", versionidmarker)
+	}
+	u := p.keyUrl("", query)
+
+	// versions is a flag with no value
+	u.RawQuery = "versions&" + u.RawQuery
+
+	result = new(ListVersionsResult)
+	if err = p.getXml(u, result); err != nil {
+		result = nil
+	}
+	return
+}
+
+// Delete a single version of a key (or a delete marker). Unlike a
+// plain delete, this actually removes the data.
+func (p *Propolis) DeleteVersionRequest(key, versionid string) (err os.Error) {
+	query := make(url.Values)
+	query.Add("versionId", versionid)
+	_, err = p.SendRequest("DELETE", false, "", p.keyUrl(key, query), nil, "", nil, nil)
+	return
+}
+
+// Check once whether the bucket keeps old versions, and warn if
+// deleting and replacing files will not free any storage.
+func (p *Propolis) checkVersioning() {
+	status, err := p.GetVersioningRequest()
+	if err != nil {
+		p.Log.Warnf("Unable to get versioning status for bucket [%s]: %v\n", p.Bucket, err)
+		return
+	}
+	p.Versioned = status != ""
+	if p.Versioned && !p.PurgeVersions {
+		p.Log.Warnf("Versioning is %s for bucket [%s]: deleted files will "+
+			"still use storage (see -purge-versions)\n", status, p.Bucket)
+	}
+}
+
+// Delete a remote file. In a versioned bucket this only adds a delete
+// marker unless p.PurgeVersions is set, in which case every version
+// is removed.
+func (p *Propolis) deleteRemote(elt *File) (err os.Error) {
+	if p.TrashPrefix != "" {
+		if err = p.trashRemote(elt); err != nil {
+			return
+		}
+	}
+	if p.Versioned && p.PurgeVersions {
+		return p.purgeVersions(elt.ServerPath, true)
+	}
+	return p.DeleteRequest(elt)
+}
+
+// Delete the versions that an upload replaced, if requested.
+func (p *Propolis) purgeNoncurrent(elt *File) os.Error {
+	if !p.Versioned || !p.PurgeNoncurrent || p.Practice {
+		return nil
+	}
+	return p.purgeVersions(elt.ServerPath, false)
+}
+
+// Delete the old versions of key. If all is set, the current version
+// and any delete markers go too.
+func (p *Propolis) purgeVersions(key string, all bool) (err os.Error) {
+	keymarker, versionidmarker := "", ""
+	for {
+		var result *ListVersionsResult
+		if result, err = p.ListVersionsRequest(key, keymarker, versionidmarker); err != nil {
+			return
+		}
+		for _, list := range [][]Version{result.Version, result.DeleteMarker} {
+			for _, version := range list {
+				if version.Key != key || version.IsLatest && !all {
+					continue
+				}
+				p.Log.Debugf("Deleting version %s of [%s]\n", version.VersionId, key)
+				if err = p.DeleteVersionRequest(key, version.VersionId); err != nil {
+					return
+				}
+			}
+		}
+		if !result.IsTruncated {
+			return
+		}
+		keymarker, versionidmarker = result.NextKeyMarker, result.NextVersionIdMarker
+	}
+	return
+}
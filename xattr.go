@@ -0,0 +1,111 @@
+//
+// Propolis: Amazon S3 <--> local file system synchronizer
+// Copyright © 2011 Russ Ross <russ@russross.com>
+//
+// This file is part of Propolis
+//
+// Propolis is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 2 of the License, or
+// (at your option) any later version.
+// 
+// Propolis is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with Propolis.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Extended attribute support (Linux)
+
+package propolis
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// list and read all extended attributes of a file without following symlinks
+// file systems that do not support xattrs simply report none
+func getXattrs(path string) (attrs map[string]string, err os.Error) {
+	attrs = make(map[string]string)
+
+	// get the list of names
+	size, e := lxattrCall(syscall.SYS_LLISTXATTR, path, "", nil)
+	if e == syscall.ENOTSUP {
+		return
+	}
+	if e != 0 {
+		return nil, os.NewSyscallError("llistxattr", e)
+	}
+	if size == 0 {
+		return
+	}
+	buf := make([]byte, size)
+	if size, e = lxattrCall(syscall.SYS_LLISTXATTR, path, "", buf); e != 0 {
+		return nil, os.NewSyscallError("llistxattr", e)
+	}
+
+	// the names are NUL-terminated
+	for _, name := range bytes.Split(buf[:size], []byte{0}, -1) {
+		if len(name) == 0 {
+			continue
+		}
+
+		// find the size of the value, then read it
+		vsize, e := lxattrCall(syscall.SYS_LGETXATTR, path, string(name), nil)
+		if e != 0 {
+			return nil, os.NewSyscallError("lgetxattr", e)
+		}
+		value := make([]byte, vsize)
+		if vsize > 0 {
+			if vsize, e = lxattrCall(syscall.SYS_LGETXATTR, path, string(name), value); e != 0 {
+				return nil, os.NewSyscallError("lgetxattr", e)
+			}
+		}
+		attrs[string(name)] = string(value[:vsize])
+	}
+	return
+}
+
+// set a single extended attribute without following symlinks
+func setXattr(path, name, value string) os.Error {
+	var pathp, namep, valuep *byte
+	pathp = syscall.StringBytePtr(path)
+	namep = syscall.StringBytePtr(name)
+	if len(value) > 0 {
+		valuep = &[]byte(value)[0]
+	}
+	_, _, e := syscall.Syscall6(syscall.SYS_LSETXATTR,
+		uintptr(unsafe.Pointer(pathp)),
+		uintptr(unsafe.Pointer(namep)),
+		uintptr(unsafe.Pointer(valuep)),
+		uintptr(len(value)),
+		0, 0)
+	if e != 0 {
+		return os.NewSyscallError("lsetxattr", int(e))
+	}
+	return nil
+}
+
+// issue llistxattr (name == "") or lgetxattr, returning the size
+// of the result. a nil buffer asks for the size only.
+func lxattrCall(trap uintptr, path, name string, buf []byte) (size int, errno int) {
+	var bufp *byte
+	if len(buf) > 0 {
+		bufp = &buf[0]
+	}
+	pathp := uintptr(unsafe.Pointer(syscall.StringBytePtr(path)))
+	var r, e uintptr
+	if trap == syscall.SYS_LLISTXATTR {
+		r, _, e = syscall.Syscall(trap, pathp, uintptr(unsafe.Pointer(bufp)), uintptr(len(buf)))
+	} else {
+		namep := uintptr(unsafe.Pointer(syscall.StringBytePtr(name)))
+		r, _, e = syscall.Syscall6(trap, pathp, namep, uintptr(unsafe.Pointer(bufp)), uintptr(len(buf)), 0, 0)
+	}
+	return int(r), int(e)
+}